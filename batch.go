@@ -3,24 +3,48 @@ package superblock
 import (
 	"context"
 	"errors"
+	"runtime"
 
 	"github.com/ipfs/go-datastore"
 
+	ihash "github.com/ajnavarro/super-blockstore/hash"
 	"github.com/ajnavarro/super-blockstore/packfile"
 )
 
-var ErrNotSupportedOnBatches = errors.New("this method is not supported on batches")
+// ErrBatchDone is returned when using a batch already committed or discarded.
+var ErrBatchDone = errors.New("batch already committed or discarded")
 
 var _ datastore.Batch = &Batch{}
 
+// Batch writes its values into a new packfile as they are put, and makes them
+// available with its deletions on Commit. Only the keys are kept in memory.
+// Batches dropped without calling Commit or Discard are discarded when
+// garbage collected.
 type Batch struct {
+	ds       *Datastore
 	packProc *packfile.PackProcessing
+
+	// writes contains the keys whose last operation was a Put
+	writes map[ihash.Hash]struct{}
+	// deleted contains the keys whose last operation was a deletion
+	deleted map[ihash.Hash]struct{}
+	// overwritten is set when a key is put more than once, so the packfile
+	// contains blocks to drop on Commit
+	overwritten bool
+	done        bool
 }
 
-func NewBatch(packProcessing *packfile.PackProcessing) *Batch {
-	return &Batch{
+func NewBatch(ds *Datastore, packProcessing *packfile.PackProcessing) *Batch {
+	b := &Batch{
+		ds:       ds,
 		packProc: packProcessing,
+		writes:   make(map[ihash.Hash]struct{}),
+		deleted:  make(map[ihash.Hash]struct{}),
 	}
+
+	runtime.SetFinalizer(b, (*Batch).finalize)
+
+	return b
 }
 
 // Put stores the object `value` named by `key`.
@@ -33,18 +57,89 @@ func NewBatch(packProcessing *packfile.PackProcessing) *Batch {
 // or risk getting incorrect values. It may also be useful to expose a more
 // type-safe interface to your application, and do the checking up-front.
 func (tx *Batch) Put(ctx context.Context, key datastore.Key, value []byte) error {
-	return tx.packProc.WriteBlock(key.Bytes(), value)
+	if tx.done {
+		return ErrBatchDone
+	}
+
+	k := ihash.SumBytes(key.Bytes())
+	delete(tx.deleted, k)
+	tx.writes[k] = struct{}{}
+
+	// blocks on the same packfile keep the first value
+	if tx.packProc.Contains(k) {
+		tx.overwritten = true
+	}
+
+	return tx.packProc.WriteHashedBlock(k, key.Bytes(), value)
 }
 
-// Delete removes the value for given `key`. If the key is not in the
-// datastore, this method returns no error.
+// Delete removes the value for given `key`, also if it was put on the batch
+// before. If the key is not in the datastore, this method returns no error.
 func (tx *Batch) Delete(ctx context.Context, key datastore.Key) error {
-	return ErrNotSupportedOnBatches
+	if tx.done {
+		return ErrBatchDone
+	}
+
+	k := ihash.SumBytes(key.Bytes())
+	delete(tx.writes, k)
+	tx.deleted[k] = struct{}{}
+
+	return nil
 }
 
 // Commit finalizes a transaction, attempting to commit it to the Datastore.
 // May return an error if the transaction has gone stale. The presence of an
 // error is an indication that the data was not committed to the Datastore.
 func (tx *Batch) Commit(ctx context.Context) error {
-	return tx.packProc.Commit()
+	if err := tx.finish(); err != nil {
+		return err
+	}
+
+	if tx.overwritten {
+		// only the last value of each key is kept, as on transactions
+		pp, err := tx.packProc.Compact(func(h ihash.Hash) bool {
+			_, ok := tx.writes[h]
+			return ok
+		})
+		if err != nil {
+			return err
+		}
+
+		tx.packProc = pp
+	}
+
+	// the values and the deletions are made available at once, as on
+	// transactions
+	return tx.ds.commitTxn(tx.packProc, hashes(tx.writes), tx.deleted)
+}
+
+// Discard removes the packfile being written by the batch. The batch cannot
+// be used after that.
+func (tx *Batch) Discard() error {
+	if err := tx.finish(); err != nil {
+		return err
+	}
+
+	return tx.packProc.Discard()
+}
+
+// finish marks the batch as done, so it is not discarded when garbage
+// collected.
+func (tx *Batch) finish() error {
+	if tx.done {
+		return ErrBatchDone
+	}
+
+	tx.done = true
+	runtime.SetFinalizer(tx, nil)
+
+	return nil
+}
+
+// finalize discards a batch that was dropped without calling Commit or
+// Discard.
+func (tx *Batch) finalize() {
+	if !tx.done {
+		tx.packProc.Discard()
+	}
 }
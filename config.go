@@ -1,14 +1,60 @@
 package superblock
 
+import (
+	"time"
+
+	"github.com/ajnavarro/super-blockstore/iio"
+	"github.com/ajnavarro/super-blockstore/packfile"
+)
+
 type DatastoreConfig struct {
 	Folder string
+	// FS is the filesystem where the datastore is stored. Defaults to the
+	// operating system one.
+	FS iio.FS
 
 	BlockCacheNumElements int
 	PackMaxNumElements    int
 	MaxOpenPacks          int
+
+	// PackMaxSize is the size in bytes that makes the packfile with single
+	// Puts to be committed. Defaults to 256 MiB. Negative values disable it.
+	PackMaxSize int64
+	// PackMaxAge is the time single Puts can wait before being committed,
+	// if Sync is not called before. Defaults to 30 seconds. Negative values
+	// disable it.
+	PackMaxAge time.Duration
+
+	// Durability sets which data is synced to disk: none, data or full.
+	// With none, committed data survives process crashes but not power
+	// losses. Data syncs file contents, and full also syncs directories
+	// after renaming files into them. Defaults to full.
+	Durability string
+
+	// WAL records single Puts and Deletes on a write-ahead log before
+	// returning, so they survive a crash before being committed.
+	WAL bool
+
+	// SkipChecksumVerification avoids checking block checksums on Get.
+	// Corrupted blocks are still detected by Check.
+	SkipChecksumVerification bool
+
+	// Compression is the codec used to compress blocks on new packfiles:
+	// none, s2, snappy or zstd. Defaults to s2.
+	Compression string
+	// CompressionLevel is the zstd compression level, from 1 to 22. Zero uses
+	// the zstd default level.
+	CompressionLevel int
+	// DictionarySize is the maximum size of the zstd dictionaries trained
+	// from a sample of blocks when repacking. Zero disables them.
+	DictionarySize int
 }
 
 func (cfg *DatastoreConfig) FillDefaults() {
+	if cfg.FS == nil {
+		cfg.FS = iio.OS
+	}
+
 	if cfg.BlockCacheNumElements == 0 {
 		cfg.BlockCacheNumElements = 1000
 	}
@@ -20,4 +66,20 @@ func (cfg *DatastoreConfig) FillDefaults() {
 	if cfg.MaxOpenPacks == 0 {
 		cfg.MaxOpenPacks = 10
 	}
+
+	if cfg.PackMaxSize == 0 {
+		cfg.PackMaxSize = 256 << 20
+	}
+
+	if cfg.PackMaxAge == 0 {
+		cfg.PackMaxAge = 30 * time.Second
+	}
+
+	if cfg.Durability == "" {
+		cfg.Durability = iio.DurabilityFull.String()
+	}
+
+	if cfg.Compression == "" {
+		cfg.Compression = packfile.CodecS2.String()
+	}
 }
@@ -1,12 +1,15 @@
 package superblock
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
 	"io/fs"
 	"path"
-	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/ipfs/go-datastore"
@@ -14,6 +17,7 @@ import (
 	"go.uber.org/multierr"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
 	"github.com/ajnavarro/super-blockstore/packfile"
 )
 
@@ -22,68 +26,183 @@ var _ datastore.Batching = &Datastore{}
 var _ datastore.CheckedDatastore = &Datastore{}
 var _ datastore.GCDatastore = &Datastore{}
 var _ datastore.PersistentDatastore = &Datastore{}
+var _ datastore.TxnDatastore = &Datastore{}
 
 const packFolder = "packs"
 const processingFolder = "processing"
 
 const tombstoneName = "tombstone.bin"
+const walName = "wal.log"
+const txnFolder = "transactions"
 
 type Datastore struct {
 	ts    *packfile.Tombstone
 	cache *lru.Cache[ihash.Hash, []byte]
 	pp    *packfile.PackPack
 
-	mu            sync.Mutex // protects singleObjects
+	mu sync.Mutex // protects singleObjects, rollover and rolloverErr
+	// singleObjects is the packfile where single Puts are written. It is nil
+	// until the first Put after a commit.
 	singleObjects *packfile.PackProcessing
-
+	// rollover commits single Puts when they are too old. It is set when
+	// the first block is written into singleObjects.
+	rollover *time.Timer
+	// rolloverErr is the error from the last commit done by rollover. It is
+	// returned by the following Put or Sync.
+	rolloverErr error
+
+	// memtable contains the single Puts not committed yet, so they can be
+	// read before Sync, and written again if committing singleObjects fails.
+	// It is only modified holding mu, and replaced when singleObjects is
+	// committed.
+	memMu    sync.RWMutex
+	memtable map[ihash.Hash]*txnWrite
+
+	// wal records single Puts and Deletes until they are committed. It is
+	// nil if disabled.
+	wal *wal
+
+	gcMu  sync.Mutex // avoids concurrent GC executions
+	delMu sync.Mutex // orders deletions on the tombstone by sequence number
+	// viewMu is held for reading by lookups, and for writing while making
+	// available the changes of a transaction, so they are seen at once.
+	viewMu sync.RWMutex
+	// snapshots are the ones used by open transactions. It is protected by
+	// delMu.
+	snapshots map[*snapshot]struct{}
+
+	fsys            iio.FS
 	folder          string
 	elementsPerPack int
+	maxPackSize     int64
+	maxPackAge      time.Duration
+	durability      iio.Durability
 }
 
 func NewDatastore(cfg *DatastoreConfig) (*Datastore, error) {
 	cfg.FillDefaults()
 
-	ts, err := packfile.NewTombstonePath(path.Join(cfg.Folder, tombstoneName))
+	codec, err := packfile.ParseCodec(cfg.Compression)
 	if err != nil {
 		return nil, err
 	}
 
-	lcache, err := lru.New[ihash.Hash, []byte](cfg.BlockCacheNumElements)
+	durability, err := iio.ParseDurability(cfg.Durability)
 	if err != nil {
 		return nil, err
 	}
 
-	processingFolder := path.Join(cfg.Folder, processingFolder)
+	ts, err := packfile.NewTombstoneFS(cfg.FS, path.Join(cfg.Folder, tombstoneName))
+	if err != nil {
+		return nil, err
+	}
 
-	ppf := path.Join(cfg.Folder, packFolder)
-	pp, err := packfile.NewPackPack(ppf, processingFolder, cfg.MaxOpenPacks)
+	ts.SetDurability(durability)
+
+	lcache, err := lru.New[ihash.Hash, []byte](cfg.BlockCacheNumElements)
 	if err != nil {
 		return nil, err
 	}
 
-	packProcessing, err := pp.NewPackProcessing()
+	processingFolder := path.Join(cfg.Folder, processingFolder)
+
+	ppf := path.Join(cfg.Folder, packFolder)
+	pp, err := packfile.NewPackPackFS(cfg.FS, ppf, processingFolder, cfg.MaxOpenPacks)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO check previous GC attempt and delete pending objects
+	pp.SkipVerification(cfg.SkipChecksumVerification)
+	pp.SetDurability(durability)
+	pp.SetCompression(packfile.Compression{
+		Codec:          codec,
+		Level:          cfg.CompressionLevel,
+		DictionarySize: cfg.DictionarySize,
+	})
+
+	// deletions must be ordered after all the previous operations
+	pp.ObserveSequence(ts.LastSequence())
 
-	return &Datastore{
+	ds := &Datastore{
 		ts:    ts,
 		cache: lcache,
 		pp:    pp,
 
-		singleObjects: packProcessing,
+		memtable:  make(map[ihash.Hash]*txnWrite),
+		snapshots: make(map[*snapshot]struct{}),
 
+		fsys:            cfg.FS,
 		folder:          cfg.Folder,
 		elementsPerPack: cfg.PackMaxNumElements,
-	}, nil
+		maxPackSize:     cfg.PackMaxSize,
+		maxPackAge:      cfg.PackMaxAge,
+		durability:      durability,
+	}
+
+	if err := ds.recoverTxns(); err != nil {
+		return nil, multierr.Combine(err, ds.Close())
+	}
+
+	if !cfg.WAL {
+		return ds, nil
+	}
+
+	ds.wal, err = openWAL(cfg.FS, path.Join(cfg.Folder, walName))
+	if err != nil {
+		return nil, multierr.Combine(err, ds.Close())
+	}
+
+	if err := ds.replayWAL(); err != nil {
+		return nil, multierr.Combine(err, ds.Close())
+	}
+
+	return ds, nil
+}
+
+// replayWAL applies the operations recorded on the write-ahead log before a
+// crash. Puts are committed on a new packfile, ordered after all the
+// deletions, and deletions keep their sequence number.
+func (ds *Datastore) replayWAL() error {
+	err := ds.wal.replay(func(r *walRecord) error {
+		if r.key == nil {
+			ds.pp.ObserveSequence(r.seq)
+			return ds.ts.AddHash(r.hash, r.seq)
+		}
+
+		ds.memtable[ihash.SumBytes(r.key)] = &txnWrite{key: r.key, value: r.value}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if len(ds.memtable) > 0 {
+		return ds.commitSingleObjectsLocked()
+	}
+
+	return ds.truncateWAL()
+}
+
+// truncateWAL removes all the records from the write-ahead log. Deletions are
+// made durable on the tombstone first.
+func (ds *Datastore) truncateWAL() error {
+	ds.delMu.Lock()
+	defer ds.delMu.Unlock()
+
+	if err := ds.ts.Sync(); err != nil {
+		return err
+	}
+
+	return ds.wal.truncate()
 }
 
 // DiskUsage returns the space used by a datastore, in bytes.
 func (ds *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
 	var size uint64
-	err := filepath.WalkDir(ds.folder, func(path string, d fs.DirEntry, err error) error {
+	err := iio.WalkDir(ds.fsys, ds.folder, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -104,41 +223,142 @@ func (ds *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
 	return size, err
 }
 
+// CollectGarbage repacks all the committed packfiles, removing deleted
+// blocks and joining small packfiles. It can be executed at the same time
+// than any other operation.
 func (ds *Datastore) CollectGarbage(ctx context.Context) error {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
+	ds.gcMu.Lock()
+	defer ds.gcMu.Unlock()
+
 	// first, we pack objects from objectStorage
-	if err := ds.singleObjects.Commit(); err != nil {
+	if err := ds.commitSingleObjects(); err != nil {
+		return err
+	}
+
+	// only deletions done before getting the packfiles to process can be
+	// removed from the tombstone at the end. Commits in progress could get
+	// a lower sequence number than those deletions and be available after
+	// getting the packfiles, so they are waited for.
+	var deleted uint64
+	var packs []string
+	ds.delMu.Lock()
+	ds.pp.WithoutCommits(func() {
+		deleted = ds.ts.LastSequence()
+		packs = ds.pp.PackIDs()
+	})
+	ds.delMu.Unlock()
+
+	if err := ds.pp.Repack(packs, ds.ts, ds.elementsPerPack); err != nil {
 		return err
 	}
 
-	// TODO repack previous packfiles
 	// TODO implement a heavy GC, to read using the indexes and remove possible duplicated blocks on packfiles
-	// TODO create MIDXs
 
-	return nil
+	if err := ds.pp.WriteMultiPackIndex(); err != nil {
+		return err
+	}
+
+	// packfiles used by open transactions are kept until they finish, so
+	// their deleted blocks must stay on the tombstone
+	if ds.pp.HasRetired() {
+		return nil
+	}
+
+	return ds.ts.ClearUntil(deleted)
+}
+
+// commitSingleObjects makes all the single Puts available, starting a new
+// packfile for the following ones.
+func (ds *Datastore) commitSingleObjects() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return ds.commitSingleObjectsLocked()
+}
+
+func (ds *Datastore) commitSingleObjectsLocked() error {
+	if len(ds.memtable) == 0 {
+		return nil
+	}
+
+	if ds.rollover != nil {
+		ds.rollover.Stop()
+		ds.rollover = nil
+	}
+
+	// a packfile that failed to commit cannot be written anymore, so the
+	// pending Puts are written into a new one by the next commit. Its files
+	// are removed when opening the datastore again.
+	so, err := ds.singleObjectsLocked()
+	ds.singleObjects = nil
+	if err != nil {
+		return err
+	}
+
+	if err := so.Commit(); err != nil {
+		return err
+	}
+
+	// values are available on the committed packfile now
+	ds.memMu.Lock()
+	ds.memtable = make(map[ihash.Hash]*txnWrite)
+	ds.memMu.Unlock()
+
+	if ds.wal == nil {
+		return nil
+	}
+
+	return ds.truncateWAL()
+}
+
+// singleObjectsLocked returns the packfile for single Puts, starting a new one
+// with all the pending Puts if there is none. It must be called holding mu.
+func (ds *Datastore) singleObjectsLocked() (*packfile.PackProcessing, error) {
+	if ds.singleObjects != nil {
+		return ds.singleObjects, nil
+	}
+
+	so, err := ds.pp.NewPackProcessing()
+	if err != nil {
+		return nil, err
+	}
+
+	for h, w := range ds.memtable {
+		if err := so.WriteHashedBlock(h, w.key, w.value); err != nil {
+			return nil, multierr.Combine(err, so.Discard())
+		}
+	}
+
+	ds.singleObjects = so
+
+	return so, nil
 }
 
 // Get retrieves the object `value` named by `key`.
 // Get will return ErrNotFound if the key is not mapped to a value.
+// If the stored value doesn't match its checksum, the returned error
+// matches packfile.ErrCorruptedBlock.
 func (ds *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
 	k := ihash.SumBytes(key.Bytes())
 
+	if v, ok := ds.pending(k); ok {
+		return v, nil
+	}
+
 	vali, ok := ds.cache.Get(k)
 	if ok {
 		return vali, nil
 	}
 
-	deleted, err := ds.ts.HasHash(k)
+	ds.viewMu.RLock()
+	defer ds.viewMu.RUnlock()
+
+	minSeq, err := ds.minSequence(k)
 	if err != nil {
 		return nil, err
 	}
 
-	if deleted {
-		return nil, datastore.ErrNotFound
-	}
-
-	val, err := ds.pp.Get(key.Bytes())
+	val, err := ds.pp.GetFrom(key.Bytes(), minSeq)
 	if errors.Is(err, packfile.ErrEntryNotFound) {
 		return nil, datastore.ErrNotFound
 	}
@@ -159,33 +379,74 @@ func (ds *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte,
 func (ds *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
 	k := ihash.SumBytes(key.Bytes())
 
+	if _, ok := ds.pending(k); ok {
+		return true, nil
+	}
+
 	if ds.cache.Contains(k) {
 		return true, nil
 	}
 
-	deleted, err := ds.ts.HasHash(k)
+	ds.viewMu.RLock()
+	defer ds.viewMu.RUnlock()
+
+	minSeq, err := ds.minSequence(k)
 	if err != nil {
 		return false, err
 	}
 
-	if deleted {
-		return false, nil
-	}
-
-	return ds.pp.Has(key.Bytes())
+	return ds.pp.HasFrom(key.Bytes(), minSeq)
 }
 
 // GetSize returns the size of the `value` named by `key`.
 // In some contexts, it may be much cheaper to only get the size of the
 // value rather than retrieving the value itself.
 func (ds *Datastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
-	size, err := ds.pp.GetSize(key.Bytes())
+	k := ihash.SumBytes(key.Bytes())
+
+	if v, ok := ds.pending(k); ok {
+		return len(v), nil
+	}
+
+	ds.viewMu.RLock()
+	defer ds.viewMu.RUnlock()
+
+	minSeq, err := ds.minSequence(k)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := ds.pp.GetSizeFrom(key.Bytes(), minSeq)
 	if err == packfile.ErrEntryNotFound {
 		return 0, datastore.ErrNotFound
 	}
 
 	return int(size), err
+}
+
+// pending returns the value of a single Put not committed yet.
+func (ds *Datastore) pending(k ihash.Hash) ([]byte, bool) {
+	ds.memMu.RLock()
+	defer ds.memMu.RUnlock()
 
+	w, ok := ds.memtable[k]
+	if !ok {
+		return nil, false
+	}
+
+	return w.value, true
+}
+
+// minSequence returns the minimum sequence number of the packfiles where the
+// key is still available. If the key was deleted, only packfiles committed
+// after the deletion are valid.
+func (ds *Datastore) minSequence(k ihash.Hash) (uint64, error) {
+	seq, deleted, err := ds.ts.Sequence(k)
+	if err != nil || !deleted {
+		return 0, err
+	}
+
+	return seq + 1, nil
 }
 
 // Query searches the datastore and returns a query result. This function
@@ -199,8 +460,154 @@ func (ds *Datastore) GetSize(ctx context.Context, key datastore.Key) (int, error
 //	// or wait for the query to be completely done
 //	entries, _ := result.Rest()
 //	for entry := range entries { ... }
+//
+// Single Puts not committed yet are returned first. Then blocks are read from
+// all the committed packfiles, newest first, skipping deleted ones and the
+// ones shadowed by a newer copy.
+// Prefix filtering is done before reading values. Filters, orders, offset
+// and limit are applied over the resulting stream.
 func (ds *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
-	panic("not implemented") // TODO: Implement
+	// pending values are taken before getting the packfiles, so they are not
+	// missed if committed in the meantime
+	entries, skip := ds.pendingEntries(q.KeysOnly)
+
+	return ds.query(ctx, q, ds.pp.NewIter(q.KeysOnly), ds.ts.Deleted, entries, skip)
+}
+
+// pendingEntries returns the single Puts not committed yet, and their keys.
+// They are newer than any committed block or deletion of the same keys.
+func (ds *Datastore) pendingEntries(keysOnly bool) ([]query.Entry, map[ihash.Hash]struct{}) {
+	ds.memMu.RLock()
+	defer ds.memMu.RUnlock()
+
+	skip := make(map[ihash.Hash]struct{}, len(ds.memtable))
+	entries := make([]query.Entry, 0, len(ds.memtable))
+	for k, w := range ds.memtable {
+		e := query.Entry{Key: datastore.NewKey(string(w.key)).String(), Size: len(w.value)}
+		if !keysOnly {
+			e.Value = w.value
+		}
+
+		entries = append(entries, e)
+		skip[k] = struct{}{}
+	}
+
+	return entries, skip
+}
+
+// query returns the blocks read by the iterator that are not deleted. The
+// given entries are returned first, and blocks of keys on skip are ignored.
+func (ds *Datastore) query(
+	ctx context.Context,
+	q query.Query,
+	it *packfile.Iter,
+	isDeleted func(k ihash.Hash, seq uint64) (bool, error),
+	entries []query.Entry,
+	skip map[ihash.Hash]struct{},
+) (query.Results, error) {
+	prefix := queryPrefix(q.Prefix)
+	if prefix != "" {
+		it.SetFilter(func(key []byte) bool {
+			return strings.HasPrefix(datastore.NewKey(string(key)).String(), prefix)
+		})
+	}
+
+	// prefix is already applied when reading keys
+	naiveQuery := q
+	naiveQuery.Prefix = ""
+
+	seen := make(map[ihash.Hash]struct{}, len(skip))
+	for k := range skip {
+		seen[k] = struct{}{}
+	}
+
+	var done bool
+	next := func() (query.Result, bool) {
+		for {
+			if done {
+				return query.Result{}, false
+			}
+
+			if len(entries) > 0 {
+				e := entries[0]
+				entries = entries[1:]
+
+				if prefix != "" && !strings.HasPrefix(e.Key, prefix) {
+					continue
+				}
+
+				return query.Result{Entry: e}, true
+			}
+
+			if err := ctx.Err(); err != nil {
+				done = true
+				return query.Result{Error: err}, true
+			}
+
+			b, err := it.Next()
+			if err == io.EOF {
+				done = true
+				return query.Result{}, false
+			}
+
+			if err != nil {
+				done = true
+				return query.Result{Error: err}, true
+			}
+
+			key := datastore.NewKey(string(b.Key))
+			if _, ok := seen[b.Hash]; ok {
+				continue
+			}
+
+			deleted, err := isDeleted(b.Hash, b.Sequence)
+			if err != nil {
+				done = true
+				return query.Result{Error: err}, true
+			}
+
+			// packfiles are read newest first, so this is the value returned
+			// by Get. Older copies are shadowed by it, or deleted with it.
+			seen[b.Hash] = struct{}{}
+			if deleted {
+				continue
+			}
+
+			e := query.Entry{Key: key.String(), Size: int(b.Size)}
+			if !q.KeysOnly {
+				e.Value = b.Value
+			}
+
+			return query.Result{Entry: e}, true
+		}
+	}
+
+	res := query.ResultsFromIterator(naiveQuery, query.Iterator{
+		Next:  next,
+		Close: it.Close,
+	})
+
+	return query.ResultsReplaceQuery(query.NaiveQueryApply(naiveQuery, res), q), nil
+}
+
+// queryPrefix returns the key prefix to filter by, ending with a slash to
+// avoid matching /foobar when looking for /foo. It returns an empty string if
+// no filtering is needed.
+func queryPrefix(p string) string {
+	if p == "" {
+		return ""
+	}
+
+	if p[0] != '/' {
+		p = "/" + p
+	}
+
+	p = path.Clean(p)
+	if p == "/" {
+		return ""
+	}
+
+	return p + "/"
 }
 
 // Put stores the object `value` named by `key`.
@@ -212,18 +619,159 @@ func (ds *Datastore) Query(ctx context.Context, q query.Query) (query.Results, e
 // Ultimately, the lowest-level datastore will need to do some value checking
 // or risk getting incorrect values. It may also be useful to expose a more
 // type-safe interface to your application, and do the checking up-front.
+//
+// Values are available after calling Sync, or after the packfile containing
+// them is committed because it reached its maximum number of elements, size
+// or age.
 func (ds *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	n, err := ds.put(key.Bytes(), value)
+	if err != nil || ds.wal == nil {
+		return err
+	}
+
+	// the log is synced without holding the lock, so concurrent Puts share
+	// the same sync
+	return ds.wal.sync(n)
+}
+
+// put writes the block into the single Puts packfile, returning the
+// write-ahead log record to sync, if enabled.
+func (ds *Datastore) put(key, value []byte) (uint64, error) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	return ds.singleObjects.WriteBlock(key.Bytes(), value)
+
+	if err := ds.takeRolloverErr(); err != nil {
+		return 0, err
+	}
+
+	h := ihash.SumBytes(key)
+	if w, ok := ds.memtable[h]; ok {
+		// the value is already pending, but could be not synced yet
+		if bytes.Equal(w.value, value) {
+			if ds.wal == nil {
+				return 0, nil
+			}
+
+			return ds.wal.appended(), nil
+		}
+
+		// blocks on the same packfile keep the first value, so the new one
+		// must be written into a newer packfile
+		if err := ds.commitSingleObjectsLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	so, err := ds.singleObjectsLocked()
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	if ds.wal != nil {
+		n, err = ds.wal.appendPut(key, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := so.WriteHashedBlock(h, key, value); err != nil {
+		// the packfile could be partially written, so the pending Puts are
+		// written into a new one
+		ds.singleObjects = nil
+		return 0, err
+	}
+
+	ds.memMu.Lock()
+	ds.memtable[h] = &txnWrite{key: append([]byte(nil), key...), value: append([]byte(nil), value...)}
+	ds.memMu.Unlock()
+
+	ds.cache.Remove(h)
+
+	if so.Count() >= ds.elementsPerPack ||
+		(ds.maxPackSize > 0 && so.Size() >= ds.maxPackSize) {
+		return n, ds.commitSingleObjectsLocked()
+	}
+
+	if ds.rollover == nil && ds.maxPackAge > 0 {
+		ds.rollover = time.AfterFunc(ds.maxPackAge, func() {
+			ds.rolloverSingleObjects(so)
+		})
+	}
+
+	return n, nil
+}
+
+// rolloverSingleObjects commits the single Puts written into pp when they are
+// too old, if they were not committed before.
+func (ds *Datastore) rolloverSingleObjects(pp *packfile.PackProcessing) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.singleObjects != pp || ds.rollover == nil {
+		return
+	}
+
+	ds.rolloverErr = ds.commitSingleObjectsLocked()
+}
+
+// takeRolloverErr returns and clears the error from the last rollover. It
+// must be called holding the lock.
+func (ds *Datastore) takeRolloverErr() error {
+	err := ds.rolloverErr
+	ds.rolloverErr = nil
+
+	return err
 }
 
 // Delete removes the value for given `key`. If the key is not in the
 // datastore, this method returns no error.
 func (ds *Datastore) Delete(ctx context.Context, key datastore.Key) error {
 	k := ihash.SumBytes(key.Bytes())
+
+	// a pending Put of the same key happened before the deletion, so it must
+	// be committed with a lower sequence number.
+	ds.mu.Lock()
+	var err error
+	if _, ok := ds.memtable[k]; ok {
+		err = ds.commitSingleObjectsLocked()
+	}
+	ds.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
 	ds.cache.Remove(k)
-	return ds.ts.AddHash(k)
+
+	n, err := ds.delete(k)
+	if err != nil || ds.wal == nil {
+		return err
+	}
+
+	return ds.wal.sync(n)
+}
+
+// delete adds the key to the tombstone, returning the write-ahead log record
+// to sync, if enabled.
+func (ds *Datastore) delete(k ihash.Hash) (uint64, error) {
+	ds.delMu.Lock()
+	defer ds.delMu.Unlock()
+
+	if err := ds.preserveDeletions(k); err != nil {
+		return 0, err
+	}
+
+	seq := ds.pp.NextSequence()
+	if err := ds.ts.AddHash(k, seq); err != nil {
+		return 0, err
+	}
+
+	if ds.wal == nil {
+		return 0, nil
+	}
+
+	return ds.wal.appendDelete(k, seq)
 }
 
 // Sync guarantees that any Put or Delete calls under prefix that returned
@@ -232,20 +780,48 @@ func (ds *Datastore) Delete(ctx context.Context, key datastore.Key) error {
 // satisfy these requirements then Sync may be a no-op.
 //
 // If the prefix fails to Sync this method returns an error.
+//
+// Whether they survive a power loss, not only a process crash, depends on
+// the configured durability level.
 func (ds *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
-	return ds.singleObjects.Commit()
+	if err := ds.takeRolloverErr(); err != nil {
+		return err
+	}
+
+	if err := ds.commitSingleObjectsLocked(); err != nil {
+		return err
+	}
+
+	if ds.durability < iio.DurabilityData {
+		return nil
+	}
+
+	return ds.ts.Sync()
 }
 
 func (ds *Datastore) Close() error {
+	ds.mu.Lock()
+	if ds.rollover != nil {
+		ds.rollover.Stop()
+		ds.rollover = nil
+	}
+	ds.mu.Unlock()
+
 	ds.cache.Purge()
 
-	return multierr.Combine(
+	err := multierr.Combine(
 		ds.pp.Close(),
 		ds.ts.Close(),
 	)
+
+	if ds.wal != nil {
+		err = multierr.Append(err, ds.wal.close())
+	}
+
+	return err
 }
 
 func (ds *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
@@ -254,9 +830,26 @@ func (ds *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
 		return nil, err
 	}
 
-	return NewBatch(pp), nil
+	return NewBatch(ds, pp), nil
 }
 
+// Check verifies all the packfiles and indexes. It returns an error combining
+// all the found problems. Use CheckReport to get them in a structured way.
 func (ds *Datastore) Check(ctx context.Context) error {
-	panic("not implemented") // TODO: Implement
+	report, err := ds.CheckReport(ctx)
+	if err != nil {
+		return err
+	}
+
+	return report.Err()
+}
+
+// CheckReport verifies all the packfiles and indexes, returning a report
+// with all the found problems.
+func (ds *Datastore) CheckReport(ctx context.Context) (*packfile.CheckReport, error) {
+	// GC removes packfiles and indexes, so they will appear as missing
+	ds.gcMu.Lock()
+	defer ds.gcMu.Unlock()
+
+	return ds.pp.Check(ctx)
 }
@@ -2,17 +2,27 @@ package superblock
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/iand/gonubs"
 	"github.com/iand/gonudb"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	pebbleds "github.com/ipfs/go-ds-pebble"
 	"github.com/stretchr/testify/require"
+
+	"github.com/ajnavarro/super-blockstore/iio"
+	"github.com/ajnavarro/super-blockstore/packfile"
 )
 
 func TestWriteAndReadSingleBlock(t *testing.T) {
@@ -87,6 +97,729 @@ func TestWriteBatch(t *testing.T) {
 
 }
 
+func TestBatchDelete(t *testing.T) {
+	require := require.New(t)
+
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:                t.TempDir(),
+		BlockCacheNumElements: 100,
+	})
+	require.NoError(err)
+
+	ctx := context.Background()
+
+	for _, k := range []string{"a", "b"} {
+		require.NoError(ds.Put(ctx, datastore.NewKey(k), []byte(k)))
+	}
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+
+	// pending to be committed
+	require.NoError(ds.Put(ctx, datastore.NewKey("c"), []byte("c")))
+
+	tx, err := ds.Batch(ctx)
+	require.NoError(err)
+
+	require.NoError(tx.Delete(ctx, datastore.NewKey("a")))
+	require.NoError(tx.Delete(ctx, datastore.NewKey("c")))
+	require.NoError(tx.Put(ctx, datastore.NewKey("d"), []byte("d")))
+	require.NoError(tx.Delete(ctx, datastore.NewKey("d")))
+	require.NoError(tx.Delete(ctx, datastore.NewKey("e")))
+	require.NoError(tx.Put(ctx, datastore.NewKey("e"), []byte("e")))
+	// the last value is kept
+	require.NoError(tx.Put(ctx, datastore.NewKey("f"), []byte("old")))
+	require.NoError(tx.Put(ctx, datastore.NewKey("f"), []byte("f")))
+	require.NoError(tx.Put(ctx, datastore.NewKey("g"), []byte("old")))
+	require.NoError(tx.Delete(ctx, datastore.NewKey("g")))
+	require.NoError(tx.Put(ctx, datastore.NewKey("g"), []byte("g")))
+
+	// nothing is applied before committing
+	ok, err := ds.Has(ctx, datastore.NewKey("a"))
+	require.NoError(err)
+	require.True(ok)
+
+	require.NoError(tx.Commit(ctx))
+	require.ErrorIs(tx.Commit(ctx), ErrBatchDone)
+
+	for k, exists := range map[string]bool{"a": false, "b": true, "c": false, "d": false, "e": true} {
+		ok, err := ds.Has(ctx, datastore.NewKey(k))
+		require.NoError(err)
+		require.Equal(exists, ok, k)
+	}
+
+	for _, k := range []string{"f", "g"} {
+		v, err := ds.Get(ctx, datastore.NewKey(k))
+		require.NoError(err)
+		require.Equal([]byte(k), v)
+	}
+
+	// only deletions, so no packfile is needed
+	packs := len(ds.pp.PackIDs())
+
+	tx, err = ds.Batch(ctx)
+	require.NoError(err)
+	require.NoError(tx.Delete(ctx, datastore.NewKey("b")))
+	require.NoError(tx.Commit(ctx))
+
+	require.Len(ds.pp.PackIDs(), packs)
+
+	_, err = ds.Get(ctx, datastore.NewKey("b"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	require.NoError(ds.Close())
+}
+
+func TestBatchDiscard(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:                dir,
+		BlockCacheNumElements: 100,
+	})
+	require.NoError(err)
+
+	ctx := context.Background()
+
+	processing := func() int {
+		entries, err := os.ReadDir(path.Join(dir, processingFolder))
+		require.NoError(err)
+		return len(entries)
+	}
+
+	before := processing()
+
+	tx, err := ds.Batch(ctx)
+	require.NoError(err)
+	require.NoError(tx.Put(ctx, datastore.NewKey("a"), []byte("a")))
+	require.Greater(processing(), before)
+
+	require.NoError(tx.(*Batch).Discard())
+	require.Equal(before, processing())
+	require.ErrorIs(tx.Put(ctx, datastore.NewKey("b"), []byte("b")), ErrBatchDone)
+	require.ErrorIs(tx.Commit(ctx), ErrBatchDone)
+
+	_, err = ds.Get(ctx, datastore.NewKey("a"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	// dropped batches are discarded when garbage collected
+	tx, err = ds.Batch(ctx)
+	require.NoError(err)
+	require.NoError(tx.Put(ctx, datastore.NewKey("a"), []byte("a")))
+	tx = nil
+
+	require.Eventually(func() bool {
+		runtime.GC()
+		return processing() == before
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(ds.Close())
+}
+
+func TestRollover(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+
+	// single Puts are readable before being committed, so only the
+	// committed packfiles are checked
+	has := func(ds *Datastore, key string) bool {
+		ok, err := ds.pp.Has(datastore.NewKey(key).Bytes())
+		require.NoError(err)
+		return ok
+	}
+
+	// by number of elements
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:             t.TempDir(),
+		PackMaxNumElements: 3,
+		PackMaxAge:         -1,
+	})
+	require.NoError(err)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(ds.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte("value")))
+	}
+
+	require.True(has(ds, "2"))
+	require.False(has(ds, "3"))
+	require.Len(ds.pp.PackIDs(), 1)
+	require.NoError(ds.Close())
+
+	// by size
+	ds, err = NewDatastore(&DatastoreConfig{
+		Folder:      t.TempDir(),
+		PackMaxSize: 1024,
+		PackMaxAge:  -1,
+	})
+	require.NoError(err)
+
+	require.NoError(ds.Put(ctx, datastore.NewKey("small"), []byte("value")))
+	require.False(has(ds, "small"))
+
+	big := make([]byte, 2048)
+	rand.New(rand.NewSource(42)).Read(big)
+	require.NoError(ds.Put(ctx, datastore.NewKey("big"), big))
+	require.True(has(ds, "small"))
+	require.True(has(ds, "big"))
+	require.NoError(ds.Close())
+
+	// by age
+	ds, err = NewDatastore(&DatastoreConfig{
+		Folder:     t.TempDir(),
+		PackMaxAge: 50 * time.Millisecond,
+	})
+	require.NoError(err)
+
+	require.NoError(ds.Put(ctx, datastore.NewKey("old"), []byte("value")))
+	require.False(has(ds, "old"))
+	require.Eventually(func() bool {
+		return has(ds, "old")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(ds.Close())
+}
+
+func TestReadYourWrites(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:     t.TempDir(),
+		PackMaxAge: -1,
+	})
+	require.NoError(err)
+
+	key := datastore.NewKey("key")
+	require.NoError(ds.Put(ctx, key, []byte("value")))
+
+	v, err := ds.Get(ctx, key)
+	require.NoError(err)
+	require.Equal([]byte("value"), v)
+
+	ok, err := ds.Has(ctx, key)
+	require.NoError(err)
+	require.True(ok)
+
+	size, err := ds.GetSize(ctx, key)
+	require.NoError(err)
+	require.Equal(5, size)
+
+	// the same value does not need a new packfile
+	require.NoError(ds.Put(ctx, key, []byte("value")))
+	require.Empty(ds.pp.PackIDs())
+
+	require.NoError(ds.Put(ctx, key, []byte("other value")))
+	require.Len(ds.pp.PackIDs(), 1)
+
+	v, err = ds.Get(ctx, key)
+	require.NoError(err)
+	require.Equal([]byte("other value"), v)
+
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+	require.Empty(ds.memtable)
+
+	v, err = ds.Get(ctx, key)
+	require.NoError(err)
+	require.Equal([]byte("other value"), v)
+
+	require.NoError(ds.Put(ctx, datastore.NewKey("deleted"), []byte("value")))
+	require.NoError(ds.Delete(ctx, datastore.NewKey("deleted")))
+
+	_, err = ds.Get(ctx, datastore.NewKey("deleted"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	require.NoError(ds.Close())
+}
+
+func TestWAL(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	folder := t.TempDir()
+	cfg := &DatastoreConfig{
+		Folder:     folder,
+		PackMaxAge: -1,
+		WAL:        true,
+	}
+
+	ds, err := NewDatastore(cfg)
+	require.NoError(err)
+
+	require.NoError(ds.Put(ctx, datastore.NewKey("deleted"), []byte("value")))
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+
+	require.NoError(ds.Delete(ctx, datastore.NewKey("deleted")))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(ds.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte(fmt.Sprint("value", i))))
+		}(i)
+	}
+
+	wg.Wait()
+
+	// single Puts are not committed on Close, like after a crash
+	require.NoError(ds.Close())
+
+	// a record being written when the process stopped
+	f, err := os.OpenFile(path.Join(folder, walName), os.O_APPEND|os.O_WRONLY, 0755)
+	require.NoError(err)
+	_, err = f.Write([]byte{walOpPut, 0, 0})
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	ds, err = NewDatastore(cfg)
+	require.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		v, err := ds.Get(ctx, datastore.NewKey(fmt.Sprint(i)))
+		require.NoError(err)
+		require.Equal([]byte(fmt.Sprint("value", i)), v)
+	}
+
+	_, err = ds.Get(ctx, datastore.NewKey("deleted"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	fi, err := os.Stat(path.Join(folder, walName))
+	require.NoError(err)
+	require.Equal(int64(walHeaderSize), fi.Size())
+
+	require.NoError(ds.Close())
+}
+
+func TestWALTornHeader(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	for _, header := range [][]byte{
+		{},
+		walSig[:2],
+		{'S', 'P', 'W', 0, 0},
+		make([]byte, walHeaderSize),
+	} {
+		folder := t.TempDir()
+		cfg := &DatastoreConfig{
+			Folder:     folder,
+			PackMaxAge: -1,
+			WAL:        true,
+		}
+
+		// the process stopped while writing the header
+		require.NoError(os.WriteFile(path.Join(folder, walName), header, 0755))
+
+		ds, err := NewDatastore(cfg)
+		require.NoError(err)
+
+		require.NoError(ds.Put(ctx, datastore.NewKey("a"), []byte("a")))
+		require.NoError(ds.Close())
+
+		ds, err = NewDatastore(cfg)
+		require.NoError(err)
+
+		v, err := ds.Get(ctx, datastore.NewKey("a"))
+		require.NoError(err)
+		require.Equal([]byte("a"), v)
+
+		require.NoError(ds.Close())
+	}
+
+	// other files are not valid logs
+	folder := t.TempDir()
+	require.NoError(os.WriteFile(path.Join(folder, walName), []byte("not a log"), 0755))
+
+	_, err := NewDatastore(&DatastoreConfig{Folder: folder, WAL: true})
+	require.Error(err)
+}
+
+func TestMemFS(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	fsys := iio.NewMemFS()
+	cfg := &DatastoreConfig{
+		Folder:     "/datastore",
+		FS:         fsys,
+		PackMaxAge: -1,
+		WAL:        true,
+	}
+
+	ds, err := NewDatastore(cfg)
+	require.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(ds.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte(fmt.Sprint("value", i))))
+	}
+
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+	require.NoError(ds.Delete(ctx, datastore.NewKey("0")))
+	require.NoError(ds.Put(ctx, datastore.NewKey("single"), []byte("value")))
+	require.NoError(ds.Close())
+
+	ds, err = NewDatastore(cfg)
+	require.NoError(err)
+	defer ds.Close()
+
+	for i := 1; i < 10; i++ {
+		v, err := ds.Get(ctx, datastore.NewKey(fmt.Sprint(i)))
+		require.NoError(err)
+		require.Equal([]byte(fmt.Sprint("value", i)), v)
+	}
+
+	v, err := ds.Get(ctx, datastore.NewKey("single"))
+	require.NoError(err)
+	require.Equal([]byte("value"), v)
+
+	_, err = ds.Get(ctx, datastore.NewKey("0"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	require.NoError(ds.CollectGarbage(ctx))
+
+	require.NoError(ds.Check(ctx))
+
+	usage, err := ds.DiskUsage(ctx)
+	require.NoError(err)
+	require.NotZero(usage)
+
+	_, err = os.Stat(cfg.Folder)
+	require.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestTornWAL(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	fsys := iio.NewFaultFS(iio.NewMemFS())
+	cfg := &DatastoreConfig{
+		Folder:     "/datastore",
+		FS:         fsys,
+		PackMaxAge: -1,
+		WAL:        true,
+	}
+
+	ds, err := NewDatastore(cfg)
+	require.NoError(err)
+
+	require.NoError(ds.Put(ctx, datastore.NewKey("logged"), []byte("value")))
+
+	fsys.SetFault(func(op iio.Op, p string) error {
+		if op == iio.OpWrite && p == path.Join(cfg.Folder, walName) {
+			return &iio.TornWrite{N: 5}
+		}
+
+		return nil
+	})
+
+	var tw *iio.TornWrite
+	require.ErrorAs(ds.Put(ctx, datastore.NewKey("torn"), []byte("value")), &tw)
+
+	// the process stops without committing anything
+	ds.Close()
+	fsys.SetFault(nil)
+
+	ds, err = NewDatastore(cfg)
+	require.NoError(err)
+	defer ds.Close()
+
+	v, err := ds.Get(ctx, datastore.NewKey("logged"))
+	require.NoError(err)
+	require.Equal([]byte("value"), v)
+
+	has, err := ds.Has(ctx, datastore.NewKey("torn"))
+	require.NoError(err)
+	require.False(has)
+}
+
+func TestSyncFailure(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	fsys := iio.NewFaultFS(iio.NewMemFS())
+	cfg := &DatastoreConfig{
+		Folder:     "/datastore",
+		FS:         fsys,
+		PackMaxAge: -1,
+	}
+
+	ds, err := NewDatastore(cfg)
+	require.NoError(err)
+
+	require.NoError(ds.Put(ctx, datastore.NewKey("a"), []byte("value a")))
+
+	errRename := errors.New("rename failed")
+	fsys.SetFault(func(op iio.Op, p string) error {
+		if op == iio.OpRename {
+			return errRename
+		}
+
+		return nil
+	})
+
+	require.ErrorIs(ds.Sync(ctx, datastore.NewKey("")), errRename)
+	fsys.SetFault(nil)
+
+	// pending Puts are written into a new packfile
+	require.NoError(ds.Put(ctx, datastore.NewKey("b"), []byte("value b")))
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+	require.NoError(ds.Close())
+
+	ds, err = NewDatastore(cfg)
+	require.NoError(err)
+	defer ds.Close()
+
+	for _, k := range []string{"a", "b"} {
+		v, err := ds.Get(ctx, datastore.NewKey(k))
+		require.NoError(err)
+		require.Equal([]byte("value "+k), v)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	require := require.New(t)
+
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:                t.TempDir(),
+		BlockCacheNumElements: 100,
+	})
+	require.NoError(err)
+
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		err = ds.Put(ctx, datastore.NewKey(fmt.Sprintf("a/%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(err)
+	}
+
+	err = ds.Put(ctx, datastore.NewKey("ab/1"), []byte("other"))
+	require.NoError(err)
+
+	err = ds.Sync(ctx, datastore.NewKey(""))
+	require.NoError(err)
+
+	err = ds.Delete(ctx, datastore.NewKey("a/3"))
+	require.NoError(err)
+
+	err = ds.Delete(ctx, datastore.NewKey("a/7"))
+	require.NoError(err)
+
+	res, err := ds.Query(ctx, query.Query{Prefix: "/a"})
+	require.NoError(err)
+	entries, err := res.Rest()
+	require.NoError(err)
+	require.Len(entries, 8)
+	for _, e := range entries {
+		require.Equal(6, e.Size)
+		require.Equal("value"+strings.TrimPrefix(e.Key, "/a/"), string(e.Value))
+	}
+
+	res, err = ds.Query(ctx, query.Query{KeysOnly: true, ReturnsSizes: true})
+	require.NoError(err)
+	entries, err = res.Rest()
+	require.NoError(err)
+	require.Len(entries, 9)
+	for _, e := range entries {
+		require.Nil(e.Value)
+		if e.Key == "/ab/1" {
+			require.Equal(5, e.Size)
+			continue
+		}
+
+		require.Equal(6, e.Size)
+	}
+
+	res, err = ds.Query(ctx, query.Query{
+		Prefix: "/a",
+		Orders: []query.Order{query.OrderByValue{}},
+		Offset: 2,
+		Limit:  3,
+	})
+	require.NoError(err)
+	entries, err = res.Rest()
+	require.NoError(err)
+	require.Len(entries, 3)
+	require.Equal("/a/2", entries[0].Key)
+	require.Equal("value2", string(entries[0].Value))
+	require.Equal("value4", string(entries[1].Value))
+	require.Equal("value5", string(entries[2].Value))
+
+	res, err = ds.Query(ctx, query.Query{
+		Filters: []query.Filter{
+			query.FilterValueCompare{Op: query.Equal, Value: []byte("value9")},
+		},
+	})
+	require.NoError(err)
+	entries, err = res.Rest()
+	require.NoError(err)
+	require.Len(entries, 1)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	res, err = ds.Query(cctx, query.Query{})
+	require.NoError(err)
+	_, err = res.Rest()
+	require.ErrorIs(err, context.Canceled)
+}
+
+func TestQueryOverwrittenKey(t *testing.T) {
+	require := require.New(t)
+
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:                t.TempDir(),
+		BlockCacheNumElements: 100,
+	})
+	require.NoError(err)
+
+	ctx := context.Background()
+
+	// every value is on its own packfile, the newest one with the oldest
+	// packfile ID
+	tx, err := ds.NewTransaction(ctx, false)
+	require.NoError(err)
+
+	for _, v := range []string{"old", "middle", "new"} {
+		err = ds.Put(ctx, datastore.NewKey("a"), []byte(v))
+		require.NoError(err)
+
+		err = ds.Sync(ctx, datastore.NewKey(""))
+		require.NoError(err)
+	}
+
+	err = tx.Put(ctx, datastore.NewKey("a"), []byte("newest"))
+	require.NoError(err)
+
+	err = tx.Commit(ctx)
+	require.NoError(err)
+
+	v, err := ds.Get(ctx, datastore.NewKey("a"))
+	require.NoError(err)
+	require.Equal("newest", string(v))
+
+	res, err := ds.Query(ctx, query.Query{})
+	require.NoError(err)
+	entries, err := res.Rest()
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.Equal("/a", entries[0].Key)
+	require.Equal("newest", string(entries[0].Value))
+
+	err = ds.Delete(ctx, datastore.NewKey("a"))
+	require.NoError(err)
+
+	res, err = ds.Query(ctx, query.Query{KeysOnly: true})
+	require.NoError(err)
+	entries, err = res.Rest()
+	require.NoError(err)
+	require.Empty(entries)
+
+	require.NoError(ds.Close())
+}
+
+func TestQueryPending(t *testing.T) {
+	require := require.New(t)
+
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:                t.TempDir(),
+		BlockCacheNumElements: 100,
+		PackMaxAge:            -1,
+	})
+	require.NoError(err)
+	defer ds.Close()
+
+	ctx := context.Background()
+
+	for _, k := range []string{"a/overwritten", "a/deleted", "a/committed"} {
+		err = ds.Put(ctx, datastore.NewKey(k), []byte("old"))
+		require.NoError(err)
+	}
+
+	err = ds.Sync(ctx, datastore.NewKey(""))
+	require.NoError(err)
+
+	err = ds.Delete(ctx, datastore.NewKey("a/deleted"))
+	require.NoError(err)
+
+	// none of them is synced
+	for _, k := range []string{"a/overwritten", "a/deleted", "a/pending", "b/pending"} {
+		err = ds.Put(ctx, datastore.NewKey(k), []byte("new"))
+		require.NoError(err)
+	}
+
+	res, err := ds.Query(ctx, query.Query{Prefix: "/a"})
+	require.NoError(err)
+	entries, err := res.Rest()
+	require.NoError(err)
+
+	values := make(map[string]string)
+	for _, e := range entries {
+		values[e.Key] = string(e.Value)
+	}
+
+	require.Equal(map[string]string{
+		"/a/committed":   "old",
+		"/a/deleted":     "new",
+		"/a/overwritten": "new",
+		"/a/pending":     "new",
+	}, values)
+	require.Len(entries, 4)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	require := require.New(t)
+
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:                t.TempDir(),
+		BlockCacheNumElements: 100,
+		PackMaxNumElements:    3,
+	})
+	require.NoError(err)
+
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		err = ds.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte(fmt.Sprint("value", i)))
+		require.NoError(err)
+
+		if i%2 == 1 {
+			require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+		}
+	}
+
+	require.Len(ds.pp.PackIDs(), 5)
+
+	for _, k := range []string{"1", "4", "8"} {
+		require.NoError(ds.Delete(ctx, datastore.NewKey(k)))
+	}
+
+	require.NoError(ds.CollectGarbage(ctx))
+	require.Len(ds.pp.PackIDs(), 3)
+	require.Equal(0, ds.ts.Len())
+
+	for i := 0; i < 10; i++ {
+		v, err := ds.Get(ctx, datastore.NewKey(fmt.Sprint(i)))
+		if i == 1 || i == 4 || i == 8 {
+			require.ErrorIs(err, datastore.ErrNotFound)
+			continue
+		}
+
+		require.NoError(err)
+		require.Equal(fmt.Sprint("value", i), string(v))
+	}
+
+	// puts after GC are still accepted
+	require.NoError(ds.Put(ctx, datastore.NewKey("10"), []byte("value10")))
+	require.NoError(ds.CollectGarbage(ctx))
+	require.Len(ds.pp.PackIDs(), 3)
+
+	v, err := ds.Get(ctx, datastore.NewKey("10"))
+	require.NoError(err)
+	require.Equal("value10", string(v))
+
+	require.NoError(ds.Close())
+}
+
 var datastores = []struct {
 	Name        string
 	GetInstance func(path string) (datastore.Batching, error)
@@ -409,3 +1142,477 @@ func BenchmarkCompareDatastores(b *testing.B) {
 		})
 	}
 }
+
+func TestCheck(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	ds, err := NewDatastore(&DatastoreConfig{
+		Folder:                dir,
+		BlockCacheNumElements: 100,
+	})
+	require.NoError(err)
+
+	ctx := context.Background()
+
+	for i := 0; i < 15; i++ {
+		err = ds.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte(fmt.Sprint("value", i)))
+		require.NoError(err)
+
+		if i%3 == 2 {
+			require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+		}
+	}
+
+	require.NoError(ds.Check(ctx))
+
+	report, err := ds.CheckReport(ctx)
+	require.NoError(err)
+	require.True(report.OK())
+	require.Equal(5, report.Packs)
+	require.Equal(15, report.Blocks)
+
+	ids := ds.pp.PackIDs()
+	packs := path.Join(dir, packFolder)
+
+	// an index from a different packfile
+	idxData, err := os.ReadFile(path.Join(packs, ids[0]+".idx"))
+	require.NoError(err)
+	require.NoError(os.WriteFile(path.Join(packs, ids[3]+".idx"), idxData, 0755))
+
+	// a packfile without index
+	require.NoError(os.Remove(path.Join(packs, ids[0]+".idx")))
+
+	// an index without packfile
+	require.NoError(os.Rename(path.Join(packs, ids[1]+".pack"), path.Join(dir, "moved.pack")))
+
+	// a corrupted packfile, truncated in the middle of its last block
+	pf := path.Join(packs, ids[2]+".pack")
+	data, err := os.ReadFile(pf)
+	require.NoError(err)
+	require.NoError(os.WriteFile(pf, data[:len(data)-48], 0755))
+
+	// a corrupted reverse index
+	rf := path.Join(packs, ids[4]+".rev")
+	data, err = os.ReadFile(rf)
+	require.NoError(err)
+	data[8]++
+	require.NoError(os.WriteFile(rf, data, 0755))
+
+	require.Error(ds.Check(ctx))
+
+	report, err = ds.CheckReport(ctx)
+	require.NoError(err)
+	require.False(report.OK())
+	require.Len(report.Problems, 6)
+
+	kinds := make(map[string][]packfile.ProblemKind)
+	for _, p := range report.Problems {
+		kinds[p.Pack] = append(kinds[p.Pack], p.Kind)
+	}
+
+	require.Equal([]packfile.ProblemKind{packfile.ProblemMissingIndex}, kinds[ids[0]])
+	require.Equal([]packfile.ProblemKind{packfile.ProblemMissingPack}, kinds[ids[1]])
+	require.Equal([]packfile.ProblemKind{packfile.ProblemIndexPack}, kinds[ids[3]])
+	require.Equal([]packfile.ProblemKind{packfile.ProblemReverseIndex}, kinds[ids[4]])
+	require.Equal([]packfile.ProblemKind{
+		packfile.ProblemPackChecksum,
+		packfile.ProblemPackBlock,
+	}, kinds[ids[2]])
+
+	require.NoError(ds.Close())
+}
+
+func TestCheckDuringCommits(t *testing.T) {
+	require := require.New(t)
+
+	// commits wait between moving the packfile and its index
+	fsys := iio.NewFaultFS(iio.OS)
+	fsys.SetFault(func(op iio.Op, p string) error {
+		if op == iio.OpRename && path.Ext(p) == ".idx" {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		return nil
+	})
+
+	ctx := context.Background()
+	ds, err := NewDatastore(&DatastoreConfig{Folder: t.TempDir(), FS: fsys})
+	require.NoError(err)
+	defer ds.Close()
+
+	done := make(chan struct{})
+	errs := make(chan error)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				errs <- nil
+				return
+			default:
+			}
+
+			if err := ds.Put(ctx, datastore.NewKey(fmt.Sprint(i)), []byte("value")); err != nil {
+				errs <- err
+				return
+			}
+
+			if err := ds.Sync(ctx, datastore.NewKey("")); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// packfiles being committed are not reported as missing their index
+	for packs := 0; packs < 20; {
+		report, err := ds.CheckReport(ctx)
+		require.NoError(err)
+		require.NoError(report.Err())
+
+		packs = report.Packs
+	}
+
+	close(done)
+	require.NoError(<-errs)
+}
+
+func TestDeleteAndPutAgain(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	cfg := &DatastoreConfig{
+		Folder:                dir,
+		BlockCacheNumElements: 100,
+	}
+
+	ds, err := NewDatastore(cfg)
+	require.NoError(err)
+
+	ctx := context.Background()
+	k := datastore.NewKey("key")
+
+	require.NoError(ds.Put(ctx, k, []byte("old")))
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+	require.NoError(ds.Delete(ctx, k))
+
+	// a pending put is deleted too
+	require.NoError(ds.Put(ctx, datastore.NewKey("pending"), []byte("pending")))
+	require.NoError(ds.Delete(ctx, datastore.NewKey("pending")))
+
+	require.NoError(ds.Put(ctx, k, []byte("new")))
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+
+	check := func(ds *Datastore) {
+		v, err := ds.Get(ctx, k)
+		require.NoError(err)
+		require.Equal("new", string(v))
+
+		has, err := ds.Has(ctx, k)
+		require.NoError(err)
+		require.True(has)
+
+		size, err := ds.GetSize(ctx, k)
+		require.NoError(err)
+		require.Equal(3, size)
+
+		_, err = ds.Get(ctx, datastore.NewKey("pending"))
+		require.ErrorIs(err, datastore.ErrNotFound)
+
+		has, err = ds.Has(ctx, datastore.NewKey("pending"))
+		require.NoError(err)
+		require.False(has)
+
+		res, err := ds.Query(ctx, query.Query{})
+		require.NoError(err)
+		entries, err := res.Rest()
+		require.NoError(err)
+		require.Len(entries, 1)
+		require.Equal("/key", entries[0].Key)
+		require.Equal("new", string(entries[0].Value))
+	}
+
+	check(ds)
+	require.NoError(ds.Close())
+
+	ds, err = NewDatastore(cfg)
+	require.NoError(err)
+	check(ds)
+
+	require.NoError(ds.CollectGarbage(ctx))
+	check(ds)
+
+	// deleting it again after GC
+	require.NoError(ds.Delete(ctx, k))
+	_, err = ds.Get(ctx, k)
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	require.NoError(ds.Close())
+}
+
+func TestTransaction(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	cfg := &DatastoreConfig{
+		Folder:     t.TempDir(),
+		PackMaxAge: -1,
+	}
+
+	ds, err := NewDatastore(cfg)
+	require.NoError(err)
+
+	for _, k := range []string{"a", "b"} {
+		require.NoError(ds.Put(ctx, datastore.NewKey(k), []byte(k)))
+	}
+
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+
+	txn, err := ds.NewTransaction(ctx, false)
+	require.NoError(err)
+
+	// changes done after creating the transaction are not visible on it
+	require.NoError(ds.Put(ctx, datastore.NewKey("c"), []byte("c")))
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+	require.NoError(ds.Delete(ctx, datastore.NewKey("a")))
+
+	v, err := txn.Get(ctx, datastore.NewKey("a"))
+	require.NoError(err)
+	require.Equal([]byte("a"), v)
+
+	has, err := txn.Has(ctx, datastore.NewKey("c"))
+	require.NoError(err)
+	require.False(has)
+
+	require.NoError(txn.Put(ctx, datastore.NewKey("d"), []byte("old")))
+	require.NoError(txn.Put(ctx, datastore.NewKey("d"), []byte("new")))
+	require.NoError(txn.Put(ctx, datastore.NewKey("e"), []byte("e")))
+	require.NoError(txn.Delete(ctx, datastore.NewKey("e")))
+	require.NoError(txn.Delete(ctx, datastore.NewKey("b")))
+
+	v, err = txn.Get(ctx, datastore.NewKey("d"))
+	require.NoError(err)
+	require.Equal([]byte("new"), v)
+
+	size, err := txn.GetSize(ctx, datastore.NewKey("d"))
+	require.NoError(err)
+	require.Equal(3, size)
+
+	_, err = txn.Get(ctx, datastore.NewKey("b"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	res, err := txn.Query(ctx, query.Query{})
+	require.NoError(err)
+	entries, err := res.Rest()
+	require.NoError(err)
+
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+
+	require.ElementsMatch([]string{"/a", "/d"}, keys)
+
+	// nothing is visible outside until committing
+	has, err = ds.Has(ctx, datastore.NewKey("d"))
+	require.NoError(err)
+	require.False(has)
+
+	has, err = ds.Has(ctx, datastore.NewKey("b"))
+	require.NoError(err)
+	require.True(has)
+
+	require.NoError(txn.Commit(ctx))
+	require.ErrorIs(txn.Commit(ctx), ErrTxnDone)
+	txn.Discard(ctx)
+
+	check := func(ds *Datastore) {
+		v, err := ds.Get(ctx, datastore.NewKey("d"))
+		require.NoError(err)
+		require.Equal([]byte("new"), v)
+
+		v, err = ds.Get(ctx, datastore.NewKey("c"))
+		require.NoError(err)
+		require.Equal([]byte("c"), v)
+
+		for _, k := range []string{"a", "b", "e"} {
+			_, err := ds.Get(ctx, datastore.NewKey(k))
+			require.ErrorIs(err, datastore.ErrNotFound)
+		}
+	}
+
+	check(ds)
+
+	txn, err = ds.NewTransaction(ctx, true)
+	require.NoError(err)
+	require.ErrorIs(txn.Put(ctx, datastore.NewKey("f"), []byte("f")), ErrTxnReadOnly)
+	require.ErrorIs(txn.Delete(ctx, datastore.NewKey("d")), ErrTxnReadOnly)
+	require.NoError(txn.Commit(ctx))
+
+	require.NoError(ds.Close())
+
+	ds, err = NewDatastore(cfg)
+	require.NoError(err)
+	defer ds.Close()
+
+	check(ds)
+}
+
+func TestTransactionDuringGC(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	ds, err := NewDatastore(&DatastoreConfig{Folder: t.TempDir()})
+	require.NoError(err)
+	defer ds.Close()
+
+	require.NoError(ds.Put(ctx, datastore.NewKey("a"), []byte("a")))
+	require.NoError(ds.Put(ctx, datastore.NewKey("b"), []byte("b")))
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+
+	txn, err := ds.NewTransaction(ctx, true)
+	require.NoError(err)
+
+	require.NoError(ds.Delete(ctx, datastore.NewKey("a")))
+	require.NoError(ds.CollectGarbage(ctx))
+	require.True(ds.pp.HasRetired())
+
+	// transactions can be opened while others are in use
+	txn2, err := ds.NewTransaction(ctx, true)
+	require.NoError(err)
+	txn2.Discard(ctx)
+
+	v, err := txn.Get(ctx, datastore.NewKey("a"))
+	require.NoError(err)
+	require.Equal([]byte("a"), v)
+
+	_, err = ds.Get(ctx, datastore.NewKey("a"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	txn.Discard(ctx)
+	require.False(ds.pp.HasRetired())
+
+	require.NoError(ds.CollectGarbage(ctx))
+
+	_, err = ds.Get(ctx, datastore.NewKey("a"))
+	require.ErrorIs(err, datastore.ErrNotFound)
+
+	v, err = ds.Get(ctx, datastore.NewKey("b"))
+	require.NoError(err)
+	require.Equal([]byte("b"), v)
+}
+
+func TestTransactionRecovery(t *testing.T) {
+	require := require.New(t)
+
+	ctx := context.Background()
+	fsys := iio.NewFaultFS(iio.NewMemFS())
+	cfg := &DatastoreConfig{
+		Folder:     "/datastore",
+		FS:         fsys,
+		PackMaxAge: -1,
+	}
+
+	ds, err := NewDatastore(cfg)
+	require.NoError(err)
+
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(ds.Put(ctx, datastore.NewKey(k), []byte(k)))
+	}
+
+	require.NoError(ds.Sync(ctx, datastore.NewKey("")))
+
+	commit := func(put, del string, fault iio.FaultFunc) error {
+		txn, err := ds.NewTransaction(ctx, false)
+		require.NoError(err)
+		require.NoError(txn.Put(ctx, datastore.NewKey(put), []byte(put)))
+		require.NoError(txn.Delete(ctx, datastore.NewKey(del)))
+
+		fsys.SetFault(fault)
+		defer fsys.SetFault(nil)
+
+		return txn.Commit(ctx)
+	}
+
+	// the process stops while writing the transaction log, before
+	// committing anything
+	err = commit("d", "a", func(op iio.Op, p string) error {
+		if op == iio.OpWrite && strings.HasPrefix(p, path.Join(cfg.Folder, txnFolder)) {
+			return &iio.TornWrite{N: 10}
+		}
+
+		return nil
+	})
+	require.Error(err)
+
+	isPack := func(op iio.Op, p string, ext string) bool {
+		return op == iio.OpRename && path.Dir(p) == path.Join(cfg.Folder, packFolder) && path.Ext(p) == ext
+	}
+
+	// moving the packfile fails, so the commit is rolled back
+	err = commit("f", "c", func(op iio.Op, p string) error {
+		if isPack(op, p, ".pack") {
+			return errors.New("injected rename failure")
+		}
+
+		return nil
+	})
+	require.Error(err)
+
+	for k, ok := range map[string]bool{"c": true, "f": false} {
+		has, err := ds.Has(ctx, datastore.NewKey(k))
+		require.NoError(err)
+		require.Equal(ok, has, k)
+	}
+
+	// the journal has no pending operations
+	fi, err := fsys.Stat(path.Join(cfg.Folder, packFolder, "journal"))
+	require.NoError(err)
+	require.Equal(int64(0), fi.Size())
+
+	// moving the index and rolling back fail, so the commit is finished when
+	// opening the datastore again
+	err = commit("g", "c", func(op iio.Op, p string) error {
+		if isPack(op, p, ".idx") || op == iio.OpRemove {
+			return errors.New("injected failure")
+		}
+
+		return nil
+	})
+	require.Error(err)
+
+	has, err := ds.Has(ctx, datastore.NewKey("g"))
+	require.NoError(err)
+	require.False(has)
+
+	// writing the deletions on the tombstone fails, so the commit is rolled
+	// back
+	err = commit("e", "b", func(op iio.Op, p string) error {
+		if op == iio.OpWrite && strings.HasPrefix(p, path.Join(cfg.Folder, tombstoneName)) {
+			return errors.New("injected write failure")
+		}
+
+		return nil
+	})
+	require.Error(err)
+
+	has, err = ds.Has(ctx, datastore.NewKey("e"))
+	require.NoError(err)
+	require.False(has)
+
+	require.NoError(ds.Close())
+
+	ds, err = NewDatastore(cfg)
+	require.NoError(err)
+	defer ds.Close()
+
+	for k, ok := range map[string]bool{"a": true, "b": true, "c": false, "d": false, "e": false, "f": false, "g": true} {
+		has, err := ds.Has(ctx, datastore.NewKey(k))
+		require.NoError(err)
+		require.Equal(ok, has, k)
+	}
+
+	entries, err := fsys.ReadDir(path.Join(cfg.Folder, txnFolder))
+	require.NoError(err)
+	require.Empty(entries)
+}
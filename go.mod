@@ -1,6 +1,6 @@
 module github.com/ajnavarro/super-blockstore
 
-go 1.19
+go 1.22
 
 replace github.com/hashicorp/golang-lru v1.0.1 => github.com/hashicorp/golang-lru v0.5.4
 
@@ -152,7 +152,7 @@ require (
 	github.com/hashicorp/golang-lru v1.0.1 // indirect
 	github.com/ipfs/go-datastore v0.6.0
 	github.com/jbenet/goprocess v0.1.4 // indirect
-	github.com/klauspost/compress v1.15.12
+	github.com/klauspost/compress v1.18.0
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
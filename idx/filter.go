@@ -0,0 +1,214 @@
+package idx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
+)
+
+// Filter format:
+//
+// Signature [3]byte: SPF
+// Version uint32: 0
+// NumHashes uint32
+// NumBits uint64
+// Bits [NumBits/8]byte
+// Checksum [ihash.HashSize]byte: sha256 of all the above
+
+var filterSig []byte = []byte{'S', 'P', 'F'}
+var filterVersion uint32 = 0
+
+const (
+	// filterBitsPerKey and filterHashes give a false positive rate close to
+	// 1%.
+	filterBitsPerKey = 10
+	filterHashes     = 7
+
+	// maxFilterBits avoids allocating huge filters from corrupted files.
+	maxFilterBits = 1 << 40
+)
+
+// Filter is a bloom filter of hashed keys. Keys are already sha256 hashes,
+// so the bit positions are taken from the key itself.
+type Filter struct {
+	numHashes uint32
+	bits      []byte
+}
+
+// NewFilter creates an empty filter sized for n keys.
+func NewFilter(n int) *Filter {
+	numBits := uint64(n) * filterBitsPerKey
+	if numBits < 64 {
+		numBits = 64
+	}
+
+	return &Filter{
+		numHashes: filterHashes,
+		bits:      make([]byte, (numBits+7)/8),
+	}
+}
+
+// Add adds a key into the filter.
+func (f *Filter) Add(h ihash.Hash) {
+	f.positions(h, func(pos uint64) bool {
+		f.bits[pos/8] |= 1 << (pos % 8)
+		return true
+	})
+}
+
+// Has returns false if the key was never added. It can return true for keys
+// that were not added.
+func (f *Filter) Has(h ihash.Hash) bool {
+	return f.positions(h, func(pos uint64) bool {
+		return f.bits[pos/8]&(1<<(pos%8)) != 0
+	})
+}
+
+// positions calls fn with the bit positions of the key, using double hashing,
+// until fn returns false.
+func (f *Filter) positions(h ihash.Hash, fn func(pos uint64) bool) bool {
+	numBits := uint64(len(f.bits)) * 8
+	h1 := binary.LittleEndian.Uint64(h[0:8])
+	h2 := binary.LittleEndian.Uint64(h[8:16]) | 1
+	for i := uint32(0); i < f.numHashes; i++ {
+		if !fn((h1 + uint64(i)*h2) % numBits) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeTo writes the number of hashes, the number of bits and the bits.
+func (f *Filter) writeTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	binary.Write(cw, binary.BigEndian, f.numHashes)
+	binary.Write(cw, binary.BigEndian, uint64(len(f.bits))*8)
+	cw.Write(f.bits)
+
+	return cw.n, cw.err
+}
+
+// readFilter reads a filter written by writeTo.
+func readFilter(r io.Reader) (*Filter, int64, error) {
+	f := &Filter{}
+	if err := binary.Read(r, binary.BigEndian, &f.numHashes); err != nil {
+		return nil, 0, err
+	}
+
+	var numBits uint64
+	if err := binary.Read(r, binary.BigEndian, &numBits); err != nil {
+		return nil, 4, err
+	}
+
+	if numBits == 0 || numBits%8 != 0 || numBits > maxFilterBits {
+		return nil, 12, fmt.Errorf("invalid filter size: %d", numBits)
+	}
+
+	f.bits = make([]byte, numBits/8)
+	n, err := io.ReadFull(r, f.bits)
+
+	return f, int64(12 + n), err
+}
+
+// WriteTo writes the filter as a filter file.
+func (f *Filter) WriteTo(writer io.Writer) (int64, error) {
+	sum := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(writer, sum)}
+
+	cw.Write(filterSig)
+	binary.Write(cw, binary.BigEndian, filterVersion)
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+
+	if _, err := f.writeTo(cw); err != nil {
+		return cw.n, err
+	}
+
+	n, err := writer.Write(sum.Sum(nil))
+
+	return cw.n + int64(n), err
+}
+
+// NewFilterFromFile reads a filter file, checking its checksum.
+func NewFilterFromFile(fsys iio.FS, p string) (*Filter, error) {
+	data, err := iio.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(filterSig)+4+ihash.KeySize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	end := len(data) - ihash.KeySize
+	if sum := sha256.Sum256(data[:end]); !bytes.Equal(sum[:], data[end:]) {
+		return nil, ErrInvalidChecksum
+	}
+
+	r := bytes.NewReader(data[:end])
+
+	sig := make([]byte, len(filterSig))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(sig, filterSig) {
+		return nil, errors.New("not a valid filter file")
+	}
+
+	var version uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+
+	if version > filterVersion {
+		return nil, errors.New("not a valid filter version")
+	}
+
+	f, _, err := readFilter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Len() != 0 {
+		return nil, errors.New("unexpected data after filter")
+	}
+
+	return f, nil
+}
+
+// WriteFilter writes the filter file into the specified path.
+func WriteFilter(fsys iio.FS, f *Filter, p string) error {
+	file, err := iio.OpenFile(fsys, p, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// FilterPath returns the path of the filter for the specified packfile.
+func FilterPath(name, packPath string) string {
+	return path.Join(packPath, fmt.Sprintf("%s.filter", name))
+}
+
+// FilterProcessingPath returns the path of the filter for the specified
+// packfile while it is being written.
+func FilterProcessingPath(name, packPath string) string {
+	return path.Join(packPath, fmt.Sprintf("%s.filter.writting", name))
+}
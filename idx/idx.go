@@ -11,25 +11,42 @@ import (
 // Index format:
 //
 // Signature [3]byte: SPI
-// Version uint32: 0
+// Version uint32: 2
+// Sequence uint64 (version >= 2): order of the packfile commit
 // Fanaout table [256]uint32
 // NumElements = fanoutTable[len(fanoutTable)-1]
 // List of hashes ordered [ihash.HashSize]byte*NumElements
 // CRCs [4]byte*NumElements
+// Sizes [4]byte*NumElements
 // Offsets32 [4]byte*NumElements
 // Offsets64 [8]byte*NumElements
-// Sizes [4]byte*NumElements
-//
-// TODO footer with checksums
+// Footer (version >= 1):
+//   Pack checksum [ihash.HashSize]byte: checksum of the corresponding packfile
+//   Index checksum [ihash.HashSize]byte: sha256 of all the above
 
 const fanoutSize = 256
 const noMapping = -1
 
 var indexSig []byte = []byte{'S', 'P', 'I'}
-var indexVersion uint32 = 0
+var indexVersion uint32 = indexVersionSequence
+
+const (
+	// indexVersionInitial is the first version, without footer.
+	indexVersionInitial uint32 = iota
+	// indexVersionChecksums adds the footer with the pack and index checksums.
+	indexVersionChecksums
+	// indexVersionSequence adds the packfile sequence number to the header.
+	indexVersionSequence
+)
 
 var ErrEntryNotFound = errors.New("entry not found")
 
+// ErrInvalidChecksum is returned when an index doesn't match its checksum.
+var ErrInvalidChecksum = errors.New("index checksum mismatch")
+
+// ErrInvalidIndex is returned when the index tables don't match their sizes.
+var ErrInvalidIndex = errors.New("invalid index")
+
 type Entries []*Entry
 
 type Entry struct {
@@ -60,6 +77,19 @@ type Idx interface {
 
 type Transaction interface {
 	Add(key ihash.Hash, crc32 uint32, pos int64, size uint32) error
+	// Contains returns true if the key was added.
+	Contains(key ihash.Hash) bool
+	// SetPackChecksum sets the checksum of the indexed packfile.
+	SetPackChecksum(h ihash.Hash)
+	// SetSequence sets the sequence number of the indexed packfile.
+	SetSequence(seq uint64)
+	// Prepare writes the index without making it available. It is done
+	// by Stage if not called before.
+	Prepare() error
+	// Stage moves the prepared index into the packs folder, still without
+	// making it available. It is done by Commit if not called before, and
+	// undone by Discard.
+	Stage() error
 	Commit() error
 	Discard() error
 }
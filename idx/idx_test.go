@@ -1,11 +1,14 @@
 package idx
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path"
 	"testing"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
 	"github.com/stretchr/testify/require"
 )
 
@@ -20,10 +23,12 @@ func TestWriteAndReadIndex_OLD(t *testing.T) {
 	idx.Add([]byte("hello"), 1, 10, 100)
 	idx.Add([]byte("bye"), 2, 20, 200)
 	idx.Add([]byte("world"), 3, 30, 300)
+	idx.SetPackChecksum(ihash.SumBytes([]byte("pack")))
+	idx.SetSequence(42)
 
 	n, err := idx.WriteTo(f)
 	require.NoError(err)
-	require.Equal(int64(1163), n)
+	require.Equal(int64(1235), n)
 
 	_, err = f.Seek(0, io.SeekStart)
 	require.NoError(err)
@@ -31,7 +36,13 @@ func TestWriteAndReadIndex_OLD(t *testing.T) {
 
 	n, err = idReader.ReadFrom(f)
 	require.NoError(err)
-	require.Equal(int64(1163), n)
+	require.Equal(int64(1235), n)
+	require.Equal(ihash.SumBytes([]byte("pack")), idReader.PackChecksum())
+	require.Equal(uint64(42), idReader.Sequence())
+
+	seq, err := ReadSequence(iio.OS, f.Name())
+	require.NoError(err)
+	require.Equal(uint64(42), seq)
 
 	key := ihash.SumBytes([]byte("hello"))
 
@@ -52,6 +63,286 @@ func TestWriteAndReadIndex_OLD(t *testing.T) {
 	require.Equal(uint32(1), crc)
 }
 
+func TestReadIndexChecksum(t *testing.T) {
+	require := require.New(t)
+
+	p := path.Join(t.TempDir(), "test.idx")
+
+	idx := NewIndexWriter()
+	idx.Add([]byte("hello"), 1, 10, 100)
+	require.NoError(WriteIndex(iio.OS, idx, p))
+
+	ir, err := NewIndexFromFile(iio.OS, p)
+	require.NoError(err)
+	require.NoError(ir.Verify())
+	require.NoError(ir.Close())
+
+	data, err := os.ReadFile(p)
+	require.NoError(err)
+
+	// change the offset of the only entry
+	data[len(data)-2*ihash.KeySize-1]++
+	require.NoError(os.WriteFile(p, data, 0755))
+
+	// the checksum is not verified when opening the index
+	ir, err = NewIndexFromFile(iio.OS, p)
+	require.NoError(err)
+	require.ErrorIs(ir.Verify(), ErrInvalidChecksum)
+	require.NoError(ir.Close())
+
+	// neither when opening all the indexes
+	mi, err := NewMulti(iio.OS, path.Dir(p), path.Dir(p), nil)
+	require.NoError(err)
+	require.NoError(mi.Close())
+
+	f, err := os.Open(p)
+	require.NoError(err)
+	_, err = NewIndexReader().ReadFrom(f)
+	require.ErrorIs(err, ErrInvalidChecksum)
+	require.NoError(f.Close())
+
+	// tables not matching the file size
+	require.NoError(os.WriteFile(p, data[:len(data)-1], 0755))
+	_, err = NewIndexFromFile(iio.OS, p)
+	require.ErrorIs(err, ErrInvalidIndex)
+
+	_, err = NewMulti(iio.OS, path.Dir(p), path.Dir(p), nil)
+	require.ErrorIs(err, ErrInvalidIndex)
+}
+
+func TestIndexLookups(t *testing.T) {
+	require := require.New(t)
+
+	p := path.Join(t.TempDir(), "test.idx")
+
+	w := NewIndexWriter()
+	for i := 0; i < 1000; i++ {
+		// some of them need 64 bits offsets
+		w.Add([]byte(fmt.Sprint(i)), uint32(i), uint64(i)<<22, uint32(i*2))
+	}
+	require.NoError(WriteIndex(iio.OS, w, p))
+
+	ir, err := NewIndexFromFile(iio.OS, p)
+	require.NoError(err)
+
+	count, err := ir.Count()
+	require.NoError(err)
+	require.Equal(int64(1000), count)
+
+	for i := 0; i < 1000; i++ {
+		k := ihash.SumBytes([]byte(fmt.Sprint(i)))
+
+		offset, err := ir.GetOffset(k)
+		require.NoError(err)
+		require.Equal(int64(i)<<22, offset)
+
+		crc, err := ir.GetCRC32(k)
+		require.NoError(err)
+		require.Equal(uint32(i), crc)
+
+		size, err := ir.GetSize(k)
+		require.NoError(err)
+		require.Equal(uint32(i*2), size)
+	}
+
+	_, err = ir.GetOffset(ihash.SumBytes([]byte("nope")))
+	require.ErrorIs(err, ErrEntryNotFound)
+
+	var entries Entries
+	require.NoError(ir.ForEach(func(e *Entry) error {
+		entries = append(entries, e)
+		return nil
+	}))
+	require.Len(entries, 1000)
+
+	sorted := append(Entries(nil), entries...)
+	SortEntriesByHash(sorted)
+	require.Equal(sorted, entries)
+
+	require.NoError(ir.Close())
+}
+
+func TestReverseIndex(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	mi, err := NewMulti(iio.OS, dir, dir, nil)
+	require.NoError(err)
+
+	tx, err := mi.NewTransaction("pack")
+	require.NoError(err)
+
+	// offsets in a different order than hashes
+	for i := 0; i < 1000; i++ {
+		require.NoError(tx.Add(ihash.SumBytes([]byte(fmt.Sprint(i))), uint32(i), int64(i)*10, uint32(i)))
+	}
+
+	require.NoError(tx.Commit())
+
+	entries := func() Entries {
+		iter, err := mi.EntriesByOffset("pack")
+		require.NoError(err)
+
+		var entries Entries
+		for {
+			e, err := iter.Next()
+			if err == io.EOF {
+				break
+			}
+
+			require.NoError(err)
+			entries = append(entries, e)
+		}
+
+		require.NoError(iter.Close())
+
+		return entries
+	}
+
+	byOffset := entries()
+	require.Len(byOffset, 1000)
+	for i, e := range byOffset {
+		require.Equal(ihash.SumBytes([]byte(fmt.Sprint(i))), e.Key)
+		require.Equal(uint64(i)*10, e.Offset)
+	}
+
+	// built in memory if missing
+	require.NoError(os.Remove(ReverseIndexPath("pack", dir)))
+	require.Equal(byOffset, entries())
+
+	ir, err := NewIndexFromFile(iio.OS, IndexPath("pack", dir))
+	require.NoError(err)
+
+	iter := ir.EntriesByHash()
+	var byHash Entries
+	for {
+		e, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(err)
+		byHash = append(byHash, e)
+	}
+
+	require.NoError(iter.Close())
+
+	sorted := append(Entries(nil), byOffset...)
+	SortEntriesByHash(sorted)
+	require.Equal(sorted, byHash)
+
+	// the reverse index of a different index
+	w := NewIndexWriter()
+	w.Add([]byte("hello"), 1, 10, 100)
+	rev, err := w.ReverseIndex()
+	require.NoError(err)
+
+	_, err = ir.EntriesByOffset(rev)
+	require.ErrorIs(err, ErrInvalidIndex)
+
+	require.NoError(ir.Close())
+	require.NoError(mi.Close())
+}
+
+func TestFilter(t *testing.T) {
+	require := require.New(t)
+
+	f := NewFilter(1000)
+	for i := 0; i < 1000; i++ {
+		f.Add(ihash.SumBytes([]byte(fmt.Sprint(i))))
+	}
+
+	p := path.Join(t.TempDir(), "test.filter")
+	require.NoError(WriteFilter(iio.OS, f, p))
+
+	f, err := NewFilterFromFile(iio.OS, p)
+	require.NoError(err)
+
+	for i := 0; i < 1000; i++ {
+		require.True(f.Has(ihash.SumBytes([]byte(fmt.Sprint(i)))))
+	}
+
+	var positives int
+	for i := 1000; i < 11000; i++ {
+		if f.Has(ihash.SumBytes([]byte(fmt.Sprint(i)))) {
+			positives++
+		}
+	}
+
+	// close to 1%
+	require.Less(positives, 300)
+
+	data, err := os.ReadFile(p)
+	require.NoError(err)
+
+	data[len(filterSig)+20]++
+	require.NoError(os.WriteFile(p, data, 0755))
+
+	_, err = NewFilterFromFile(iio.OS, p)
+	require.ErrorIs(err, ErrInvalidChecksum)
+}
+
+func TestMultiIndexOrder(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	mi, err := NewMulti(iio.OS, dir, dir, nil)
+	require.NoError(err)
+
+	k := ihash.SumBytes([]byte("hello"))
+
+	commit := func(packName string, seq uint64, offset int64) {
+		tx, err := mi.NewTransaction(packName)
+		require.NoError(err)
+		require.NoError(tx.Add(k, 1, offset, 100))
+		tx.SetSequence(seq)
+		require.NoError(tx.Commit())
+	}
+
+	// sequence numbers go first, names break ties
+	commit("a", 2, 10)
+	commit("b", 1, 20)
+	commit("c", 1, 30)
+	require.Equal([]string{"a", "c", "b"}, mi.order)
+
+	pn, offs, err := mi.GetOffset(k)
+	require.NoError(err)
+	require.Equal("a", pn)
+	require.Equal(int64(10), offs)
+
+	require.NoError(mi.WriteMultiPackIndex())
+	pn, _, err = mi.GetOffset(k)
+	require.NoError(err)
+	require.Equal("a", pn)
+
+	// not covered by the multi-pack index, but newer
+	commit("d", 3, 40)
+	pn, _, err = mi.GetOffset(k)
+	require.NoError(err)
+	require.Equal("d", pn)
+
+	// older than some of the covered packfiles
+	commit("e", 1, 50)
+	pn, _, _, err = mi.FindFrom(k, 1)
+	require.NoError(err)
+	require.Equal("d", pn)
+
+	require.NoError(mi.DeleteAll("d"))
+	pn, _, err = mi.GetOffset(k)
+	require.NoError(err)
+	require.Equal("a", pn)
+
+	_, _, _, err = mi.FindFrom(k, 3)
+	require.ErrorIs(err, ErrEntryNotFound)
+
+	require.NoError(mi.Close())
+
+	mi, err = NewMulti(iio.OS, dir, dir, nil)
+	require.NoError(err)
+	require.Equal([]string{"a", "e", "c", "b"}, mi.order)
+	require.NoError(mi.Close())
+}
+
 var indexFixtures = []struct {
 	Name        string
 	GetInstance func(path string) (Idx, error)
@@ -59,7 +350,7 @@ var indexFixtures = []struct {
 	{
 		Name: "multi",
 		GetInstance: func(path string) (Idx, error) {
-			return NewMulti(path, path, 10)
+			return NewMulti(iio.OS, path, path, nil)
 		},
 	},
 }
@@ -110,3 +401,93 @@ func TestReadWriteIdx(t *testing.T) {
 	}
 
 }
+
+func TestMultiPackIndex(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	mi, err := NewMulti(iio.OS, dir, dir, nil)
+	require.NoError(err)
+
+	k1 := ihash.SumBytes([]byte("hello"))
+	k2 := ihash.SumBytes([]byte("bye"))
+	k3 := ihash.SumBytes([]byte("world"))
+
+	tx, err := mi.NewTransaction("pack1")
+	require.NoError(err)
+	require.NoError(tx.Add(k1, 1, 10, 100))
+	require.NoError(tx.Add(k2, 2, 20, 200))
+	require.NoError(tx.Commit())
+
+	tx, err = mi.NewTransaction("pack2")
+	require.NoError(err)
+	require.NoError(tx.Add(k2, 2, 25, 200))
+	require.NoError(tx.Commit())
+
+	require.NoError(mi.WriteMultiPackIndex())
+	require.ElementsMatch([]string{"pack1", "pack2"}, mi.midx.Packs())
+	require.Equal(int64(2), mi.midx.Count())
+	require.NotNil(mi.midx.filter)
+	require.True(mi.midx.filter.Has(k1))
+	require.NotNil(mi.filters["pack1"])
+
+	// the key on the newest packfile shadows the other ones
+	pn, offs, err := mi.GetOffset(k2)
+	require.NoError(err)
+	require.Equal("pack2", pn)
+	require.Equal(int64(25), offs)
+
+	// created after the multi-pack index
+	tx, err = mi.NewTransaction("pack3")
+	require.NoError(err)
+	require.NoError(tx.Add(k3, 3, 30, 300))
+	require.NoError(tx.Commit())
+
+	pn, offs, err = mi.GetOffset(k1)
+	require.NoError(err)
+	require.Equal("pack1", pn)
+	require.Equal(int64(10), offs)
+
+	pn, offs, err = mi.GetOffset(k3)
+	require.NoError(err)
+	require.Equal("pack3", pn)
+	require.Equal(int64(30), offs)
+
+	size, err := mi.GetSize(k2)
+	require.NoError(err)
+	require.Equal(uint32(200), size)
+
+	ok, err := mi.Contains(ihash.SumBytes([]byte("nope")))
+	require.NoError(err)
+	require.False(ok)
+
+	// extend it with the new packfile
+	require.NoError(mi.WriteMultiPackIndex())
+	require.Equal(int64(3), mi.midx.Count())
+
+	mi2, err := NewMulti(iio.OS, dir, dir, nil)
+	require.NoError(err)
+	require.NotNil(mi2.midx)
+	require.Equal(int64(3), mi2.midx.Count())
+
+	require.NoError(mi2.DeleteAll("pack2"))
+
+	// key was on the deleted packfile on the multi-pack index, but still
+	// exists on another one
+	pn, offs, err = mi2.GetOffset(k2)
+	require.NoError(err)
+	require.Equal("pack1", pn)
+	require.Equal(int64(20), offs)
+
+	require.NoError(mi2.DeleteAll("pack1"))
+
+	_, _, err = mi2.GetOffset(k1)
+	require.ErrorIs(err, ErrEntryNotFound)
+
+	_, _, err = mi2.GetOffset(k2)
+	require.ErrorIs(err, ErrEntryNotFound)
+
+	pn, _, err = mi2.GetOffset(k3)
+	require.NoError(err)
+	require.Equal("pack3", pn)
+}
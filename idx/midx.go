@@ -0,0 +1,460 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
+)
+
+// Multi-pack index format:
+//
+// Signature [3]byte: SPM
+// Version uint32: 1
+// NumPacks uint32
+// Pack names, sorted: for each pack, name length uint32 and name bytes
+// Fanout table [256]uint32
+// NumElements = fanoutTable[len(fanoutTable)-1]
+// List of hashes ordered [ihash.HashSize]byte*NumElements
+// Pack positions on the pack names table [4]byte*NumElements
+// Offsets32 [4]byte*NumElements
+// Offsets64 [8]byte*NumElements
+// Sizes [4]byte*NumElements
+// Filter (version >= 1): bloom filter of all the hashes, as on filter files,
+// without signature, version and checksum
+
+const midxName = "multi-pack-index"
+
+var midxSig []byte = []byte{'S', 'P', 'M'}
+var midxVersion uint32 = midxVersionFilter
+
+const (
+	// midxVersionInitial is the first version.
+	midxVersionInitial uint32 = iota
+	// midxVersionFilter adds a filter of all the keys at the end.
+	midxVersionFilter
+)
+
+type midxEntry struct {
+	key    ihash.Hash
+	pack   uint32
+	offset uint64
+	size   uint32
+}
+
+// MultiPackIndex is an index covering several packfiles at once, avoiding
+// to check all packfile indexes one by one.
+type MultiPackIndex struct {
+	packNames []string
+	packs     map[string]struct{}
+
+	fanoutTable [fanoutSize]uint32
+
+	names     []byte
+	positions []byte
+	offsets32 []byte
+	offsets64 []byte
+	sizes     []byte
+
+	// filter is nil on version 0 multi-pack indexes
+	filter *Filter
+}
+
+// NewMultiPackIndexFromFile reads a multi-pack index from the given path.
+func NewMultiPackIndexFromFile(fsys iio.FS, p string) (*MultiPackIndex, error) {
+	f, err := iio.Open(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+
+	midx := &MultiPackIndex{}
+	if _, err := midx.ReadFrom(bufio.NewReader(f)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return midx, f.Close()
+}
+
+func (midx *MultiPackIndex) ReadFrom(r io.Reader) (int64, error) {
+	var nOut int64
+
+	sig := make([]byte, len(midxSig))
+	n, err := io.ReadFull(r, sig)
+	nOut += int64(n)
+	if err != nil {
+		return nOut, err
+	}
+
+	if !bytes.Equal(sig, midxSig) {
+		return nOut, errors.New("not a valid multi-pack index file")
+	}
+
+	var version, numPacks uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nOut, err
+	}
+
+	nOut += 4
+
+	if version > midxVersion {
+		return nOut, errors.New("not a valid multi-pack index version")
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &numPacks); err != nil {
+		return nOut, err
+	}
+
+	nOut += 4
+
+	midx.packs = make(map[string]struct{}, numPacks)
+	for p := uint32(0); p < numPacks; p++ {
+		var nameLen uint32
+		if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+			return nOut, err
+		}
+
+		nOut += 4
+
+		name := make([]byte, nameLen)
+		n, err := io.ReadFull(r, name)
+		nOut += int64(n)
+		if err != nil {
+			return nOut, err
+		}
+
+		midx.packNames = append(midx.packNames, string(name))
+		midx.packs[string(name)] = struct{}{}
+	}
+
+	if err := binary.Read(r, binary.BigEndian, midx.fanoutTable[:]); err != nil {
+		return nOut, err
+	}
+
+	nOut += fanoutSize * 4
+
+	count := int(midx.fanoutTable[fanoutSize-1])
+
+	midx.names = make([]byte, count*ihash.KeySize)
+	midx.positions = make([]byte, count*4)
+	midx.offsets32 = make([]byte, count*4)
+	midx.sizes = make([]byte, count*4)
+
+	for _, b := range [][]byte{midx.names, midx.positions, midx.offsets32} {
+		n, err := io.ReadFull(r, b)
+		nOut += int64(n)
+		if err != nil {
+			return nOut, err
+		}
+	}
+
+	var o64cnt int
+	for p := 0; p < len(midx.offsets32); p += 4 {
+		if midx.offsets32[p]&(byte(1)<<7) > 0 {
+			o64cnt++
+		}
+	}
+
+	midx.offsets64 = make([]byte, o64cnt*8)
+	n, err = io.ReadFull(r, midx.offsets64)
+	nOut += int64(n)
+	if err != nil {
+		return nOut, err
+	}
+
+	n, err = io.ReadFull(r, midx.sizes)
+	nOut += int64(n)
+	if err != nil || version < midxVersionFilter {
+		return nOut, err
+	}
+
+	f, fn, err := readFilter(r)
+	nOut += fn
+	if err != nil {
+		return nOut, err
+	}
+
+	midx.filter = f
+
+	return nOut, nil
+}
+
+// Packs returns the names of the packfiles covered by this index.
+func (midx *MultiPackIndex) Packs() []string {
+	return midx.packNames
+}
+
+// Covers returns true if the packfile is included on this index.
+func (midx *MultiPackIndex) Covers(packName string) bool {
+	_, ok := midx.packs[packName]
+	return ok
+}
+
+func (midx *MultiPackIndex) Count() int64 {
+	return int64(midx.fanoutTable[fanoutSize-1])
+}
+
+// Find returns the packfile name, offset and size of the given key.
+func (midx *MultiPackIndex) Find(h ihash.Hash) (string, int64, uint32, error) {
+	if midx.filter != nil && !midx.filter.Has(h) {
+		return "", 0, 0, ErrEntryNotFound
+	}
+
+	i, ok := midx.findHashIndex(h)
+	if !ok {
+		return "", 0, 0, ErrEntryNotFound
+	}
+
+	e := midx.entry(i)
+
+	return midx.packNames[e.pack], int64(e.offset), e.size, nil
+}
+
+func (midx *MultiPackIndex) findHashIndex(h ihash.Hash) (int, bool) {
+	var low int
+	if h[0] > 0 {
+		low = int(midx.fanoutTable[h[0]-1])
+	}
+
+	high := int(midx.fanoutTable[h[0]])
+
+	i := low + sort.Search(high-low, func(i int) bool {
+		offset := (low + i) * ihash.KeySize
+		return bytes.Compare(h[:], midx.names[offset:offset+ihash.KeySize]) <= 0
+	})
+
+	if i >= high {
+		return 0, false
+	}
+
+	offset := i * ihash.KeySize
+	return i, bytes.Equal(h[:], midx.names[offset:offset+ihash.KeySize])
+}
+
+func (midx *MultiPackIndex) entry(i int) *midxEntry {
+	e := &midxEntry{
+		pack: binary.BigEndian.Uint32(midx.positions[i*4:]),
+		size: binary.BigEndian.Uint32(midx.sizes[i*4:]),
+	}
+
+	copy(e.key[:], midx.names[i*ihash.KeySize:])
+
+	ofs := binary.BigEndian.Uint32(midx.offsets32[i*4:])
+	if (uint64(ofs) & isO64Mask) != 0 {
+		offset := 8 * (uint64(ofs) & ^isO64Mask)
+		e.offset = binary.BigEndian.Uint64(midx.offsets64[offset : offset+8])
+	} else {
+		e.offset = uint64(ofs)
+	}
+
+	return e
+}
+
+// MultiPackIndexWriter generates a multi-pack index from packfile indexes.
+type MultiPackIndexWriter struct {
+	packNames []string
+	packPos   map[string]uint32
+	entries   []*midxEntry
+	newer     func(a, b string) bool
+}
+
+func NewMultiPackIndexWriter() *MultiPackIndexWriter {
+	return &MultiPackIndexWriter{
+		packPos: make(map[string]uint32),
+	}
+}
+
+// SetNewer sets the function used to choose between entries with the same
+// key. The entry from the packfile that is newer is kept.
+func (w *MultiPackIndexWriter) SetNewer(newer func(a, b string) bool) {
+	w.newer = newer
+}
+
+// Add adds a packfile entry into the multi-pack index. Packfile names are
+// assigned positions in the order they are first added. If the same key is
+// added several times, the one from the newest packfile is kept, or the last
+// added one if there is no newer function.
+func (w *MultiPackIndexWriter) Add(packName string, e *Entry) {
+	pos, ok := w.packPos[packName]
+	if !ok {
+		pos = uint32(len(w.packNames))
+		w.packPos[packName] = pos
+		w.packNames = append(w.packNames, packName)
+	}
+
+	w.entries = append(w.entries, &midxEntry{
+		key:    e.Key,
+		pack:   pos,
+		offset: e.Offset,
+		size:   e.Size,
+	})
+}
+
+// AddIndex adds all the entries from a packfile index.
+func (w *MultiPackIndexWriter) AddIndex(packName string, ir *IndexReader) error {
+	return ir.ForEach(func(e *Entry) error {
+		w.Add(packName, e)
+		return nil
+	})
+}
+
+// AddMultiPackIndex adds all the entries from a previous multi-pack index,
+// skipping the ones from packfiles not accepted by the filter function.
+func (w *MultiPackIndexWriter) AddMultiPackIndex(midx *MultiPackIndex, filter func(packName string) bool) {
+	for i := 0; i < int(midx.Count()); i++ {
+		me := midx.entry(i)
+		packName := midx.packNames[me.pack]
+		if !filter(packName) {
+			continue
+		}
+
+		w.Add(packName, &Entry{
+			Key:    me.key,
+			Offset: me.offset,
+			Size:   me.size,
+		})
+	}
+}
+
+func (w *MultiPackIndexWriter) prepareData() ([]string, []*midxEntry) {
+	// sort pack names to make the output deterministic
+	sortedNames := make([]string, len(w.packNames))
+	copy(sortedNames, w.packNames)
+	sort.Strings(sortedNames)
+
+	mapping := make([]uint32, len(w.packNames))
+	for i, n := range w.packNames {
+		mapping[i] = uint32(sort.SearchStrings(sortedNames, n))
+	}
+
+	// stable sort keeps insertion order for duplicated keys
+	sort.SliceStable(w.entries, func(i, j int) bool {
+		return bytes.Compare(w.entries[i].key[:], w.entries[j].key[:]) < 0
+	})
+
+	var entries []*midxEntry
+	for _, e := range w.entries {
+		e.pack = mapping[e.pack]
+		if len(entries) > 0 && entries[len(entries)-1].key == e.key {
+			last := entries[len(entries)-1]
+			if w.newer == nil || !w.newer(sortedNames[last.pack], sortedNames[e.pack]) {
+				entries[len(entries)-1] = e
+			}
+
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	w.packNames = sortedNames
+	w.entries = entries
+
+	return sortedNames, entries
+}
+
+func (w *MultiPackIndexWriter) WriteTo(writer io.Writer) (int64, error) {
+	names, entries := w.prepareData()
+
+	bw := bufio.NewWriter(writer)
+	cw := &countWriter{w: bw}
+
+	cw.Write(midxSig)
+	binary.Write(cw, binary.BigEndian, midxVersion)
+	binary.Write(cw, binary.BigEndian, uint32(len(names)))
+	for _, n := range names {
+		binary.Write(cw, binary.BigEndian, uint32(len(n)))
+		cw.Write([]byte(n))
+	}
+
+	var fanout [fanoutSize]uint32
+	for _, e := range entries {
+		fanout[e.key[0]]++
+	}
+
+	for i := 1; i < fanoutSize; i++ {
+		fanout[i] += fanout[i-1]
+	}
+
+	binary.Write(cw, binary.BigEndian, fanout[:])
+
+	for _, e := range entries {
+		cw.Write(e.key[:])
+	}
+
+	for _, e := range entries {
+		binary.Write(cw, binary.BigEndian, e.pack)
+	}
+
+	var offsets64 []uint64
+	for _, e := range entries {
+		offset := e.offset
+		if offset > math.MaxInt32 {
+			offset = uint64(len(offsets64)) | isO64Mask
+			offsets64 = append(offsets64, e.offset)
+		}
+
+		binary.Write(cw, binary.BigEndian, uint32(offset))
+	}
+
+	binary.Write(cw, binary.BigEndian, offsets64)
+
+	for _, e := range entries {
+		binary.Write(cw, binary.BigEndian, e.size)
+	}
+
+	filter := NewFilter(len(entries))
+	for _, e := range entries {
+		filter.Add(e.key)
+	}
+
+	filter.writeTo(cw)
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+
+	return cw.n, bw.Flush()
+}
+
+// WriteMultiPackIndex writes the multi-pack index into the specified path.
+func WriteMultiPackIndex(fsys iio.FS, w *MultiPackIndexWriter, path string) error {
+	f, err := iio.OpenFile(fsys, path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// countWriter counts written bytes and keeps the first error, to be able to
+// write several fields checking for errors only once.
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+
+	return n, err
+}
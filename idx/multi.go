@@ -1,138 +1,554 @@
 package idx
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
-	"os"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
-	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ajnavarro/super-blockstore/iio"
+	"go.uber.org/multierr"
 )
 
 var _ Idx = &MultiIndex{}
 
+// MultiIndex keeps the indexes of all the available packfiles open. Indexes
+// are mapped in memory, so opening them is cheap and their data is only
+// loaded when used.
 type MultiIndex struct {
-	indexes        *lru.Cache[string, *IndexReader]
+	fsys           iio.FS
 	path           string
 	processingPath string
-
-	mu  sync.RWMutex
-	ids map[string]struct{}
+	rebuild        RebuildFunc
+	durability     iio.Durability
+
+	mu sync.RWMutex
+	// indexes contains the index of every available packfile
+	indexes map[string]*IndexReader
+	// filters contains the filters of the packfiles having one
+	filters map[string]*Filter
+	// retired contains the packfiles removed while in use. They are only
+	// found when asking for them explicitly.
+	retired map[string]struct{}
+	// order contains the packfile names, newest first
+	order []string
+	midx  *MultiPackIndex
 }
 
-func NewMulti(path, processingPath string, maxOpenIndexes int) (*MultiIndex, error) {
-	cache, err := lru.New[string, *IndexReader](
-		maxOpenIndexes,
-	)
-	if err != nil {
-		return nil, err
-	}
+// RebuildFunc adds all the blocks of a packfile into the index writer,
+// setting its packfile checksum and, if known, its sequence number. It is
+// used to rebuild missing indexes.
+type RebuildFunc func(packName string, w *IndexWriter) error
 
+// NewMulti opens the indexes of all the packfiles on path. Indexes missing
+// for a packfile, or whose header or tables are broken, are rebuilt using the
+// rebuild function, if not nil.
+func NewMulti(fsys iio.FS, path, processingPath string, rebuild RebuildFunc) (*MultiIndex, error) {
 	mi := &MultiIndex{
-		indexes:        cache,
+		fsys:           fsys,
 		path:           path,
 		processingPath: processingPath,
-		ids:            map[string]struct{}{},
+		rebuild:        rebuild,
+		durability:     iio.DurabilityFull,
+		indexes:        map[string]*IndexReader{},
+		filters:        map[string]*Filter{},
+		retired:        map[string]struct{}{},
 	}
 
-	return mi, mi.reloadPacks()
+	if err := mi.reloadPacks(); err != nil {
+		mi.Close()
+		return nil, err
+	}
+
+	return mi, nil
+}
+
+// SetDurability sets which data is synced to disk when writing indexes. It
+// defaults to iio.DurabilityFull, and must be set before writing any index.
+func (i *MultiIndex) SetDurability(d iio.Durability) {
+	i.durability = d
 }
 
-func (i *MultiIndex) lookup(irfs func(string, *IndexReader) error) error {
+// find looks for the key on the packfile indexes not covered by the
+// multi-pack index and on the multi-pack index. If the key is on several
+// packfiles, the newest one is returned.
+func (i *MultiIndex) find(key ihash.Hash) (string, int64, uint32, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
-	var forLater []string
-	for k := range i.ids {
-		ir, ok := i.indexes.Get(k)
-		if !ok {
-			forLater = append(forLater, k)
+
+	if i.midx == nil {
+		return i.lookup(key, nil)
+	}
+
+	packID, offset, size, err := i.lookup(key, i.midx)
+	if err != nil && err != ErrEntryNotFound {
+		return "", 0, 0, err
+	}
+
+	mPackID, mOffset, mSize, mErr := i.midx.Find(key)
+	if mErr == ErrEntryNotFound {
+		return packID, offset, size, err
+	}
+
+	if mErr != nil {
+		return "", 0, 0, mErr
+	}
+
+	// the packfile was deleted after writing the multi-pack index. The key
+	// could still be on any other packfile.
+	if !i.available(mPackID) {
+		return i.lookup(key, nil)
+	}
+
+	if err == nil && i.newer(packID, mPackID) {
+		return packID, offset, size, nil
+	}
+
+	return mPackID, mOffset, mSize, nil
+}
+
+// lookup checks packfile indexes one by one, newest first, skipping the ones
+// covered by the multi-pack index, if any, and the ones whose filter does not
+// contain the key.
+func (i *MultiIndex) lookup(key ihash.Hash, midx *MultiPackIndex) (string, int64, uint32, error) {
+	for _, k := range i.order {
+		if midx != nil && midx.Covers(k) {
 			continue
 		}
 
-		err := irfs(k, ir)
-		if err == ErrEntryNotFound {
+		if _, ok := i.retired[k]; ok {
 			continue
 		}
+
+		ir := i.indexes[k]
+
+		if !i.mayContain(k, key) {
+			continue
+		}
+
+		offset, size, ok, err := ir.find(key)
 		if err != nil {
-			return err
+			return "", 0, 0, err
 		}
 
-		return nil
+		if !ok {
+			continue
+		}
+
+		return k, offset, size, nil
 	}
 
-	// After searching on cached indexes, we need to check uncached ones:
-	for _, k := range forLater {
-		ir, err := NewIndexFromFile(indexPath(k, i.path))
-		if err != nil {
-			return err
+	return "", 0, 0, ErrEntryNotFound
+}
+
+// available returns true if the packfile has an index and it is not retired.
+// It must be called holding the lock.
+func (i *MultiIndex) available(packName string) bool {
+	_, ok := i.indexes[packName]
+	_, retired := i.retired[packName]
+	return ok && !retired
+}
+
+// mayContain returns false if the packfile filter does not contain the key.
+// Packfiles without filter may contain any key.
+func (i *MultiIndex) mayContain(packName string, key ihash.Hash) bool {
+	f, ok := i.filters[packName]
+	return !ok || f.Has(key)
+}
+
+// FindFrom returns the packfile name, offset and size of the key, only
+// looking into packfiles with a sequence number equal or greater than
+// minSeq. If the key is on several of them, the newest one is returned.
+func (i *MultiIndex) FindFrom(key ihash.Hash, minSeq uint64) (string, int64, uint32, error) {
+	if minSeq == 0 {
+		return i.find(key)
+	}
+
+	return i.findIn(key, minSeq, nil)
+}
+
+// FindIn is like FindFrom, only looking into the given packfiles.
+func (i *MultiIndex) FindIn(key ihash.Hash, minSeq uint64, packs map[string]struct{}) (string, int64, uint32, error) {
+	return i.findIn(key, minSeq, packs)
+}
+
+// findIn checks packfile indexes with a sequence number equal or greater
+// than minSeq, newest first. If packs is not nil, only the packfiles on it
+// are checked, including retired ones.
+func (i *MultiIndex) findIn(key ihash.Hash, minSeq uint64, packs map[string]struct{}) (string, int64, uint32, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for _, k := range i.order {
+		ir := i.indexes[k]
+
+		// packfiles are sorted by sequence number
+		if ir.Sequence() < minSeq {
+			break
+		}
+
+		if packs != nil {
+			if _, ok := packs[k]; !ok {
+				continue
+			}
+		} else if _, ok := i.retired[k]; ok {
+			continue
 		}
 
-		err = irfs(k, ir)
-		if err == ErrEntryNotFound {
+		if !i.mayContain(k, key) {
 			continue
 		}
+
+		offset, size, ok, err := ir.find(key)
 		if err != nil {
-			return err
+			return "", 0, 0, err
 		}
 
-		// only add to LRU cache if we find something
-		i.indexes.Add(k, ir)
+		if ok {
+			return k, offset, size, nil
+		}
+	}
 
-		return nil
+	return "", 0, 0, ErrEntryNotFound
+}
+
+// newer returns true if packfile a was created after packfile b. Packfiles
+// are ordered by sequence number, and packfiles with the same one by name.
+// It must be called holding the lock.
+func (i *MultiIndex) newer(a, b string) bool {
+	sa, sb := i.indexes[a].Sequence(), i.indexes[b].Sequence()
+	if sa != sb {
+		return sa > sb
 	}
 
-	return ErrEntryNotFound
+	return a > b
 }
 
-func (i *MultiIndex) GetOffset(key ihash.Hash) (string, int64, error) {
-	var packID string
-	var offset int64
-	err := i.lookup(func(id string, ir *IndexReader) error {
-		off, err := ir.GetOffset(key)
-		offset = off
-		packID = id
-		return err
+// sortPacks updates the packfile lookup order. It must be called holding the
+// lock.
+func (i *MultiIndex) sortPacks() {
+	i.order = i.order[:0]
+	for k := range i.indexes {
+		i.order = append(i.order, k)
+	}
+
+	sort.Slice(i.order, func(a, b int) bool {
+		return i.newer(i.order[a], i.order[b])
 	})
+}
+
+// Sequence returns the sequence number of the specified packfile, or zero if
+// it is unknown.
+func (i *MultiIndex) Sequence(packName string) uint64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	ir, ok := i.indexes[packName]
+	if !ok {
+		return 0
+	}
+
+	return ir.Sequence()
+}
 
+// MultiPackIndexPacks returns the packfiles covered by the multi-pack index,
+// also the ones deleted after writing it. It is nil if there is none.
+func (i *MultiIndex) MultiPackIndexPacks() []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.midx == nil {
+		return nil
+	}
+
+	return append([]string(nil), i.midx.Packs()...)
+}
+
+// MaxSequence returns the highest sequence number from all the packfiles.
+func (i *MultiIndex) MaxSequence() uint64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var max uint64
+	for _, ir := range i.indexes {
+		if seq := ir.Sequence(); seq > max {
+			max = seq
+		}
+	}
+
+	return max
+}
+
+func (i *MultiIndex) GetOffset(key ihash.Hash) (string, int64, error) {
+	packID, offset, _, err := i.find(key)
 	return packID, offset, err
 }
 
 func (i *MultiIndex) Contains(key ihash.Hash) (bool, error) {
-	var contains bool
-	err := i.lookup(func(id string, ir *IndexReader) error {
-		ok, err := ir.Contains(key)
-		contains = ok
-		return err
-	})
+	_, _, _, err := i.find(key)
+	if err == ErrEntryNotFound {
+		return false, nil
+	}
 
-	return contains, err
+	return err == nil, err
 }
 
 func (i *MultiIndex) GetSize(key ihash.Hash) (uint32, error) {
-	var size uint32
-	err := i.lookup(func(id string, ir *IndexReader) error {
-		s, err := ir.GetSize(key)
-		size = s
+	_, _, size, err := i.find(key)
+	return size, err
+}
+
+// WriteMultiPackIndex generates a new multi-pack index covering all the
+// available packfiles. Entries from the previous multi-pack index are
+// reused, so only indexes from packfiles created after it are read.
+func (i *MultiIndex) WriteMultiPackIndex() error {
+	w := NewMultiPackIndexWriter()
+
+	// indexes are released when deleting their packfile, so they are only
+	// read while holding the lock
+	i.mu.RLock()
+	prev := i.midx
+
+	// keep the newest entry of duplicated keys
+	rank := make(map[string]int, len(i.order))
+	for r, k := range i.order {
+		rank[k] = r
+	}
+
+	w.SetNewer(func(a, b string) bool {
+		return rank[a] < rank[b]
+	})
+
+	if prev != nil {
+		w.AddMultiPackIndex(prev, i.available)
+	}
+
+	for _, k := range i.order {
+		if prev != nil && prev.Covers(k) {
+			continue
+		}
+
+		if _, ok := i.retired[k]; ok {
+			continue
+		}
+
+		if err := w.AddIndex(k, i.indexes[k]); err != nil {
+			i.mu.RUnlock()
+			return err
+		}
+	}
+	i.mu.RUnlock()
+
+	pp := path.Join(i.processingPath, midxName+".writting")
+	if err := WriteMultiPackIndex(i.fsys, w, pp); err != nil {
+		return err
+	}
+
+	if err := i.durability.SyncFile(i.fsys, pp); err != nil {
+		return err
+	}
+
+	midx, err := NewMultiPackIndexFromFile(i.fsys, pp)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := iio.Rename(i.fsys, pp, path.Join(i.path, midxName)); err != nil {
+		return err
+	}
+
+	if err := i.durability.SyncDir(i.fsys, i.path); err != nil {
 		return err
+	}
+
+	i.midx = midx
+
+	return nil
+}
+
+// PackIDs returns the sorted list of packfile IDs with an available index,
+// excluding retired ones.
+func (i *MultiIndex) PackIDs() []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	ids := make([]string, 0, len(i.indexes))
+	for k := range i.indexes {
+		if _, ok := i.retired[k]; ok {
+			continue
+		}
+
+		ids = append(ids, k)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// SortNewest sorts the given packfile IDs newest first, the same order used
+// by lookups. Packfiles without an index are placed at the end.
+func (i *MultiIndex) SortNewest(ids []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	rank := make(map[string]int, len(i.order))
+	for r, k := range i.order {
+		rank[k] = r
+	}
+
+	sort.SliceStable(ids, func(a, b int) bool {
+		ra, ok := rank[ids[a]]
+		if !ok {
+			ra = len(i.order)
+		}
+
+		rb, ok := rank[ids[b]]
+		if !ok {
+			rb = len(i.order)
+		}
+
+		return ra < rb
 	})
+}
 
-	return size, err
+// index returns the specified packfile index. It must be called holding the
+// lock.
+func (i *MultiIndex) index(packName string) (*IndexReader, error) {
+	ir, ok := i.indexes[packName]
+	if !ok {
+		return nil, fmt.Errorf("index %s: %w", packName, fs.ErrNotExist)
+	}
+
+	return ir, nil
+}
+
+// PackChecksum returns the packfile checksum stored on the specified
+// packfile index.
+func (i *MultiIndex) PackChecksum(packName string) (ihash.Hash, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	ir, err := i.index(packName)
+	if err != nil {
+		return ihash.Hash{}, err
+	}
+
+	return ir.PackChecksum(), nil
+}
+
+// ForEach calls fn with all the entries from the specified packfile index,
+// in hash order. The index cannot be deleted until fn returns for all the
+// entries.
+func (i *MultiIndex) ForEach(packName string, fn func(e *Entry) error) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	ir, err := i.index(packName)
+	if err != nil {
+		return err
+	}
+
+	return ir.ForEach(fn)
+}
+
+// EntriesByOffset returns an iterator over the entries of the specified
+// packfile index, in the order they are on the packfile. The iterator opens
+// its own copy of the index, so it keeps working if the packfile is deleted.
+// Packfiles without reverse index get one built in memory.
+func (i *MultiIndex) EntriesByOffset(packName string) (EntryIter, error) {
+	ir, err := NewIndexFromFile(i.fsys, IndexPath(packName, i.path))
+	if err != nil {
+		return nil, err
+	}
+
+	rev, err := NewReverseIndexFromFile(i.fsys, ReverseIndexPath(packName, i.path))
+	if errors.Is(err, fs.ErrNotExist) {
+		rev, err = NewReverseIndex(ir)
+	}
+
+	if err != nil {
+		return nil, multierr.Combine(err, ir.Close())
+	}
+
+	iter, err := ir.EntriesByOffset(rev)
+	if err != nil {
+		return nil, multierr.Combine(err, rev.Close(), ir.Close())
+	}
+
+	iter.(*entryIter).close = func() error {
+		return multierr.Combine(rev.Close(), ir.Close())
+	}
+
+	return iter, nil
+}
+
+// Retire hides a packfile from lookups and from the list of packfiles,
+// keeping its index available for the ones asking for it explicitly until
+// it is deleted.
+func (i *MultiIndex) Retire(packName string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.indexes[packName]; ok {
+		i.retired[packName] = struct{}{}
+	}
+}
+
+// Retired returns true if the packfile was retired and not deleted yet.
+func (i *MultiIndex) Retired(packName string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	_, ok := i.retired[packName]
+	return ok
+}
+
+// HasRetired returns true if any packfile was retired and not deleted yet.
+func (i *MultiIndex) HasRetired() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.retired) != 0
 }
 
 func (i *MultiIndex) DeleteAll(packName string) error {
-	if err := os.Remove(indexPath(packName, i.path)); err != nil {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.fsys.Remove(IndexPath(packName, i.path)); err != nil {
 		return err
 	}
 
-	delete(i.ids, packName)
+	// the filter and the reverse index are useless without the index
+	delete(i.filters, packName)
+	for _, p := range []string{
+		FilterPath(packName, i.path),
+		ReverseIndexPath(packName, i.path),
+	} {
+		if err := i.fsys.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
 
-	i.indexes.Remove(packName)
+	ir, ok := i.indexes[packName]
+	if !ok {
+		return nil
+	}
 
-	return nil
+	delete(i.indexes, packName)
+	delete(i.retired, packName)
+	i.sortPacks()
+
+	return ir.Close()
 }
 
 func (i *MultiIndex) NewTransaction(packName string) (Transaction, error) {
@@ -141,15 +557,25 @@ func (i *MultiIndex) NewTransaction(packName string) (Transaction, error) {
 		packName:       packName,
 		path:           i.path,
 		processingPath: i.processingPath,
-		ids:            i.ids,
+		mi:             i,
 	}, nil
 }
 
 func (i *MultiIndex) Close() error {
-	i.ids = nil
-	i.indexes.Purge()
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-	return nil
+	var err error
+	for _, ir := range i.indexes {
+		err = multierr.Append(err, ir.Close())
+	}
+
+	i.indexes = nil
+	i.filters = nil
+	i.order = nil
+	i.midx = nil
+
+	return err
 }
 
 type multiIndexTransaction struct {
@@ -158,8 +584,12 @@ type multiIndexTransaction struct {
 	packName       string
 	path           string
 	processingPath string
+	prepared       bool
+	// ir and f are set once the index is staged on the packs folder
+	ir *IndexReader
+	f  *Filter
 
-	ids map[string]struct{}
+	mi *MultiIndex
 }
 
 func (txn *multiIndexTransaction) Add(key ihash.Hash, crc32 uint32, pos int64, size uint32) error {
@@ -167,32 +597,170 @@ func (txn *multiIndexTransaction) Add(key ihash.Hash, crc32 uint32, pos int64, s
 	return nil
 }
 
-func (txn *multiIndexTransaction) Commit() error {
-	pp := indexProcessingPath(txn.packName, txn.processingPath)
-	if err := WriteIndex(txn.w, pp); err != nil {
+func (txn *multiIndexTransaction) Contains(key ihash.Hash) bool {
+	return txn.w.Contains(key)
+}
+
+func (txn *multiIndexTransaction) SetPackChecksum(h ihash.Hash) {
+	txn.w.SetPackChecksum(h)
+}
+
+func (txn *multiIndexTransaction) SetSequence(seq uint64) {
+	txn.w.SetSequence(seq)
+}
+
+func (txn *multiIndexTransaction) Prepare() error {
+	fp := FilterProcessingPath(txn.packName, txn.processingPath)
+	if err := WriteFilter(txn.mi.fsys, txn.w.Filter(), fp); err != nil {
 		return err
 	}
 
-	ip := indexPath(txn.packName, txn.path)
+	rev, err := txn.w.ReverseIndex()
+	if err != nil {
+		return err
+	}
 
-	if err := os.Rename(pp, ip); err != nil {
+	rp := ReverseIndexProcessingPath(txn.packName, txn.processingPath)
+	if err := WriteReverseIndex(txn.mi.fsys, rev, rp); err != nil {
 		return err
 	}
 
-	txn.ids[txn.packName] = struct{}{}
+	ip := IndexProcessingPath(txn.packName, txn.processingPath)
+	if err := WriteIndex(txn.mi.fsys, txn.w, ip); err != nil {
+		return err
+	}
+
+	// contents must be on disk before renaming the files into the packs
+	// folder
+	for _, p := range []string{fp, rp, ip} {
+		if err := txn.mi.durability.SyncFile(txn.mi.fsys, p); err != nil {
+			return err
+		}
+	}
+
+	if err := txn.mi.durability.SyncDir(txn.mi.fsys, txn.processingPath); err != nil {
+		return err
+	}
+
+	txn.prepared = true
 
 	return nil
 }
 
+func (txn *multiIndexTransaction) Stage() error {
+	if txn.ir != nil {
+		return nil
+	}
+
+	if !txn.prepared {
+		if err := txn.Prepare(); err != nil {
+			return err
+		}
+	}
+
+	// the filter must be there before the index makes the packfile available
+	fp := FilterPath(txn.packName, txn.path)
+	if err := txn.mi.fsys.Rename(FilterProcessingPath(txn.packName, txn.processingPath), fp); err != nil {
+		return err
+	}
+
+	if err := txn.mi.fsys.Rename(
+		ReverseIndexProcessingPath(txn.packName, txn.processingPath),
+		ReverseIndexPath(txn.packName, txn.path),
+	); err != nil {
+		return err
+	}
+
+	ip := IndexPath(txn.packName, txn.path)
+	if err := txn.mi.fsys.Rename(IndexProcessingPath(txn.packName, txn.processingPath), ip); err != nil {
+		return err
+	}
+
+	if err := txn.mi.durability.SyncDir(txn.mi.fsys, txn.path); err != nil {
+		return err
+	}
+
+	f, err := NewFilterFromFile(txn.mi.fsys, fp)
+	if err != nil {
+		return err
+	}
+
+	ir, err := NewIndexFromFile(txn.mi.fsys, ip)
+	if err != nil {
+		return err
+	}
+
+	txn.f = f
+	txn.ir = ir
+
+	return nil
+}
+
+func (txn *multiIndexTransaction) Commit() error {
+	if err := txn.Stage(); err != nil {
+		return err
+	}
+
+	txn.mi.mu.Lock()
+	defer txn.mi.mu.Unlock()
+
+	txn.publish()
+
+	return nil
+}
+
+// publish makes the staged index available. It must be called holding the
+// lock.
+func (txn *multiIndexTransaction) publish() {
+	txn.mi.indexes[txn.packName] = txn.ir
+	txn.mi.filters[txn.packName] = txn.f
+	txn.mi.sortPacks()
+}
+
 func (txn *multiIndexTransaction) Discard() error {
 	txn.w = nil
-	return nil
+	if !txn.prepared {
+		return nil
+	}
+
+	var err error
+	if txn.ir != nil {
+		err = txn.ir.Close()
+		txn.ir = nil
+		txn.f = nil
+	}
+
+	// a failed Stage could have moved only some of the files
+	for _, p := range []string{
+		FilterProcessingPath(txn.packName, txn.processingPath),
+		ReverseIndexProcessingPath(txn.packName, txn.processingPath),
+		IndexProcessingPath(txn.packName, txn.processingPath),
+		FilterPath(txn.packName, txn.path),
+		ReverseIndexPath(txn.packName, txn.path),
+		IndexPath(txn.packName, txn.path),
+	} {
+		err = multierr.Append(err, iio.RemoveIfExists(txn.mi.fsys, p))
+	}
+
+	return err
 }
 
 func (i *MultiIndex) reloadPacks() error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	return filepath.WalkDir(i.path, func(p string, d fs.DirEntry, err error) error {
+
+	midx, err := NewMultiPackIndexFromFile(i.fsys, path.Join(i.path, midxName))
+	switch {
+	case err == nil:
+		i.midx = midx
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	defer i.sortPacks()
+
+	var packs []string
+	err = iio.WalkDir(i.fsys, i.path, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -206,21 +774,101 @@ func (i *MultiIndex) reloadPacks() error {
 		key := strings.TrimSuffix(file, ext)
 
 		if ext == ".idx" {
-			if _, exists := i.ids[key]; exists {
+			if _, exists := i.indexes[key]; exists {
 				return nil
 			}
 
-			i.ids[key] = struct{}{}
+			// only the header and the table sizes are checked, so opening
+			// does not depend on the index size. Check verifies checksums.
+			ir, err := NewIndexFromFile(i.fsys, p)
+			if err != nil {
+				// broken indexes are rebuilt like the missing ones
+				if i.rebuild != nil && (errors.Is(err, ErrInvalidIndex) || errors.Is(err, io.ErrUnexpectedEOF)) {
+					return nil
+				}
+
+				return fmt.Errorf("opening index %s: %w", key, err)
+			}
+
+			i.indexes[key] = ir
+
+			// packfiles committed before adding filters have none
+			f, err := NewFilterFromFile(i.fsys, FilterPath(key, i.path))
+			switch {
+			case err == nil:
+				i.filters[key] = f
+			case !errors.Is(err, fs.ErrNotExist):
+				return err
+			}
+		}
+
+		if ext == ".pack" {
+			packs = append(packs, key)
 		}
 
 		return nil
 	})
+	if err != nil || i.rebuild == nil {
+		return err
+	}
+
+	for _, k := range packs {
+		if _, ok := i.indexes[k]; ok {
+			continue
+		}
+
+		if err := i.rebuildIndex(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildIndex writes a new index for the packfile, as done when committing
+// it. It must be called holding the lock.
+func (i *MultiIndex) rebuildIndex(packName string) error {
+	txn := &multiIndexTransaction{
+		w:              NewIndexWriter(),
+		packName:       packName,
+		path:           i.path,
+		processingPath: i.processingPath,
+		mi:             i,
+	}
+
+	if err := i.rebuild(packName, txn.w); err != nil {
+		return err
+	}
+
+	// packfile IDs are increasing, so packfiles without sequence number are
+	// placed after the ones created before them
+	if txn.w.Sequence() == 0 {
+		var seq uint64
+		for k, ir := range i.indexes {
+			if k < packName && ir.Sequence() > seq {
+				seq = ir.Sequence()
+			}
+		}
+
+		txn.w.SetSequence(seq)
+	}
+
+	if err := txn.Stage(); err != nil {
+		return err
+	}
+
+	txn.publish()
+
+	return nil
 }
 
-func indexPath(name, packPath string) string {
+// IndexPath returns the path of the index for the specified packfile.
+func IndexPath(name, packPath string) string {
 	return path.Join(packPath, fmt.Sprintf("%s.idx", name))
 }
 
-func indexProcessingPath(name, packPath string) string {
+// IndexProcessingPath returns the path of the index for the specified packfile
+// while it is being written.
+func IndexProcessingPath(name, packPath string) string {
 	return path.Join(packPath, fmt.Sprintf("%s.idx.writting", name))
 }
@@ -2,10 +2,12 @@ package idx
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"os"
+	"sort"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
 	"github.com/ajnavarro/super-blockstore/iio"
@@ -13,249 +15,299 @@ import (
 
 var _ io.ReaderFrom = &IndexReader{}
 
-func NewIndexFromFile(p string) (*IndexReader, error) {
-	idx := NewIndexReader()
-	idxf, err := iio.OpenFile(p, os.O_RDONLY, 0755)
+// NewIndexFromFile opens an index mapping it in memory. Only the header and
+// the table sizes are checked, so opening it does not depend on the number of
+// entries. Use Verify to check the index checksum.
+func NewIndexFromFile(fsys iio.FS, p string) (*IndexReader, error) {
+	f, err := iio.Open(fsys, p)
 	if err != nil {
 		return nil, err
 	}
-	_, err = idx.ReadFrom(idxf)
+
+	data, mmapped, err := iio.Mmap(f)
 	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	release := func() {
+		if mmapped {
+			iio.Munmap(data)
+		}
+	}
+
+	// the mapping is still valid after closing the file
+	if err := f.Close(); err != nil {
+		release()
 		return nil, err
 	}
 
-	return idx, idxf.Close()
+	idx := NewIndexReader()
+	if err := idx.load(data); err != nil {
+		release()
+		return nil, err
+	}
+
+	idx.mmapped = mmapped
+
+	return idx, nil
 }
 
 func NewIndexReader() *IndexReader {
-	return &IndexReader{
-		fanoutTable: make([]uint32, fanoutSize),
-	}
+	return &IndexReader{}
 }
 
+// IndexReader looks up keys directly on the index data, without copying it.
 type IndexReader struct {
-	fanoutTable   []uint32
-	fanoutMapping [256]int
-
-	names     [][]byte
-	crcs32    [][]byte
-	offsets32 [][]byte
-	offsets64 []byte
-	sizes     [][]byte
+	data []byte
+	// mmapped is true if data must be released using iio.Munmap.
+	mmapped bool
+
+	version      uint32
+	sequence     uint64
+	count        int
+	packChecksum ihash.Hash
+
+	// positions of each table on data
+	fanout, names, crcs32, sizes, offsets32, offsets64 int
+	numOffsets64                                       int
 }
 
+// ReadFrom reads the whole index in memory, checking the index checksum if
+// present.
 func (idx *IndexReader) ReadFrom(r io.Reader) (int64, error) {
-	var nOut int64
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
 
-	flow := []func(io.Reader) (int, error){
-		readSignature,
-		readVersion,
-		idx.readFanout,
-		idx.readNames,
-		idx.readCRC,
-		idx.readSizes,
-		idx.readOffsets,
-		// TODO footer with checksum
-	}
-
-	for _, e := range flow {
-		n, err := e(r)
-		nOut += int64(n)
-		if err != nil {
-			return nOut, err
-		}
+	if err := idx.load(data); err != nil {
+		return int64(len(data)), err
 	}
 
-	return nOut, nil
+	return int64(len(data)), idx.Verify()
 }
 
-func (idx *IndexReader) readFanout(r io.Reader) (int, error) {
-	var nOut int
-	for k := 0; k < fanoutSize; k++ {
-		var v uint32
-		if err := binary.Read(r, binary.BigEndian, &v); err != nil {
-			return nOut, err
+// load sets the index data, checking the header and that the size of the
+// data matches the number of entries.
+func (idx *IndexReader) load(data []byte) error {
+	r := bytes.NewReader(data)
+	for _, e := range []func(io.Reader) (int, error){
+		readSignature,
+		idx.readVersion,
+		idx.readSequence,
+	} {
+		if _, err := e(r); err != nil {
+			return err
 		}
+	}
 
-		nOut += 4
+	idx.fanout = len(data) - r.Len()
+	idx.names = idx.fanout + fanoutSize*4
 
-		idx.fanoutTable[k] = v
-		idx.fanoutMapping[k] = noMapping
+	var footer int
+	if idx.version >= indexVersionChecksums {
+		footer = 2 * ihash.KeySize
 	}
 
-	return nOut, nil
-}
+	if len(data) < idx.names+footer {
+		return io.ErrUnexpectedEOF
+	}
 
-func (idx *IndexReader) readNames(r io.Reader) (int, error) {
-	var nOut int
+	idx.data = data
+
+	var prev uint32
 	for k := 0; k < fanoutSize; k++ {
-		var buckets uint32
-		if k == 0 {
-			buckets = idx.fanoutTable[k]
-		} else {
-			buckets = idx.fanoutTable[k] - idx.fanoutTable[k-1]
+		v := idx.fanoutAt(k)
+		if v < prev {
+			return ErrInvalidIndex
 		}
 
-		if buckets == 0 {
-			continue
-		}
+		prev = v
+	}
 
-		idx.fanoutMapping[k] = len(idx.names)
+	idx.count = int(prev)
+	idx.crcs32 = idx.names + idx.count*ihash.KeySize
+	idx.sizes = idx.crcs32 + idx.count*4
+	idx.offsets32 = idx.sizes + idx.count*4
+	idx.offsets64 = idx.offsets32 + idx.count*4
 
-		nameLen := int(buckets * ihash.KeySize)
-		bin := make([]byte, nameLen)
-		n, err := io.ReadFull(r, bin)
-		if err != nil {
-			return nOut, err
-		}
+	// the remaining data contains the 64 bits offsets
+	rest := len(data) - footer - idx.offsets64
+	if rest < 0 || rest%8 != 0 {
+		return ErrInvalidIndex
+	}
 
-		nOut += n
+	idx.numOffsets64 = rest / 8
 
-		idx.names = append(idx.names, bin)
-		idx.crcs32 = append(idx.crcs32, make([]byte, buckets*4))
-		idx.offsets32 = append(idx.offsets32, make([]byte, buckets*4))
-		idx.sizes = append(idx.sizes, make([]byte, buckets*4))
+	if footer > 0 {
+		copy(idx.packChecksum[:], data[len(data)-footer:])
 	}
 
-	return nOut, nil
+	return nil
 }
 
-func (idx *IndexReader) readCRC(r io.Reader) (int, error) {
-	var nOut int
-	for k := 0; k < fanoutSize; k++ {
-		if pos := idx.fanoutMapping[k]; pos != noMapping {
-			n, err := io.ReadFull(r, idx.crcs32[pos])
-			if err != nil {
-				return nOut, err
-			}
+// Verify checks the index against the checksum on its footer. Indexes older
+// than version 1 have no footer, so nothing is checked.
+func (idx *IndexReader) Verify() error {
+	if idx.version < indexVersionChecksums {
+		return nil
+	}
 
-			nOut += n
-		}
+	end := len(idx.data) - ihash.KeySize
+	sum := sha256.Sum256(idx.data[:end])
+	if !bytes.Equal(sum[:], idx.data[end:]) {
+		return ErrInvalidChecksum
 	}
 
-	return nOut, nil
+	return nil
 }
 
-func (idx *IndexReader) readOffsets(r io.Reader) (int, error) {
-	var nOut int
-	var o64cnt int
-	for k := 0; k < fanoutSize; k++ {
-		if pos := idx.fanoutMapping[k]; pos != noMapping {
-			n, err := io.ReadFull(r, idx.offsets32[pos])
-			if err != nil {
-				return nOut, err
-			}
-
-			nOut += n
-
-			for p := 0; p < len(idx.offsets32[pos]); p += 4 {
-				if idx.offsets32[pos][p]&(byte(1)<<7) > 0 {
-					o64cnt++
-				}
-			}
-		}
+// Close releases the index data. The index cannot be used after that.
+func (idx *IndexReader) Close() error {
+	data := idx.data
+	idx.data = nil
+	if !idx.mmapped {
+		return nil
 	}
 
-	if o64cnt > 0 {
-		idx.offsets64 = make([]byte, o64cnt*8)
-		n, err := io.ReadFull(r, idx.offsets64)
-		if err != nil {
-			return nOut, err
-		}
+	return iio.Munmap(data)
+}
+
+// PackChecksum returns the checksum of the indexed packfile. It is empty on
+// indexes older than version 1.
+func (idx *IndexReader) PackChecksum() ihash.Hash {
+	return idx.packChecksum
+}
+
+// Sequence returns the sequence number of the indexed packfile. It is zero
+// on indexes older than version 2.
+func (idx *IndexReader) Sequence() uint64 {
+	return idx.sequence
+}
+
+func (idx *IndexReader) readSequence(r io.Reader) (int, error) {
+	if idx.version < indexVersionSequence {
+		return 0, nil
+	}
 
-		nOut += n
+	if err := binary.Read(r, binary.BigEndian, &idx.sequence); err != nil {
+		return 0, err
 	}
 
-	return nOut, nil
+	return 8, nil
 }
 
-func (idx *IndexReader) readSizes(r io.Reader) (int, error) {
-	var nOut int
-	for k := 0; k < fanoutSize; k++ {
-		if pos := idx.fanoutMapping[k]; pos != noMapping {
-			n, err := io.ReadFull(r, idx.sizes[pos])
-			if err != nil {
-				return nOut, err
-			}
+// ReadSequence reads the packfile sequence number from the header of an
+// index file, without reading the whole file.
+func ReadSequence(fsys iio.FS, p string) (uint64, error) {
+	f, err := iio.Open(fsys, p)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
 
-			nOut += n
+	idx := NewIndexReader()
+	for _, e := range []func(io.Reader) (int, error){
+		readSignature,
+		idx.readVersion,
+		idx.readSequence,
+	} {
+		if _, err := e(f); err != nil {
+			return 0, err
 		}
 	}
 
-	return nOut, nil
+	return idx.sequence, nil
+}
+
+func (idx *IndexReader) fanoutAt(k int) uint32 {
+	return binary.BigEndian.Uint32(idx.data[idx.fanout+k*4:])
 }
 
 func (idx *IndexReader) Count() (int64, error) {
-	return int64(idx.fanoutTable[len(idx.fanoutTable)-1]), nil
+	return int64(idx.count), nil
 }
 
 func (idx *IndexReader) GetOffset(h ihash.Hash) (int64, error) {
-	if len(idx.fanoutMapping) <= int(h[0]) {
-		return 0, ErrEntryNotFound
-	}
-
-	k := idx.fanoutMapping[h[0]]
 	i, ok := idx.findHashIndex(h)
 	if !ok {
 		return 0, ErrEntryNotFound
 	}
 
-	offset := idx.getOffset(k, i)
-
-	return int64(offset), nil
+	offset, err := idx.getOffset(i)
+	return int64(offset), err
 }
 
 const isO64Mask = uint64(1) << 31
 
-func (idx *IndexReader) getOffset(firstLevel, secondLevel int) uint64 {
-	offset := secondLevel << 2
-	ofs := binary.BigEndian.Uint32(idx.offsets32[firstLevel][offset : offset+4])
+// getOffset returns the offset of the i-th entry.
+func (idx *IndexReader) getOffset(i int) (uint64, error) {
+	ofs := uint64(binary.BigEndian.Uint32(idx.data[idx.offsets32+i*4:]))
+	if ofs&isO64Mask == 0 {
+		return ofs, nil
+	}
 
-	if (uint64(ofs) & isO64Mask) != 0 {
-		offset := 8 * (uint64(ofs) & ^isO64Mask)
-		n := binary.BigEndian.Uint64(idx.offsets64[offset : offset+8])
-		return n
+	pos := ofs & ^isO64Mask
+	if pos >= uint64(idx.numOffsets64) {
+		return 0, ErrInvalidIndex
 	}
 
-	return uint64(ofs)
+	return binary.BigEndian.Uint64(idx.data[idx.offsets64+int(pos)*8:]), nil
 }
 
+// findHashIndex returns the position of the key on the index, looking only
+// into the keys sharing its first byte.
 func (idx *IndexReader) findHashIndex(h ihash.Hash) (int, bool) {
-	k := idx.fanoutMapping[h[0]]
-	if k == noMapping {
+	if idx.count == 0 {
 		return 0, false
 	}
 
-	if len(idx.names) <= k {
-		return 0, false
+	var low int
+	if h[0] > 0 {
+		low = int(idx.fanoutAt(int(h[0]) - 1))
 	}
 
-	data := idx.names[k]
-	high := uint64(len(idx.offsets32[k])) >> 2
-	if high == 0 {
-		return 0, false
+	high := int(idx.fanoutAt(int(h[0])))
+
+	i := low + sort.Search(high-low, func(i int) bool {
+		return bytes.Compare(idx.name(low+i), h[:]) >= 0
+	})
+
+	if i < high && bytes.Equal(idx.name(i), h[:]) {
+		return i, true
 	}
 
-	low := uint64(0)
-	for {
-		mid := (low + high) >> 1
-		offset := mid * ihash.KeySize
+	return 0, false
+}
 
-		cmp := bytes.Compare(h[:], data[offset:offset+ihash.KeySize])
-		if cmp < 0 {
-			high = mid
-		} else if cmp == 0 {
-			return int(mid), true
-		} else {
-			low = mid + 1
-		}
+func (idx *IndexReader) name(i int) []byte {
+	pos := idx.names + i*ihash.KeySize
+	return idx.data[pos : pos+ihash.KeySize]
+}
 
-		if low >= high {
-			break
-		}
+// find returns the offset and size of the given key.
+func (idx *IndexReader) find(h ihash.Hash) (int64, uint32, bool, error) {
+	i, ok := idx.findHashIndex(h)
+	if !ok {
+		return 0, 0, false, nil
 	}
 
-	return 0, false
+	offset, err := idx.getOffset(i)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	return int64(offset), idx.size(i), true, nil
+}
+
+func (idx *IndexReader) size(i int) uint32 {
+	return binary.BigEndian.Uint32(idx.data[idx.sizes+i*4:])
+}
+
+func (idx *IndexReader) crc32(i int) uint32 {
+	return binary.BigEndian.Uint32(idx.data[idx.crcs32+i*4:])
 }
 
 func (idx *IndexReader) Contains(h ihash.Hash) (bool, error) {
@@ -264,38 +316,119 @@ func (idx *IndexReader) Contains(h ihash.Hash) (bool, error) {
 }
 
 func (idx *IndexReader) GetCRC32(h ihash.Hash) (uint32, error) {
-	firstLevel := idx.fanoutMapping[h[0]]
-	secondLevel, ok := idx.findHashIndex(h)
+	i, ok := idx.findHashIndex(h)
 	if !ok {
 		return 0, ErrEntryNotFound
 	}
 
-	offset := secondLevel << 2
-	return binary.BigEndian.Uint32(idx.crcs32[firstLevel][offset : offset+4]), nil
+	return idx.crc32(i), nil
 }
 
 func (idx *IndexReader) GetSize(h ihash.Hash) (uint32, error) {
-	firstLevel := idx.fanoutMapping[h[0]]
-	secondLevel, ok := idx.findHashIndex(h)
+	i, ok := idx.findHashIndex(h)
 	if !ok {
 		return 0, ErrEntryNotFound
 	}
 
-	offset := secondLevel << 2
-	return binary.BigEndian.Uint32(idx.sizes[firstLevel][offset : offset+4]), nil
+	return idx.size(i), nil
 }
 
-// TODO entriesbyoffset
-// TODO entriesbyhash
+// ForEach calls fn with all the index entries, in hash order.
+func (idx *IndexReader) ForEach(fn func(e *Entry) error) error {
+	for i := 0; i < idx.count; i++ {
+		e, err := idx.entry(i)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entry returns the i-th entry of the index.
+func (idx *IndexReader) entry(i int) (*Entry, error) {
+	offset, err := idx.getOffset(i)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Entry{
+		CRC32:  idx.crc32(i),
+		Offset: offset,
+		Size:   idx.size(i),
+	}
+
+	copy(e.Key[:], idx.name(i))
+
+	return e, nil
+}
+
+// EntriesByHash returns an iterator over the index entries, in hash order.
+func (idx *IndexReader) EntriesByHash() EntryIter {
+	return &entryIter{idx: idx}
+}
+
+// EntriesByOffset returns an iterator over the index entries, in the order
+// they are on the packfile, using the given reverse index.
+func (idx *IndexReader) EntriesByOffset(rev *ReverseIndex) (EntryIter, error) {
+	if rev.Count() != idx.count || rev.PackChecksum() != idx.PackChecksum() {
+		return nil, fmt.Errorf("%w: reverse index does not match the index", ErrInvalidIndex)
+	}
+
+	return &entryIter{idx: idx, rev: rev}, nil
+}
 
 // EntryIter is an iterator that will return the entries in a packfile index.
 type EntryIter interface {
-	// Next returns the next entry in the packfile index.
+	// Next returns the next entry in the packfile index, or io.EOF if there
+	// are no more entries.
 	Next() (*Entry, error)
 	// Close closes the iterator.
 	Close() error
 }
 
+type entryIter struct {
+	idx *IndexReader
+	// rev is nil when iterating in hash order
+	rev *ReverseIndex
+	pos int
+	// close releases the indexes, if owned by the iterator
+	close func() error
+}
+
+func (i *entryIter) Next() (*Entry, error) {
+	if i.pos >= i.idx.count {
+		return nil, io.EOF
+	}
+
+	p := i.pos
+	if i.rev != nil {
+		p = i.rev.position(p)
+		if p >= i.idx.count {
+			return nil, ErrInvalidIndex
+		}
+	}
+
+	i.pos++
+
+	return i.idx.entry(p)
+}
+
+func (i *entryIter) Close() error {
+	if i.close == nil {
+		return nil
+	}
+
+	err := i.close()
+	i.close = nil
+
+	return err
+}
+
 func readSignature(r io.Reader) (int, error) {
 	sig := make([]byte, len(indexSig))
 	n, err := io.ReadFull(r, sig)
@@ -311,16 +444,18 @@ func readSignature(r io.Reader) (int, error) {
 	return n, nil
 }
 
-func readVersion(r io.Reader) (int, error) {
+func (idx *IndexReader) readVersion(r io.Reader) (int, error) {
 	var version uint32
 
 	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
 		return 0, err
 	}
 
-	if version != indexVersion {
+	if version > indexVersion {
 		return 4, errors.New("not a valid idx version")
 	}
 
+	idx.version = version
+
 	return 4, nil
 }
@@ -0,0 +1,213 @@
+package idx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
+)
+
+// Reverse index format:
+//
+// Signature [3]byte: SPR
+// Version uint32: 0
+// Index positions in packfile order [4]byte*NumElements
+// Pack checksum [ihash.HashSize]byte: checksum of the corresponding packfile
+// Checksum [ihash.HashSize]byte: sha256 of all the above
+
+var revSig []byte = []byte{'S', 'P', 'R'}
+var revVersion uint32 = 0
+
+const revHeaderSize = 3 + 4
+
+// ReverseIndex maps the packfile order of the blocks to their position on
+// the packfile index, so entries can be read in packfile order.
+type ReverseIndex struct {
+	data []byte
+	// mmapped is true if data must be released using iio.Munmap.
+	mmapped bool
+
+	count        int
+	packChecksum ihash.Hash
+}
+
+// NewReverseIndex builds the reverse index of a packfile index in memory.
+func NewReverseIndex(ir *IndexReader) (*ReverseIndex, error) {
+	offsets := make([]uint64, ir.count)
+	for i := range offsets {
+		o, err := ir.getOffset(i)
+		if err != nil {
+			return nil, err
+		}
+
+		offsets[i] = o
+	}
+
+	data, err := reverseIndexData(offsets, ir.PackChecksum())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReverseIndex{}
+	return r, r.load(data)
+}
+
+// reverseIndexData returns the reverse index file contents for the given
+// entry offsets, in index order.
+func reverseIndexData(offsets []uint64, packChecksum ihash.Hash) ([]byte, error) {
+	positions := make([]uint32, len(offsets))
+	for i := range positions {
+		positions[i] = uint32(i)
+	}
+
+	sort.Slice(positions, func(i, j int) bool {
+		return offsets[positions[i]] < offsets[positions[j]]
+	})
+
+	buf := bytes.NewBuffer(make([]byte, 0, revHeaderSize+len(positions)*4+2*ihash.KeySize))
+	buf.Write(revSig)
+	if err := binary.Write(buf, binary.BigEndian, revVersion); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, positions); err != nil {
+		return nil, err
+	}
+
+	buf.Write(packChecksum[:])
+
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+
+	return buf.Bytes(), nil
+}
+
+// NewReverseIndexFromFile opens a reverse index mapping it in memory. Use
+// Verify to check its checksum.
+func NewReverseIndexFromFile(fsys iio.FS, p string) (*ReverseIndex, error) {
+	f, err := iio.Open(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+
+	data, mmapped, err := iio.Mmap(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	release := func() {
+		if mmapped {
+			iio.Munmap(data)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		release()
+		return nil, err
+	}
+
+	r := &ReverseIndex{}
+	if err := r.load(data); err != nil {
+		release()
+		return nil, err
+	}
+
+	r.mmapped = mmapped
+
+	return r, nil
+}
+
+// load sets the reverse index data, checking the header.
+func (r *ReverseIndex) load(data []byte) error {
+	footer := 2 * ihash.KeySize
+	if len(data) < revHeaderSize+footer {
+		return io.ErrUnexpectedEOF
+	}
+
+	if !bytes.Equal(data[:len(revSig)], revSig) {
+		return errors.New("not a valid reverse index file")
+	}
+
+	if binary.BigEndian.Uint32(data[len(revSig):]) > revVersion {
+		return errors.New("not a valid reverse index version")
+	}
+
+	size := len(data) - revHeaderSize - footer
+	if size%4 != 0 {
+		return ErrInvalidIndex
+	}
+
+	r.data = data
+	r.count = size / 4
+	copy(r.packChecksum[:], data[len(data)-footer:])
+
+	return nil
+}
+
+// Verify checks the reverse index against its checksum.
+func (r *ReverseIndex) Verify() error {
+	end := len(r.data) - ihash.KeySize
+	sum := sha256.Sum256(r.data[:end])
+	if !bytes.Equal(sum[:], r.data[end:]) {
+		return ErrInvalidChecksum
+	}
+
+	return nil
+}
+
+// Count returns the number of entries.
+func (r *ReverseIndex) Count() int {
+	return r.count
+}
+
+// PackChecksum returns the checksum of the indexed packfile.
+func (r *ReverseIndex) PackChecksum() ihash.Hash {
+	return r.packChecksum
+}
+
+// position returns the index position of the i-th block on the packfile.
+func (r *ReverseIndex) position(i int) int {
+	return int(binary.BigEndian.Uint32(r.data[revHeaderSize+i*4:]))
+}
+
+// WriteTo writes the reverse index file.
+func (r *ReverseIndex) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.data)
+	return int64(n), err
+}
+
+// Close releases the reverse index data.
+func (r *ReverseIndex) Close() error {
+	data := r.data
+	r.data = nil
+	if !r.mmapped {
+		return nil
+	}
+
+	return iio.Munmap(data)
+}
+
+// WriteReverseIndex writes the reverse index file into the specified path.
+func WriteReverseIndex(fsys iio.FS, r *ReverseIndex, p string) error {
+	return iio.WriteFile(fsys, p, r.data, 0755)
+}
+
+// ReverseIndexPath returns the path of the reverse index for the specified
+// packfile.
+func ReverseIndexPath(name, packPath string) string {
+	return path.Join(packPath, fmt.Sprintf("%s.rev", name))
+}
+
+// ReverseIndexProcessingPath returns the path of the reverse index for the
+// specified packfile while it is being written.
+func ReverseIndexProcessingPath(name, packPath string) string {
+	return path.Join(packPath, fmt.Sprintf("%s.rev.writting", name))
+}
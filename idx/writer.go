@@ -2,6 +2,7 @@ package idx
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
 	"math"
@@ -28,6 +29,9 @@ type IndexWriter struct {
 
 	version       uint32
 	offset64Write uint32
+
+	packChecksum ihash.Hash
+	sequence     uint64
 }
 
 func NewIndexWriter() *IndexWriter {
@@ -58,6 +62,29 @@ func (idx *IndexWriter) AddRaw(h ihash.Hash, crc32 uint32, pos uint64, size uint
 	}
 }
 
+// SetPackChecksum sets the checksum of the indexed packfile, written on the
+// index footer.
+func (idx *IndexWriter) SetPackChecksum(h ihash.Hash) {
+	idx.packChecksum = h
+}
+
+// SetSequence sets the sequence number of the indexed packfile. Packfiles
+// with a higher sequence number were committed later.
+func (idx *IndexWriter) SetSequence(seq uint64) {
+	idx.sequence = seq
+}
+
+// Sequence returns the sequence number of the indexed packfile.
+func (idx *IndexWriter) Sequence() uint64 {
+	return idx.sequence
+}
+
+// Contains returns true if the key was already added.
+func (idx *IndexWriter) Contains(h ihash.Hash) bool {
+	_, ok := idx.added[h]
+	return ok
+}
+
 func (idx *IndexWriter) Count() int64 {
 	return int64(len(idx.entries))
 }
@@ -70,24 +97,31 @@ func (idx *IndexWriter) WriteTo(writer io.Writer) (int64, error) {
 	flow := []func(io.Writer) (int, error){
 		idx.writeSignature,
 		idx.writeVersion,
+		idx.writeSequence,
 		idx.writeFanout,
 		idx.writeNames,
 		idx.writeCRC,
 		idx.writeSizes,
 		idx.writeOffsets,
-		// TODO footer with checksum
+		idx.writePackChecksum,
 	}
 
+	sum := sha256.New()
+	w := io.MultiWriter(writer, sum)
+
 	var nOut int64
 	for _, e := range flow {
-		n, err := e(writer)
+		n, err := e(w)
 		nOut += int64(n)
 		if err != nil {
 			return nOut, err
 		}
 	}
 
-	return nOut, nil
+	n, err := writer.Write(sum.Sum(nil))
+	nOut += int64(n)
+
+	return nOut, err
 }
 
 func (idx *IndexWriter) prepareData() error {
@@ -156,7 +190,6 @@ func (idx *IndexWriter) prepareData() error {
 	}
 
 	idx.version = indexVersion
-	// TODO write checksum
 
 	return nil
 }
@@ -187,6 +220,18 @@ func (idx *IndexWriter) writeVersion(w io.Writer) (int, error) {
 	return 4, nil
 }
 
+func (idx *IndexWriter) writePackChecksum(w io.Writer) (int, error) {
+	return w.Write(idx.packChecksum[:])
+}
+
+func (idx *IndexWriter) writeSequence(w io.Writer) (int, error) {
+	if err := binary.Write(w, binary.BigEndian, idx.sequence); err != nil {
+		return 0, err
+	}
+
+	return 8, nil
+}
+
 func (idx *IndexWriter) writeFanout(w io.Writer) (int, error) {
 	for _, c := range idx.fanoutTable {
 		if err := binary.Write(w, binary.BigEndian, &c); err != nil {
@@ -281,14 +326,44 @@ func (idx *IndexWriter) writeSizes(w io.Writer) (int, error) {
 	return size, nil
 }
 
-func WriteIndex(i *IndexWriter, path string) error {
-	f, err := iio.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
+// Filter returns a filter containing all the added keys.
+func (idx *IndexWriter) Filter() *Filter {
+	f := NewFilter(len(idx.entries))
+	for _, e := range idx.entries {
+		f.Add(e.Key)
+	}
+
+	return f
+}
+
+// ReverseIndex returns the reverse index of the added entries. The packfile
+// checksum must be set before.
+func (idx *IndexWriter) ReverseIndex() (*ReverseIndex, error) {
+	SortEntriesByHash(idx.entries)
+
+	offsets := make([]uint64, len(idx.entries))
+	for i, e := range idx.entries {
+		offsets[i] = e.Offset
+	}
+
+	data, err := reverseIndexData(offsets, idx.packChecksum)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReverseIndex{}
+	return r, r.load(data)
+}
+
+func WriteIndex(fsys iio.FS, i *IndexWriter, path string) error {
+	f, err := iio.OpenFile(fsys, path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
 	if err != nil {
 		return err
 	}
 
 	_, err = i.WriteTo(f)
 	if err != nil {
+		f.Close()
 		return err
 	}
 
@@ -0,0 +1,78 @@
+package iio
+
+import (
+	"fmt"
+)
+
+// Durability sets which data is synced to disk when writing files. Higher
+// levels survive power losses, not only process crashes.
+type Durability int
+
+const (
+	// DurabilityNone relies on the operating system to write files to disk.
+	DurabilityNone Durability = iota
+	// DurabilityData syncs file contents before renaming them into their
+	// final place.
+	DurabilityData
+	// DurabilityFull also syncs directories after renaming or removing
+	// files, so the directory entries survive a power loss too.
+	DurabilityFull
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityData:
+		return "data"
+	case DurabilityFull:
+		return "full"
+	default:
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+}
+
+// ParseDurability returns the durability level with the given name.
+func ParseDurability(s string) (Durability, error) {
+	for _, d := range []Durability{DurabilityNone, DurabilityData, DurabilityFull} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown durability level: %q", s)
+}
+
+// SyncFile syncs the contents of an already written file, if the durability
+// level requires it.
+func (d Durability) SyncFile(fsys FS, p string) error {
+	if d < DurabilityData {
+		return nil
+	}
+
+	return syncPath(fsys, p)
+}
+
+// SyncDir syncs a directory after renaming or removing files on it, if the
+// durability level requires it.
+func (d Durability) SyncDir(fsys FS, p string) error {
+	if d < DurabilityFull {
+		return nil
+	}
+
+	return syncPath(fsys, p)
+}
+
+func syncPath(fsys FS, p string) error {
+	f, err := Open(fsys, p)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
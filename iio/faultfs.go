@@ -0,0 +1,173 @@
+package iio
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+)
+
+var _ FS = &FaultFS{}
+
+// Op is an operation done on a FaultFS.
+type Op string
+
+const (
+	OpOpen     Op = "open"
+	OpWrite    Op = "write"
+	OpSync     Op = "sync"
+	OpTruncate Op = "truncate"
+	OpRename   Op = "rename"
+	OpRemove   Op = "remove"
+)
+
+// FaultFunc is called before every operation on a FaultFS, with the
+// affected path. Renames are called with the destination path. If it returns
+// an error, the operation fails with it without being done.
+type FaultFunc func(op Op, name string) error
+
+// TornWrite is the error to return from a FaultFunc to write only the first
+// N bytes before failing, as if the process stopped in the middle of the
+// write.
+type TornWrite struct {
+	N int
+}
+
+func (e *TornWrite) Error() string {
+	return fmt.Sprintf("torn write after %d bytes", e.N)
+}
+
+// FaultFS wraps a filesystem injecting faults on the chosen operations. It is
+// used on tests to check what happens when writes fail or are interrupted.
+type FaultFS struct {
+	fs FS
+
+	mu    sync.RWMutex
+	fault FaultFunc
+}
+
+// NewFaultFS wraps the given filesystem. No faults are injected until
+// calling SetFault.
+func NewFaultFS(fsys FS) *FaultFS {
+	return &FaultFS{fs: fsys}
+}
+
+// SetFault sets the function deciding which operations fail. A nil function
+// disables the faults.
+func (f *FaultFS) SetFault(fn FaultFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fault = fn
+}
+
+func (f *FaultFS) check(op Op, name string) error {
+	f.mu.RLock()
+	fn := f.fault
+	f.mu.RUnlock()
+
+	if fn == nil {
+		return nil
+	}
+
+	return fn(op, name)
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if err := f.check(OpOpen, name); err != nil {
+		return nil, err
+	}
+
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if err := f.check(OpRename, newpath); err != nil {
+		return err
+	}
+
+	return f.fs.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.check(OpRemove, name); err != nil {
+		return err
+	}
+
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) Stat(name string) (fs.FileInfo, error) {
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.fs.ReadDir(name)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm fs.FileMode) error {
+	return f.fs.MkdirAll(path, perm)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.check(OpWrite, f.name); err != nil {
+		return f.torn(err, p, f.File.Write)
+	}
+
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.check(OpWrite, f.name); err != nil {
+		return f.torn(err, p, func(b []byte) (int, error) {
+			return f.File.WriteAt(b, off)
+		})
+	}
+
+	return f.File.WriteAt(p, off)
+}
+
+// torn writes the first bytes of p if err is a TornWrite, and returns err.
+func (f *faultFile) torn(err error, p []byte, write func([]byte) (int, error)) (int, error) {
+	tw, ok := err.(*TornWrite)
+	if !ok || tw.N <= 0 {
+		return 0, err
+	}
+
+	if tw.N < len(p) {
+		p = p[:tw.N]
+	}
+
+	n, werr := write(p)
+	if werr != nil {
+		return n, werr
+	}
+
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.check(OpSync, f.name); err != nil {
+		return err
+	}
+
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.check(OpTruncate, f.name); err != nil {
+		return err
+	}
+
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,128 @@
+package iio
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultFS(t *testing.T) {
+	require := require.New(t)
+
+	errFault := errors.New("fault")
+	m := NewMemFS()
+	f := NewFaultFS(m)
+	require.NoError(f.MkdirAll("/data", 0755))
+
+	var ops []Op
+	f.SetFault(func(op Op, name string) error {
+		ops = append(ops, op)
+		if name == "/data/fail" {
+			return errFault
+		}
+
+		return nil
+	})
+
+	_, err := f.OpenFile("/data/fail", os.O_CREATE|os.O_WRONLY, 0644)
+	require.ErrorIs(err, errFault)
+	_, err = m.Stat("/data/fail")
+	require.Error(err)
+
+	file, err := f.OpenFile("/data/file", os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(err)
+	_, err = file.Write([]byte("data"))
+	require.NoError(err)
+	require.NoError(file.Sync())
+	require.NoError(file.Truncate(2))
+	require.NoError(file.Close())
+
+	// failed renames and removals are not done
+	require.ErrorIs(f.Rename("/data/file", "/data/fail"), errFault)
+	require.Equal("da", readMemFile(t, m, "/data/file"))
+
+	require.Equal([]Op{OpOpen, OpOpen, OpWrite, OpSync, OpTruncate, OpRename}, ops)
+
+	f.SetFault(func(op Op, name string) error {
+		if op == OpRemove || op == OpSync {
+			return errFault
+		}
+
+		return nil
+	})
+
+	require.ErrorIs(f.Remove("/data/file"), errFault)
+	require.Equal("da", readMemFile(t, m, "/data/file"))
+
+	file, err = f.OpenFile("/data/file", os.O_RDWR, 0644)
+	require.NoError(err)
+	require.ErrorIs(file.Sync(), errFault)
+	require.NoError(file.Close())
+
+	// disabled faults
+	f.SetFault(nil)
+	require.NoError(f.Rename("/data/file", "/data/fail"))
+	require.NoError(f.Remove("/data/fail"))
+
+	entries, err := f.ReadDir("/data")
+	require.NoError(err)
+	require.Len(entries, 0)
+}
+
+func TestFaultFSTornWrite(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMemFS()
+	f := NewFaultFS(m)
+
+	file, err := f.OpenFile("/file", os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(err)
+
+	_, err = file.Write([]byte("complete"))
+	require.NoError(err)
+
+	f.SetFault(func(op Op, name string) error {
+		if op == OpWrite {
+			return &TornWrite{N: 3}
+		}
+
+		return nil
+	})
+
+	n, err := file.Write([]byte("-torn"))
+	var tw *TornWrite
+	require.ErrorAs(err, &tw)
+	require.Equal(3, n)
+	require.Equal("complete-to", readMemFile(t, m, "/file"))
+
+	n, err = file.WriteAt([]byte("AB"), 0)
+	require.ErrorAs(err, &tw)
+	require.Equal(2, n)
+	require.Equal("ABmplete-to", readMemFile(t, m, "/file"))
+
+	// other operations just fail with it
+	f.SetFault(func(op Op, name string) error {
+		return &TornWrite{}
+	})
+
+	_, err = f.OpenFile("/other", os.O_CREATE|os.O_RDWR, 0644)
+	require.ErrorAs(err, &tw)
+
+	// nothing is written when N is zero
+	f.SetFault(func(op Op, name string) error {
+		if op == OpWrite {
+			return &TornWrite{}
+		}
+
+		return nil
+	})
+
+	n, err = file.Write([]byte("more"))
+	require.ErrorAs(err, &tw)
+	require.Equal(0, n)
+	require.Equal("ABmplete-to", readMemFile(t, m, "/file"))
+
+	require.NoError(file.Close())
+}
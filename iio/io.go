@@ -1,33 +1,132 @@
 package iio
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path"
 )
 
 // OpenFile opens a new file and creates all the directories if needed
-func OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
-	if err := os.MkdirAll(path.Dir(name), perm); err != nil {
+func OpenFile(fsys FS, name string, flag int, perm os.FileMode) (File, error) {
+	if err := fsys.MkdirAll(path.Dir(name), perm); err != nil {
 		return nil, err
 	}
 
-	return os.OpenFile(name, flag, perm)
+	return fsys.OpenFile(name, flag, perm)
+}
+
+// Open opens a file for reading.
+func Open(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
 }
 
 // WriteFile writes a new file and creates all the directories if needed
-func WriteFile(name string, data []byte, perm os.FileMode) error {
-	if err := os.MkdirAll(path.Dir(name), perm); err != nil {
+func WriteFile(fsys FS, name string, data []byte, perm os.FileMode) error {
+	f, err := OpenFile(fsys, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
 		return err
 	}
 
-	return os.WriteFile(name, data, perm)
+	return f.Close()
+}
+
+// ReadFile reads the whole file.
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return io.ReadAll(f)
 }
 
 // Rename moves the file and creates all the directories if needed
-func Rename(from, to string) error {
-	if err := os.MkdirAll(path.Dir(to), 0755); err != nil {
+func Rename(fsys FS, from, to string) error {
+	if err := fsys.MkdirAll(path.Dir(to), 0755); err != nil {
 		return err
 	}
 
-	return os.Rename(from, to)
+	return fsys.Rename(from, to)
+}
+
+// RemoveIfExists removes the file, returning no error if it does not exist.
+func RemoveIfExists(fsys FS, name string) error {
+	err := fsys.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// WalkDir walks the file tree rooted at root like filepath.WalkDir, reading
+// directories from the given FS.
+func WalkDir(fsys FS, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+
+	if err == fs.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+func walkDir(fsys FS, p string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(p, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			return nil
+		}
+
+		return err
+	}
+
+	entries, err := fsys.ReadDir(p)
+	if err != nil {
+		if err := fn(p, d, err); err != fs.SkipDir {
+			return err
+		}
+
+		return nil
+	}
+
+	for _, e := range entries {
+		if err := walkDir(fsys, path.Join(p, e.Name()), e, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readAll reads the whole file in memory.
+func readAll(f File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, fi.Size())
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b, nil
 }
@@ -0,0 +1,451 @@
+package iio
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ FS = &MemFS{}
+
+// MemFS is a filesystem keeping all the files in memory, used on tests.
+// Opened files keep working after being renamed or removed, as on Unix.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]time.Time
+}
+
+// NewMemFS returns an empty in-memory filesystem, containing only the root
+// directory.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]time.Time{string(filepath.Separator): time.Now()},
+	}
+}
+
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func memPathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[name]; ok {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, memPathError("open", name, errors.New("is a directory"))
+		}
+
+		return &memFile{fs: m, name: name, dir: true}, nil
+	}
+
+	d, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memPathError("open", name, fs.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memPathError("open", name, fs.ErrNotExist)
+	case !ok:
+		if _, ok := m.dirs[filepath.Dir(name)]; !ok {
+			return nil, memPathError("open", name, fs.ErrNotExist)
+		}
+
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	f := &memFile{fs: m, name: name, d: d, flag: flag}
+	if flag&os.O_TRUNC != 0 && f.writable() {
+		d.mu.Lock()
+		d.data = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+
+	return f, nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+
+	if _, ok := m.dirs[filepath.Dir(newpath)]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+
+	if _, ok := m.dirs[newpath]; ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+
+	delete(m.files, oldpath)
+	m.files[newpath] = d
+
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+
+	if _, ok := m.dirs[name]; !ok {
+		return memPathError("remove", name, fs.ErrNotExist)
+	}
+
+	if len(m.children(name)) > 0 {
+		return memPathError("remove", name, errors.New("directory not empty"))
+	}
+
+	delete(m.dirs, name)
+
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fi, ok := m.stat(name)
+	if !ok {
+		return nil, memPathError("stat", name, fs.ErrNotExist)
+	}
+
+	return fi, nil
+}
+
+// stat returns the file information. It must be called holding the lock.
+func (m *MemFS) stat(name string) (fs.FileInfo, bool) {
+	if t, ok := m.dirs[name]; ok {
+		return &memInfo{name: filepath.Base(name), modTime: t, dir: true}, true
+	}
+
+	d, ok := m.files[name]
+	if !ok {
+		return nil, false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return &memInfo{name: filepath.Base(name), size: int64(len(d.data)), modTime: d.modTime}, true
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[name]; !ok {
+		return nil, memPathError("readdir", name, fs.ErrNotExist)
+	}
+
+	children := m.children(name)
+	sort.Strings(children)
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, c := range children {
+		fi, _ := m.stat(c)
+		entries = append(entries, fs.FileInfoToDirEntry(fi))
+	}
+
+	return entries, nil
+}
+
+// children returns the paths of the files and directories directly inside
+// the given directory. It must be called holding the lock.
+func (m *MemFS) children(dir string) []string {
+	var out []string
+	for p := range m.files {
+		if filepath.Dir(p) == dir {
+			out = append(out, p)
+		}
+	}
+
+	for p := range m.dirs {
+		if p != dir && filepath.Dir(p) == dir {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+func (m *MemFS) MkdirAll(path string, perm fs.FileMode) error {
+	path = filepath.Clean(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p := path; ; p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return memPathError("mkdir", p, errors.New("not a directory"))
+		}
+
+		if _, ok := m.dirs[p]; ok {
+			break
+		}
+
+		m.dirs[p] = time.Now()
+	}
+
+	return nil
+}
+
+type memFile struct {
+	fs   *MemFS
+	name string
+	d    *memData
+	flag int
+	dir  bool
+
+	mu     sync.Mutex // protects pos and closed
+	pos    int64
+	closed bool
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return memPathError(op, f.name, fs.ErrClosed)
+	case f.dir && op != "sync" && op != "stat":
+		return memPathError(op, f.name, errors.New("is a directory"))
+	case write && !f.writable():
+		return memPathError(op, f.name, fs.ErrPermission)
+	}
+
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("read", false)
+	f.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+
+	return copy(p, f.d.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		f.d.mu.RLock()
+		f.pos = int64(len(f.d.data))
+		f.d.mu.RUnlock()
+	}
+
+	n := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("write", true)
+	f.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return f.writeAt(p, off), nil
+}
+
+func (f *memFile) writeAt(p []byte, off int64) int {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.data = append(f.d.data, make([]byte, end-int64(len(f.d.data)))...)
+	}
+
+	f.d.modTime = time.Now()
+
+	return copy(f.d.data[off:], p)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("seek", false); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.d.mu.RLock()
+		offset += int64(len(f.d.data))
+		f.d.mu.RUnlock()
+	default:
+		return 0, memPathError("seek", f.name, errors.New("invalid whence"))
+	}
+
+	if offset < 0 {
+		return 0, memPathError("seek", f.name, errors.New("negative position"))
+	}
+
+	f.pos = offset
+
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return memPathError("close", f.name, fs.ErrClosed)
+	}
+
+	f.closed = true
+
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	err := f.check("stat", false)
+	f.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f.dir {
+		return f.fs.Stat(f.name)
+	}
+
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	return &memInfo{name: filepath.Base(f.name), size: int64(len(f.d.data)), modTime: f.d.modTime}, nil
+}
+
+// Sync does nothing, as data is never lost while the MemFS is in use.
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.check("sync", false)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if size < int64(len(f.d.data)) {
+		f.d.data = f.d.data[:size]
+	} else {
+		f.d.data = append(f.d.data, make([]byte, size-int64(len(f.d.data)))...)
+	}
+
+	f.d.modTime = time.Now()
+
+	return nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() any           { return nil }
+
+func (i *memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+
+	return 0644
+}
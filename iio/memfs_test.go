@@ -0,0 +1,156 @@
+package iio
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeMemFile(t *testing.T, m *MemFS, name, data string) {
+	t.Helper()
+	require := require.New(t)
+
+	f, err := m.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	require.NoError(err)
+	_, err = f.Write([]byte(data))
+	require.NoError(err)
+	require.NoError(f.Close())
+}
+
+func readMemFile(t *testing.T, m *MemFS, name string) string {
+	t.Helper()
+	require := require.New(t)
+
+	f, err := m.OpenFile(name, os.O_RDONLY, 0)
+	require.NoError(err)
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	require.NoError(err)
+
+	return string(data)
+}
+
+func TestMemFSRename(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMemFS()
+	require.NoError(m.MkdirAll("/a/b", 0755))
+	writeMemFile(t, m, "/a/old", "old")
+	writeMemFile(t, m, "/a/b/new", "replaced")
+
+	// opened files keep reading the renamed data
+	f, err := m.OpenFile("/a/old", os.O_RDONLY, 0)
+	require.NoError(err)
+
+	require.NoError(m.Rename("/a/old", "/a/b/new"))
+	require.Equal("old", readMemFile(t, m, "/a/b/new"))
+
+	_, err = m.Stat("/a/old")
+	require.ErrorIs(err, fs.ErrNotExist)
+
+	data, err := io.ReadAll(f)
+	require.NoError(err)
+	require.Equal("old", string(data))
+	require.NoError(f.Close())
+
+	err = m.Rename("/a/old", "/a/other")
+	require.ErrorIs(err, fs.ErrNotExist)
+
+	err = m.Rename("/a/b/new", "/missing/new")
+	require.ErrorIs(err, fs.ErrNotExist)
+
+	err = m.Rename("/a/b/new", "/a/b")
+	require.ErrorIs(err, fs.ErrExist)
+	require.Equal("old", readMemFile(t, m, "/a/b/new"))
+}
+
+func TestMemFSSync(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMemFS()
+	require.NoError(m.MkdirAll("/data", 0755))
+
+	f, err := m.OpenFile("/data/file", os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(err)
+
+	_, err = f.Write([]byte("synced"))
+	require.NoError(err)
+	require.NoError(f.Sync())
+
+	// a process stopping without syncing or closing the file does not lose
+	// the written data, as the MemFS outlives it
+	_, err = f.Write([]byte(" and not synced"))
+	require.NoError(err)
+	require.Equal("synced and not synced", readMemFile(t, m, "/data/file"))
+
+	fi, err := m.Stat("/data/file")
+	require.NoError(err)
+	require.Equal(int64(21), fi.Size())
+
+	// directories can be opened to sync them
+	d, err := m.OpenFile("/data", os.O_RDONLY, 0)
+	require.NoError(err)
+	require.NoError(d.Sync())
+	_, err = d.Write([]byte("x"))
+	require.Error(err)
+	require.NoError(d.Close())
+
+	_, err = m.OpenFile("/data", os.O_RDWR, 0)
+	require.Error(err)
+
+	require.NoError(f.Close())
+	require.ErrorIs(f.Sync(), fs.ErrClosed)
+	require.ErrorIs(f.Close(), fs.ErrClosed)
+
+	// removed files are lost, even if they were synced
+	require.NoError(m.Remove("/data/file"))
+	_, err = m.OpenFile("/data/file", os.O_RDONLY, 0)
+	require.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestMemFSReadDir(t *testing.T) {
+	require := require.New(t)
+
+	m := NewMemFS()
+	require.NoError(m.MkdirAll("/dir/sub/deep", 0755))
+	writeMemFile(t, m, "/dir/c", "ccc")
+	writeMemFile(t, m, "/dir/a", "a")
+	writeMemFile(t, m, "/dir/sub/b", "b")
+
+	entries, err := m.ReadDir("/dir")
+	require.NoError(err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	// sorted by name, only the direct children
+	require.Equal([]string{"a", "c", "sub"}, names)
+	require.False(entries[0].IsDir())
+	require.True(entries[2].IsDir())
+
+	fi, err := entries[1].Info()
+	require.NoError(err)
+	require.Equal(int64(3), fi.Size())
+
+	entries, err = m.ReadDir("/dir/sub/deep")
+	require.NoError(err)
+	require.Len(entries, 0)
+
+	_, err = m.ReadDir("/missing")
+	require.ErrorIs(err, fs.ErrNotExist)
+
+	require.Error(m.Remove("/dir/sub"))
+	require.NoError(m.Remove("/dir/sub/deep"))
+	require.NoError(m.Remove("/dir/sub/b"))
+	require.NoError(m.Remove("/dir/sub"))
+
+	entries, err = m.ReadDir("/dir")
+	require.NoError(err)
+	require.Len(entries, 2)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package iio
+
+// Mmap reads the whole file in memory on systems without mmap support. The
+// returned slice never needs to be released.
+func Mmap(f File) ([]byte, bool, error) {
+	b, err := readAll(f)
+	return b, false, err
+}
+
+// Munmap releases a slice returned by Mmap.
+func Munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package iio
+
+import (
+	"os"
+	"syscall"
+)
+
+// Mmap maps the whole file in memory as read only. Files not coming from the
+// OS filesystem are read in memory instead. It returns true if the slice
+// must be released using Munmap.
+func Mmap(f File) ([]byte, bool, error) {
+	of, ok := f.(*os.File)
+	if !ok {
+		b, err := readAll(f)
+		return b, false, err
+	}
+
+	fi, err := of.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if fi.Size() == 0 {
+		return nil, false, nil
+	}
+
+	b, err := syscall.Mmap(int(of.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// Munmap releases a slice returned by Mmap.
+func Munmap(b []byte) error {
+	if b == nil {
+		return nil
+	}
+
+	return syscall.Munmap(b)
+}
@@ -0,0 +1,452 @@
+package packfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/idx"
+	"go.uber.org/multierr"
+)
+
+// ProblemKind describes a problem found when checking packfiles.
+type ProblemKind string
+
+const (
+	ProblemPackHeader   ProblemKind = "invalid packfile header"
+	ProblemPackChecksum ProblemKind = "packfile does not match its checksum"
+	ProblemPackBlock    ProblemKind = "unreadable packfile block"
+	ProblemKeyHash      ProblemKind = "block key does not match its hash"
+	ProblemChecksum     ProblemKind = "block does not match its checksum"
+	ProblemIndex        ProblemKind = "unreadable index"
+	ProblemIndexPack    ProblemKind = "index belongs to a different packfile"
+	ProblemIndexEntry   ProblemKind = "index entry does not match any block"
+	ProblemCount        ProblemKind = "index and packfile counts differ"
+	ProblemMissingIndex ProblemKind = "packfile without index"
+	ProblemMissingPack  ProblemKind = "index without packfile"
+	ProblemFilter       ProblemKind = "filter does not match its index"
+	ProblemReverseIndex ProblemKind = "reverse index does not match its index"
+)
+
+// NoOffset is the Problem offset when the problem is not related to a block.
+const NoOffset int64 = -1
+
+// Problem is an issue found on a packfile or its index.
+type Problem struct {
+	Pack string
+	Kind ProblemKind
+	// Offset is the position of the affected block, or NoOffset.
+	Offset int64
+	Err    error
+}
+
+func (p *Problem) Error() string {
+	msg := fmt.Sprintf("pack %s: %s", p.Pack, p.Kind)
+	if p.Offset != NoOffset {
+		msg = fmt.Sprintf("%s at offset %d", msg, p.Offset)
+	}
+
+	if p.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, p.Err)
+	}
+
+	return msg
+}
+
+func (p *Problem) Unwrap() error {
+	return p.Err
+}
+
+// CheckReport contains the result of checking all the packfiles.
+type CheckReport struct {
+	Packs    int
+	Blocks   int
+	Problems []*Problem
+}
+
+// OK returns true if no problems were found.
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Err returns an error combining all the problems, or nil if there are none.
+func (r *CheckReport) Err() error {
+	var err error
+	for _, p := range r.Problems {
+		err = multierr.Append(err, p)
+	}
+
+	return err
+}
+
+func (r *CheckReport) add(pack string, kind ProblemKind, offset int64, err error) {
+	r.Problems = append(r.Problems, &Problem{
+		Pack:   pack,
+		Kind:   kind,
+		Offset: offset,
+		Err:    err,
+	})
+}
+
+type checkedPack struct {
+	checksum ihash.Hash
+	// blocks are in packfile order
+	blocks []*checkedBlock
+}
+
+type checkedBlock struct {
+	offset int64
+	hash   ihash.Hash
+	crc    uint32
+	size   uint32
+}
+
+// Check reads all the packfiles and their indexes from disk, checking that
+// all blocks are readable and that indexes match their packfiles. Problems
+// are added to the report, and only errors not related to the packfile
+// contents are returned.
+func (pp *PackPack) Check(ctx context.Context) (report *CheckReport, err error) {
+	packs, indexes, err := pp.pinFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(packs)+len(indexes))
+	for id := range packs {
+		ids = append(ids, id)
+	}
+
+	pinned := append([]string(nil), ids...)
+	defer func() {
+		err = multierr.Append(err, pp.unpin(pinned))
+	}()
+
+	for id := range indexes {
+		if _, ok := packs[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	report = &CheckReport{}
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		if _, ok := packs[id]; !ok {
+			report.add(id, ProblemMissingPack, NoOffset, nil)
+			continue
+		}
+
+		report.Packs++
+
+		cp, ok := pp.checkPack(id, report)
+		if !ok {
+			continue
+		}
+
+		if _, ok := indexes[id]; !ok {
+			report.add(id, ProblemMissingIndex, NoOffset, nil)
+			continue
+		}
+
+		pp.checkIndex(id, cp, report)
+	}
+
+	return report, nil
+}
+
+// checkPack verifies the packfile checksum and reads all its blocks. It
+// returns false if the packfile cannot be completely read.
+func (pp *PackPack) checkPack(id string, report *CheckReport) (*checkedPack, bool) {
+	r, err := NewPackFromFile(pp.fsys, packPath(id, pp.path))
+	if err != nil {
+		report.add(id, ProblemPackHeader, NoOffset, err)
+		return nil, false
+	}
+
+	defer r.Close()
+
+	sum, err := r.Verify()
+	if errors.Is(err, ErrInvalidChecksum) {
+		report.add(id, ProblemPackChecksum, NoOffset, err)
+
+		// start reading blocks again to find the corrupted ones
+		err = r.Reset()
+	}
+
+	if err != nil {
+		report.add(id, ProblemPackBlock, NoOffset, err)
+		return nil, false
+	}
+
+	// checksums are verified here to be able to continue with the next
+	// blocks
+	r.SkipVerification(true)
+
+	var blocks []*checkedBlock
+	for {
+		off := r.Offset()
+		bh, v, err := r.NextBlock()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			report.add(id, ProblemPackBlock, off, err)
+			return nil, false
+		}
+
+		report.Blocks++
+
+		if k := bh.OriginalKey(); k != nil && ihash.SumBytes(k) != bh.Hash {
+			report.add(id, ProblemKeyHash, off, nil)
+		}
+
+		if r.Version() >= packVersionBlocks {
+			if crc := Checksum(v); crc != bh.Checksum {
+				report.add(id, ProblemChecksum, off, &CorruptedBlockError{
+					Hash:     bh.Hash,
+					Expected: bh.Checksum,
+					Actual:   crc,
+				})
+			}
+		}
+
+		blocks = append(blocks, &checkedBlock{offset: off, hash: bh.Hash, crc: bh.Checksum, size: bh.Blocksize})
+	}
+
+	return &checkedPack{checksum: sum, blocks: blocks}, true
+}
+
+// checkIndex checks that all the index entries point to a block with the
+// same hash and size. Entries are read in packfile order, so they are
+// compared with the blocks as they come.
+func (pp *PackPack) checkIndex(id string, cp *checkedPack, report *CheckReport) {
+	ir, err := idx.NewIndexFromFile(pp.fsys, idx.IndexPath(id, pp.path))
+	if err != nil {
+		report.add(id, ProblemIndex, NoOffset, err)
+		return
+	}
+
+	defer ir.Close()
+
+	// indexes are not verified when opening them
+	if err := ir.Verify(); err != nil {
+		report.add(id, ProblemIndex, NoOffset, err)
+		return
+	}
+
+	sum := ir.PackChecksum()
+
+	if sum != cp.checksum {
+		report.add(id, ProblemIndexPack, NoOffset, fmt.Errorf("index packfile checksum %x, packfile checksum %x", sum, cp.checksum))
+		return
+	}
+
+	rev := pp.checkReverseIndex(id, ir, report)
+	if rev == nil {
+		return
+	}
+
+	defer rev.Close()
+
+	iter, err := ir.EntriesByOffset(rev)
+	if err != nil {
+		report.add(id, ProblemIndex, NoOffset, err)
+		return
+	}
+
+	defer iter.Close()
+
+	blocks := cp.blocks
+
+	var count, next int
+	for {
+		e, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			report.add(id, ProblemIndex, NoOffset, err)
+			return
+		}
+
+		count++
+
+		off := int64(e.Offset)
+		for next < len(blocks) && blocks[next].offset < off {
+			next++
+		}
+
+		if next == len(blocks) || blocks[next].offset != off {
+			report.add(id, ProblemIndexEntry, off, errors.New("no block at offset"))
+			continue
+		}
+
+		b := blocks[next]
+		next++
+
+		switch {
+		case b.hash != e.Key:
+			report.add(id, ProblemIndexEntry, off, errors.New("hash mismatch"))
+		case b.crc != e.CRC32:
+			report.add(id, ProblemIndexEntry, off, fmt.Errorf("checksum mismatch: index %08x, block %08x", e.CRC32, b.crc))
+		case b.size != e.Size:
+			report.add(id, ProblemIndexEntry, off, fmt.Errorf("size mismatch: index %d, block %d", e.Size, b.size))
+		}
+	}
+
+	if count != len(blocks) {
+		report.add(id, ProblemCount, NoOffset, fmt.Errorf("index has %d entries, packfile has %d blocks", count, len(blocks)))
+	}
+
+	pp.checkFilter(id, ir, report)
+}
+
+// checkReverseIndex checks the packfile reverse index, if any, and returns it.
+// If it is missing or does not match the index, a new one is built in memory.
+// It returns nil if the index entries cannot be read.
+func (pp *PackPack) checkReverseIndex(id string, ir *idx.IndexReader, report *CheckReport) *idx.ReverseIndex {
+	rev, err := idx.NewReverseIndexFromFile(pp.fsys, idx.ReverseIndexPath(id, pp.path))
+	if err == nil {
+		err = validReverseIndex(ir, rev)
+		if err == nil {
+			return rev
+		}
+
+		rev.Close()
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		report.add(id, ProblemReverseIndex, NoOffset, err)
+	}
+
+	rev, err = idx.NewReverseIndex(ir)
+	if err != nil {
+		report.add(id, ProblemIndex, NoOffset, err)
+		return nil
+	}
+
+	return rev
+}
+
+// validReverseIndex checks that the reverse index matches its checksum, and
+// that it returns all the index entries sorted by offset.
+func validReverseIndex(ir *idx.IndexReader, rev *idx.ReverseIndex) error {
+	if err := rev.Verify(); err != nil {
+		return err
+	}
+
+	iter, err := ir.EntriesByOffset(rev)
+	if err != nil {
+		return err
+	}
+
+	defer iter.Close()
+
+	var prev *idx.Entry
+	for {
+		e, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if prev != nil && e.Offset <= prev.Offset {
+			return fmt.Errorf("entry at offset %d after offset %d", e.Offset, prev.Offset)
+		}
+
+		prev = e
+	}
+}
+
+// checkFilter checks that the packfile filter, if any, contains all the keys
+// on its index. Otherwise, lookups would miss them.
+func (pp *PackPack) checkFilter(id string, ir *idx.IndexReader, report *CheckReport) {
+	f, err := idx.NewFilterFromFile(pp.fsys, idx.FilterPath(id, pp.path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
+	if err != nil {
+		report.add(id, ProblemFilter, NoOffset, err)
+		return
+	}
+
+	var missing int
+	ir.ForEach(func(e *idx.Entry) error {
+		if !f.Has(e.Key) {
+			missing++
+		}
+
+		return nil
+	})
+
+	if missing > 0 {
+		report.add(id, ProblemFilter, NoOffset, fmt.Errorf("%d keys missing on the filter", missing))
+	}
+}
+
+// pinFiles lists the packfiles and indexes on the packs folder, pinning the
+// packfiles so they are not removed until unpinned. Commits and deletions
+// move or remove packfiles and indexes one by one, so they are waited for.
+func (pp *PackPack) pinFiles() (map[string]struct{}, map[string]struct{}, error) {
+	pp.commitMu.Lock()
+	defer pp.commitMu.Unlock()
+
+	pp.pinMu.Lock()
+	defer pp.pinMu.Unlock()
+
+	packs, indexes, err := pp.listFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for id := range packs {
+		pp.pins[id]++
+	}
+
+	return packs, indexes, nil
+}
+
+// listFiles returns the IDs of all the packfiles and indexes in the packs
+// folder.
+func (pp *PackPack) listFiles() (map[string]struct{}, map[string]struct{}, error) {
+	entries, err := pp.fsys.ReadDir(pp.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	packs := make(map[string]struct{})
+	indexes := make(map[string]struct{})
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		name := e.Name()
+		ext := filepath.Ext(name)
+		id := strings.TrimSuffix(name, ext)
+		switch ext {
+		case ".pack":
+			packs[id] = struct{}{}
+		case ".idx":
+			indexes[id] = struct{}{}
+		}
+	}
+
+	return packs, indexes, nil
+}
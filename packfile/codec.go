@@ -0,0 +1,275 @@
+package packfile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies how a block is stored on packfiles from version 1.
+type Codec uint8
+
+const (
+	// CodecNone stores the block as it is.
+	CodecNone Codec = iota
+	// CodecS2 stores the block compressed using the s2 block format.
+	CodecS2
+	// CodecSnappy stores the block compressed using the snappy block format.
+	CodecSnappy
+	// CodecZstd stores the block as a zstd frame, optionally compressed
+	// using the dictionary on the packfile header.
+	CodecZstd
+)
+
+// ErrUnknownCodec is returned when reading a block stored using an unknown
+// codec.
+var ErrUnknownCodec = errors.New("unknown codec")
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecS2:
+		return "s2"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// ParseCodec returns the codec with the given name.
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{CodecNone, CodecS2, CodecSnappy, CodecZstd} {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+
+	return CodecNone, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+}
+
+// Compression configures how blocks are compressed on new packfiles.
+type Compression struct {
+	Codec Codec
+	// Level is the zstd compression level, from 1 to 22. Zero uses the
+	// default one.
+	Level int
+	// DictionarySize is the maximum size of the zstd dictionaries trained
+	// when repacking. Zero disables them.
+	DictionarySize int
+}
+
+// blockCodec compresses and decompresses single blocks.
+type blockCodec interface {
+	// encode compresses src using dst as buffer if it is big enough.
+	encode(dst, src []byte) []byte
+	// decode decompresses src into dst, which must have the exact size of
+	// the block.
+	decode(dst, src []byte) error
+	close() error
+}
+
+// codecs contains the codecs without state, shared by all the packfiles.
+var codecs = map[Codec]blockCodec{
+	CodecNone:   noneCodec{},
+	CodecS2:     s2Codec{},
+	CodecSnappy: snappyCodec{},
+}
+
+// newBlockCodec returns the codec used to write blocks. Level and dict are
+// only used by zstd.
+func newBlockCodec(c Codec, level int, dict []byte) (blockCodec, error) {
+	if c != CodecZstd {
+		if len(dict) != 0 {
+			return nil, fmt.Errorf("dictionaries are not supported by %v", c)
+		}
+
+		bc, ok := codecs[c]
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownCodec, c)
+		}
+
+		return bc, nil
+	}
+
+	return newZstdCodec(level, dict)
+}
+
+// errSizeMismatch returns an error if a decoded block does not have the
+// expected size.
+func errSizeMismatch(expected, actual int) error {
+	if expected == actual {
+		return nil
+	}
+
+	return fmt.Errorf("block size mismatch: expected %d, got %d", expected, actual)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) encode(dst, src []byte) []byte {
+	return src
+}
+
+func (noneCodec) decode(dst, src []byte) error {
+	if err := errSizeMismatch(len(dst), len(src)); err != nil {
+		return err
+	}
+
+	copy(dst, src)
+
+	return nil
+}
+
+func (noneCodec) close() error { return nil }
+
+type s2Codec struct{}
+
+func (s2Codec) encode(dst, src []byte) []byte {
+	return s2.Encode(dst[:cap(dst)], src)
+}
+
+func (s2Codec) decode(dst, src []byte) error {
+	n, err := s2.DecodedLen(src)
+	if err != nil {
+		return err
+	}
+
+	if err := errSizeMismatch(len(dst), n); err != nil {
+		return err
+	}
+
+	_, err = s2.Decode(dst, src)
+	return err
+}
+
+func (s2Codec) close() error { return nil }
+
+type snappyCodec struct{}
+
+func (snappyCodec) encode(dst, src []byte) []byte {
+	return snappy.Encode(dst[:cap(dst)], src)
+}
+
+func (snappyCodec) decode(dst, src []byte) error {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return err
+	}
+
+	if err := errSizeMismatch(len(dst), n); err != nil {
+		return err
+	}
+
+	_, err = snappy.Decode(dst, src)
+	return err
+}
+
+func (snappyCodec) close() error { return nil }
+
+// zstdCodec compresses each block as a zstd frame. Encoders and decoders are
+// safe for concurrent use.
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// newZstdDecoder returns a zstd codec that can only decode blocks.
+func newZstdDecoder(dict []byte) (*zstdCodec, error) {
+	opts := []zstd.DOption{
+		zstd.WithDecoderConcurrency(0),
+	}
+
+	if len(dict) != 0 {
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+
+	dec, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdCodec{dec: dec}, nil
+}
+
+func newZstdCodec(level int, dict []byte) (*zstdCodec, error) {
+	c, err := newZstdDecoder(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	// blocks already have their own checksum
+	opts := []zstd.EOption{
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderCRC(false),
+	}
+
+	if level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+
+	if len(dict) != 0 {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+
+	c.enc, err = zstd.NewWriter(nil, opts...)
+	if err != nil {
+		c.dec.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *zstdCodec) encode(dst, src []byte) []byte {
+	return c.enc.EncodeAll(src, dst[:0])
+}
+
+func (c *zstdCodec) decode(dst, src []byte) error {
+	out, err := c.dec.DecodeAll(src, dst[:0])
+	if err != nil {
+		return err
+	}
+
+	if err := errSizeMismatch(len(dst), len(out)); err != nil {
+		return err
+	}
+
+	// the block did not fit into dst
+	if len(dst) > 0 && &out[0] != &dst[0] {
+		copy(dst, out)
+	}
+
+	return nil
+}
+
+func (c *zstdCodec) close() error {
+	c.dec.Close()
+	if c.enc == nil {
+		return nil
+	}
+
+	return c.enc.Close()
+}
+
+// encodeBlock compresses the block using dst as buffer if it is big enough.
+// If compressing the block does not reduce its size, it is stored as it is.
+func encodeBlock(bc blockCodec, c Codec, dst, block []byte) (Codec, []byte, []byte) {
+	if c == CodecNone {
+		return CodecNone, block, dst
+	}
+
+	enc := bc.encode(dst, block)
+	if len(enc) >= len(block) {
+		return CodecNone, block, enc
+	}
+
+	return c, enc, enc
+}
@@ -0,0 +1,51 @@
+package packfile
+
+import (
+	"hash/crc32"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DictionarySampleRatio is the amount of sample data used to train a
+// dictionary, relative to its size.
+const DictionarySampleRatio = 100
+
+// TrainDictionary builds a zstd dictionary with up to size bytes of content
+// from sample blocks. The content is taken from the samples as they are, and
+// the entropy tables are computed by compressing all of them with it. It
+// returns nil if the samples are too small to build a dictionary.
+func TrainDictionary(samples [][]byte, size int) ([]byte, error) {
+	history := dictionaryHistory(samples, size)
+	// repeat offsets must be inside the content
+	if len(history) < 8 {
+		return nil, nil
+	}
+
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		// IDs lower than 32768 and higher than 2^31 are reserved
+		ID:       32768 + crc32.ChecksumIEEE(history)%(1<<31-32768),
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	})
+}
+
+// dictionaryHistory returns up to size bytes of samples. The first samples
+// go at the end, where offsets are smaller.
+func dictionaryHistory(samples [][]byte, size int) []byte {
+	history := make([]byte, size)
+	pos := size
+	for _, s := range samples {
+		if pos == 0 {
+			break
+		}
+
+		if len(s) > pos {
+			s = s[len(s)-pos:]
+		}
+
+		pos -= copy(history[pos-len(s):], s)
+	}
+
+	return history[pos:]
+}
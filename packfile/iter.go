@@ -0,0 +1,150 @@
+package packfile
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/idx"
+	"github.com/ajnavarro/super-blockstore/iio"
+)
+
+// Block is a block read from a packfile by Iter.
+type Block struct {
+	Key   []byte
+	Hash  ihash.Hash
+	Value []byte
+	Size  uint32
+	// Sequence is the sequence number of the packfile containing the block.
+	Sequence uint64
+}
+
+// Iter walks over all the blocks contained on the packfiles that were
+// available when the iterator was created, newest packfile first. Every
+// packfile is opened using its own Reader, so iterating does not interfere
+// with concurrent lookups.
+type Iter struct {
+	fsys     iio.FS
+	path     string
+	packs    []string
+	keysOnly bool
+	filter   func(key []byte) bool
+	idx      *idx.MultiIndex
+
+	current    *Reader
+	currentSeq uint64
+}
+
+// NewIter returns an iterator over all the committed packfiles, newest first.
+// If keysOnly is true, values are skipped and only keys and sizes are
+// returned.
+func (pp *PackPack) NewIter(keysOnly bool) *Iter {
+	return newIter(pp, pp.idx.PackIDs(), keysOnly)
+}
+
+// newIter returns an iterator over the given packfiles. They are read newest
+// first, so the first block found for each key is the one returned by
+// lookups.
+func newIter(pp *PackPack, packs []string, keysOnly bool) *Iter {
+	pp.idx.SortNewest(packs)
+
+	return &Iter{
+		fsys:     pp.fsys,
+		path:     pp.path,
+		packs:    packs,
+		keysOnly: keysOnly,
+		idx:      pp.idx,
+	}
+}
+
+// SetFilter skips the blocks whose key does not match, without reading their
+// value. It must be called before Next.
+func (it *Iter) SetFilter(fn func(key []byte) bool) {
+	it.filter = fn
+}
+
+// Next returns the next block. Value is nil if the iterator was created as
+// keys only. It returns io.EOF when there are no more blocks.
+func (it *Iter) Next() (*Block, error) {
+	for {
+		if it.current == nil {
+			if len(it.packs) == 0 {
+				return nil, io.EOF
+			}
+
+			packName := it.packs[0]
+			it.packs = it.packs[1:]
+
+			r, err := NewPackFromFile(it.fsys, packPath(packName, it.path))
+			// pack was removed after starting the iteration
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			it.current = r
+			it.currentSeq = it.idx.Sequence(packName)
+		}
+
+		bh, err := it.current.nextHeader()
+		if err == io.EOF {
+			if err := it.closeCurrent(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		skip := it.filter != nil && !it.filter(bh.Key)
+		if skip || it.keysOnly {
+			if err := it.current.skipValue(bh); err != nil {
+				return nil, err
+			}
+
+			if skip {
+				continue
+			}
+		}
+
+		var value []byte
+		if !it.keysOnly {
+			value, err = it.current.readCheckedValue(it.current.rc, bh)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return &Block{
+			Key:   bh.Key,
+			Hash:  bh.Hash,
+			Value: value,
+			Size:  bh.Blocksize,
+
+			Sequence: it.currentSeq,
+		}, nil
+	}
+}
+
+func (it *Iter) closeCurrent() error {
+	if it.current == nil {
+		return nil
+	}
+
+	err := it.current.Close()
+	it.current = nil
+
+	return err
+}
+
+// Close releases the opened packfile, if any. It can be called several times.
+func (it *Iter) Close() error {
+	it.packs = nil
+	return it.closeCurrent()
+}
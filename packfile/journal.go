@@ -0,0 +1,265 @@
+package packfile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ajnavarro/super-blockstore/idx"
+	"github.com/ajnavarro/super-blockstore/iio"
+)
+
+const journalName = "journal"
+
+// journal operations. Every started operation is followed by its end
+// operation when finished, or by opAborted if a commit is rolled back.
+const (
+	opCommit    = "commit"
+	opCommitted = "committed"
+	opAborted   = "aborted"
+	opDelete    = "delete"
+	opDeleted   = "deleted"
+)
+
+// journal records packfile commits and deletions, so operations interrupted
+// by a crash can be finished when opening the packs folder again.
+//
+// Every line contains the operation and the packfile ID. The file is
+// truncated when there are no pending operations.
+type journal struct {
+	mu      sync.Mutex
+	f       iio.File
+	pending int
+	// durability sets if records are synced. Starting an operation must be
+	// durable before its first step when syncing file contents.
+	durability iio.Durability
+}
+
+func openJournal(fsys iio.FS, p string) (*journal, error) {
+	f, err := iio.OpenFile(fsys, p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{f: f, durability: iio.DurabilityFull}, nil
+}
+
+func (j *journal) write(op, packID string) error {
+	if _, err := fmt.Fprintf(j.f, "%s %s\n", op, packID); err != nil {
+		return err
+	}
+
+	if j.durability < iio.DurabilityData {
+		return nil
+	}
+
+	return j.f.Sync()
+}
+
+// begin records the start of an operation.
+func (j *journal) begin(op, packID string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(op, packID); err != nil {
+		return err
+	}
+
+	j.pending++
+
+	return nil
+}
+
+// end records the end of an operation.
+func (j *journal) end(op, packID string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.pending--
+	if j.pending == 0 {
+		return j.f.Truncate(0)
+	}
+
+	return j.write(op, packID)
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+// readPendingOperations returns the started operations without an end
+// operation, by packfile ID.
+func readPendingOperations(fsys iio.FS, p string) (map[string]string, error) {
+	f, err := iio.Open(fsys, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	pending := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		op, packID, ok := strings.Cut(s.Text(), " ")
+		if !ok {
+			// incomplete line written before a crash
+			continue
+		}
+
+		switch op {
+		case opCommit, opDelete:
+			pending[packID] = op
+		case opCommitted, opAborted, opDeleted:
+			delete(pending, packID)
+		}
+	}
+
+	return pending, s.Err()
+}
+
+// recover finishes pending operations from the journal and removes all the
+// unfinished files from the processing folder. It must be called before
+// loading any packfile.
+func (pp *PackPack) recover() error {
+	jp := filepath.Join(pp.path, journalName)
+	pending, err := readPendingOperations(pp.fsys, jp)
+	if err != nil {
+		return err
+	}
+
+	for packID, op := range pending {
+		switch op {
+		case opCommit:
+			// both files were completely written before starting the
+			// operation, so the commit can be finished.
+			if err := renameIfExists(
+				pp.fsys,
+				packProcessingPath(packID, pp.tempPath),
+				packPath(packID, pp.path),
+			); err != nil {
+				return err
+			}
+
+			if err := renameIfExists(
+				pp.fsys,
+				idx.FilterProcessingPath(packID, pp.tempPath),
+				idx.FilterPath(packID, pp.path),
+			); err != nil {
+				return err
+			}
+
+			if err := renameIfExists(
+				pp.fsys,
+				idx.ReverseIndexProcessingPath(packID, pp.tempPath),
+				idx.ReverseIndexPath(packID, pp.path),
+			); err != nil {
+				return err
+			}
+
+			if err := renameIfExists(
+				pp.fsys,
+				idx.IndexProcessingPath(packID, pp.tempPath),
+				idx.IndexPath(packID, pp.path),
+			); err != nil {
+				return err
+			}
+		case opDelete:
+			if err := iio.RemoveIfExists(pp.fsys, idx.IndexPath(packID, pp.path)); err != nil {
+				return err
+			}
+
+			if err := iio.RemoveIfExists(pp.fsys, idx.FilterPath(packID, pp.path)); err != nil {
+				return err
+			}
+
+			if err := iio.RemoveIfExists(pp.fsys, idx.ReverseIndexPath(packID, pp.path)); err != nil {
+				return err
+			}
+
+			if err := iio.RemoveIfExists(pp.fsys, packPath(packID, pp.path)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// finished operations must be on disk before removing the journal
+	if len(pending) > 0 {
+		if err := pp.durability.SyncDir(pp.fsys, pp.path); err != nil {
+			return err
+		}
+	}
+
+	if err := iio.RemoveIfExists(pp.fsys, jp); err != nil {
+		return err
+	}
+
+	// nothing is using the processing folder yet, everything there is
+	// coming from unfinished commits, batches or GCs
+	entries, err := pp.fsys.ReadDir(pp.tempPath)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		if err := pp.fsys.Remove(filepath.Join(pp.tempPath, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return pp.removeDanglingIndexes()
+}
+
+// removeDanglingIndexes removes indexes, filters and reverse indexes without
+// the corresponding packfile, so no lookups will point to a missing packfile.
+func (pp *PackPack) removeDanglingIndexes() error {
+	entries, err := pp.fsys.ReadDir(pp.path)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || (ext != ".idx" && ext != ".filter" && ext != ".rev") {
+			continue
+		}
+
+		packID := strings.TrimSuffix(name, ext)
+		_, err := pp.fsys.Stat(packPath(packID, pp.path))
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		if err := pp.fsys.Remove(filepath.Join(pp.path, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func renameIfExists(fsys iio.FS, from, to string) error {
+	err := iio.Rename(fsys, from, to)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
@@ -2,11 +2,16 @@ package packfile
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"testing"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
+	"github.com/klauspost/compress/s2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -21,15 +26,16 @@ func TestWriteAndReadPackfile(t *testing.T) {
 	err = pw.WriteHeader()
 	require.NoError(err)
 
-	pos1, err := pw.WriteBlock([]byte("hello"), 5, bytes.NewReader([]byte("world")))
+	pos1, crc1, err := pw.WriteBlock([]byte("hello"), 5, bytes.NewReader([]byte("world")))
 	require.NoError(err)
-	require.Equal(int64(7), pos1)
-	pos2, err := pw.WriteBlock([]byte("ttt"), 9, bytes.NewReader([]byte("somevalue")))
+	require.Equal(int64(12), pos1)
+	require.Equal(Checksum([]byte("world")), crc1)
+	pos2, _, err := pw.WriteBlock([]byte("ttt"), 9, bytes.NewReader([]byte("somevalue")))
 	require.NoError(err)
-	require.Equal(int64(48), pos2)
-	pos3, err := pw.WriteBlock([]byte("bye"), 11, bytes.NewBuffer([]byte("cruel world")))
+	require.Equal(int64(71), pos2)
+	pos3, _, err := pw.WriteBlock([]byte("bye"), 11, bytes.NewBuffer([]byte("cruel world")))
 	require.NoError(err)
-	require.Equal(int64(93), pos3)
+	require.Equal(int64(132), pos3)
 
 	err = pw.Close()
 	require.NoError(err)
@@ -40,32 +46,311 @@ func TestWriteAndReadPackfile(t *testing.T) {
 	pr, err := NewReader(f)
 	require.NoError(err)
 
+	require.Equal(packVersion, pr.Version())
+
+	sum, err := pr.Verify()
+	require.NoError(err)
+	require.Equal(pw.Sum(), sum)
+
 	key, vr, err := pr.Next()
 	require.NoError(err)
 
-	k1 := ihash.SumBytes([]byte("hello"))
-	require.Equal(k1[:], key)
+	require.Equal([]byte("hello"), key)
 	require.Equal([]byte("world"), vr)
 
 	err = pr.Skip()
 	require.NoError(err)
 
-	key, vr, err = pr.Next()
+	bh, vr, err := pr.NextBlock()
 	require.NoError(err)
 
-	k3 := ihash.SumBytes([]byte("bye"))
-	require.Equal(k3[:], key)
+	require.Equal(ihash.SumBytes([]byte("bye")), bh.Hash)
+	require.Equal([]byte("bye"), bh.Key)
+	require.Equal(Checksum([]byte("cruel world")), bh.Checksum)
 	require.Equal([]byte("cruel world"), vr)
 
 	k2, v2r, err := pr.ReadValueAt(pos2)
-	hk2 := ihash.SumBytes([]byte("ttt"))
 	require.NoError(err)
-	require.Equal(hk2[:], k2)
+	require.Equal([]byte("ttt"), k2)
 
 	require.Equal("somevalue", string(v2r))
 
 }
 
+func TestWriteAndReadCompressedBlocks(t *testing.T) {
+	require := require.New(t)
+
+	f, err := os.CreateTemp(t.TempDir(), "test.pack")
+	require.NoError(err)
+
+	pw := NewWriter(f)
+	require.NoError(pw.WriteHeader())
+
+	compressible := bytes.Repeat([]byte("value"), 1000)
+	random := make([]byte, 5000)
+	_, err = rand.Read(random)
+	require.NoError(err)
+
+	values := [][]byte{compressible, random, compressible}
+	var offsets []int64
+	for i, v := range values {
+		off, _, err := pw.WriteBlock([]byte(fmt.Sprint(i)), uint32(len(v)), bytes.NewReader(v))
+		require.NoError(err)
+		offsets = append(offsets, off)
+	}
+
+	require.NoError(pw.Close())
+
+	// compressed blocks take less space than their values
+	require.Less(offsets[1]-offsets[0], int64(len(compressible)))
+
+	pr, err := NewPackFromFile(iio.OS, f.Name())
+	require.NoError(err)
+
+	_, err = pr.Verify()
+	require.NoError(err)
+
+	for i, codec := range []Codec{CodecS2, CodecNone, CodecS2} {
+		bh, v, err := pr.NextBlock()
+		require.NoError(err)
+		require.Equal(codec, bh.Codec)
+		require.Equal(uint32(len(values[i])), bh.Blocksize)
+		require.Equal(values[i], v)
+	}
+
+	_, _, err = pr.NextBlock()
+	require.ErrorIs(err, io.EOF)
+
+	for i := len(offsets) - 1; i >= 0; i-- {
+		k, v, err := pr.ReadValueAt(offsets[i])
+		require.NoError(err)
+		require.Equal([]byte(fmt.Sprint(i)), k)
+		require.Equal(values[i], v)
+	}
+
+	require.NoError(pr.Close())
+}
+
+func TestWriteAndReadCodecs(t *testing.T) {
+	for _, codec := range []Codec{CodecNone, CodecS2, CodecSnappy, CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			f, err := os.CreateTemp(t.TempDir(), "test.pack")
+			require.NoError(err)
+
+			pw := NewWriter(f)
+			require.NoError(pw.SetCodec(codec, 19, nil))
+			require.NoError(pw.WriteHeader())
+
+			values := [][]byte{bytes.Repeat([]byte("value"), 1000), []byte("v"), {}}
+			var offsets []int64
+			for i, v := range values {
+				off, _, err := pw.WriteBlock([]byte(fmt.Sprint(i)), uint32(len(v)), bytes.NewReader(v))
+				require.NoError(err)
+				offsets = append(offsets, off)
+			}
+
+			require.NoError(pw.Close())
+
+			pr, err := NewPackFromFile(iio.OS, f.Name())
+			require.NoError(err)
+			require.Equal(codec, pr.Codec())
+			require.Nil(pr.Dictionary())
+
+			// small blocks are not compressed
+			for i, c := range []Codec{codec, CodecNone, CodecNone} {
+				bh, v, err := pr.NextBlock()
+				require.NoError(err)
+				require.Equal(c, bh.Codec)
+				require.Equal(values[i], v)
+			}
+
+			for i := len(offsets) - 1; i >= 0; i-- {
+				_, v, err := pr.ReadValueAt(offsets[i])
+				require.NoError(err)
+				require.Equal(values[i], v)
+			}
+
+			require.NoError(pr.Close())
+		})
+	}
+}
+
+func TestWriteAndReadDictionary(t *testing.T) {
+	require := require.New(t)
+
+	r := rand.New(rand.NewSource(42))
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, similarBlock(r, i))
+	}
+
+	dict, err := TrainDictionary(samples, 4096)
+	require.NoError(err)
+	require.NotEmpty(dict)
+	require.Less(len(dict), 4096+1024)
+
+	// blocks not used as samples
+	var values [][]byte
+	for i := 0; i < 100; i++ {
+		values = append(values, similarBlock(r, i))
+	}
+
+	write := func(dict []byte) (string, int64) {
+		f, err := os.CreateTemp(t.TempDir(), "test.pack")
+		require.NoError(err)
+
+		pw := NewWriter(f)
+		require.NoError(pw.SetCodec(CodecZstd, 0, dict))
+		require.NoError(pw.WriteHeader())
+
+		for i, v := range values {
+			_, _, err := pw.WriteBlock([]byte(fmt.Sprint(i)), uint32(len(v)), bytes.NewReader(v))
+			require.NoError(err)
+		}
+
+		require.NoError(pw.Close())
+
+		fi, err := os.Stat(f.Name())
+		require.NoError(err)
+
+		return f.Name(), fi.Size()
+	}
+
+	withDict, withDictSize := write(dict)
+	_, withoutDictSize := write(nil)
+
+	require.Less(withDictSize, withoutDictSize)
+
+	pr, err := NewPackFromFile(iio.OS, withDict)
+	require.NoError(err)
+	require.Equal(CodecZstd, pr.Codec())
+	require.Equal(dict, pr.Dictionary())
+
+	_, err = pr.Verify()
+	require.NoError(err)
+
+	for i := range values {
+		bh, v, err := pr.NextBlock()
+		require.NoError(err)
+		require.Equal(CodecZstd, bh.Codec)
+		require.Equal(values[i], v)
+	}
+
+	require.NoError(pr.Close())
+
+	// not enough content to build a dictionary
+	dict, err = TrainDictionary([][]byte{[]byte("abc"), []byte("de")}, 4096)
+	require.NoError(err)
+	require.Nil(dict)
+}
+
+// similarBlock returns a block sharing most of its structure with the other
+// ones, like nodes linking to chunks of a file.
+func similarBlock(r *rand.Rand, i int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"Data":{"Type":"File","blocksizes":[`)
+	for l := 0; l < 4; l++ {
+		fmt.Fprintf(&b, "262144,")
+	}
+	fmt.Fprintf(&b, "%d]},\"Links\":[", r.Intn(262144))
+	for l := 0; l < 4; l++ {
+		h := make([]byte, 16)
+		r.Read(h)
+		fmt.Fprintf(&b, `{"Name":"chunk-%d","Hash":"%x","Tsize":262158},`, i*4+l, h)
+	}
+	b.WriteString("]}")
+
+	return b.Bytes()
+}
+
+func TestReadPackfileVersion0(t *testing.T) {
+	require := require.New(t)
+
+	f, err := os.CreateTemp(t.TempDir(), "test.pack")
+	require.NoError(err)
+
+	// version 0 packfiles only contain the hashed key
+	s2w := s2.NewWriter(f, s2.WriterAddIndex())
+	_, err = s2w.Write(packSig)
+	require.NoError(err)
+	require.NoError(binary.Write(s2w, binary.BigEndian, packVersionHashes))
+
+	k := ihash.SumBytes([]byte("hello"))
+	_, err = s2w.Write(k[:])
+	require.NoError(err)
+	require.NoError(binary.Write(s2w, binary.BigEndian, uint32(5)))
+	_, err = s2w.Write([]byte("world"))
+	require.NoError(err)
+
+	require.NoError(s2w.Close())
+	require.NoError(f.Close())
+
+	pr, err := NewPackFromFile(iio.OS, f.Name())
+	require.NoError(err)
+	require.Equal(packVersionHashes, pr.Version())
+
+	bh, v, err := pr.NextBlock()
+	require.NoError(err)
+	require.Equal(k, bh.Hash)
+	require.Equal(k[:], bh.Key)
+	require.Equal([]byte("world"), v)
+
+	k1, v1, err := pr.ReadValueAt(7)
+	require.NoError(err)
+	require.Equal(k[:], k1)
+	require.Equal([]byte("world"), v1)
+
+	require.NoError(pr.Close())
+}
+
+func TestReadPackfileCorruptedBlock(t *testing.T) {
+	require := require.New(t)
+
+	f, err := os.CreateTemp(t.TempDir(), "test.pack")
+	require.NoError(err)
+	p := f.Name()
+
+	pw := NewWriter(f)
+	require.NoError(pw.SetCodec(CodecNone, 0, nil))
+	require.NoError(pw.WriteHeader())
+
+	key := []byte("hello")
+	k := ihash.SumBytes(key)
+	off, _, err := pw.WriteBlock(key, 5, bytes.NewReader([]byte("world")))
+	require.NoError(err)
+	require.NoError(pw.Close())
+
+	// blocks not compressed are stored as they are
+	data, err := os.ReadFile(p)
+	require.NoError(err)
+	i := bytes.Index(data, []byte("world"))
+	require.NotEqual(-1, i)
+	data[i+1] = 'O'
+	require.NoError(os.WriteFile(p, data, 0755))
+
+	pr, err := NewPackFromFile(iio.OS, p)
+	require.NoError(err)
+
+	_, _, err = pr.ReadValueAt(off)
+	require.ErrorIs(err, ErrCorruptedBlock)
+
+	var cerr *CorruptedBlockError
+	require.ErrorAs(err, &cerr)
+	require.Equal(k, cerr.Hash)
+	require.Equal(Checksum([]byte("world")), cerr.Expected)
+	require.Equal(Checksum([]byte("wOrld")), cerr.Actual)
+
+	pr.SkipVerification(true)
+
+	_, v, err := pr.ReadValueAt(off)
+	require.NoError(err)
+	require.Equal([]byte("wOrld"), v)
+
+	require.NoError(pr.Close())
+}
+
 func BenchmarkPackfileWrite(b *testing.B) {
 	b.Run("N=1", func(b *testing.B) {
 		packfileWriteElements(b, 1)
@@ -137,7 +422,7 @@ func packfileWriteElements(b *testing.B, numBlocks int) {
 		b.StartTimer()
 
 		for i := 0; i < numBlocks; i++ {
-			_, err = pw.WriteBlock(tokens[i][:], uint32(len(block)), bytes.NewBuffer(block))
+			_, _, err = pw.WriteBlock(tokens[i][:], uint32(len(block)), bytes.NewBuffer(block))
 			require.NoError(err)
 		}
 
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
-	"github.com/google/uuid"
 	lru "github.com/hashicorp/golang-lru/v2"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
 	"github.com/ajnavarro/super-blockstore/idx"
 	"github.com/ajnavarro/super-blockstore/iio"
+	"go.uber.org/multierr"
 )
 
 var ErrEntryNotFound = errors.New("entry not found")
@@ -20,51 +25,190 @@ var ErrEntryNotFound = errors.New("entry not found")
 // PackPack contains all the logic needed to get by key blocks from several packfiles.
 // It will use indexes if available
 type PackPack struct {
+	fsys     iio.FS
 	path     string
 	tempPath string
 
-	packs *lru.Cache[string, *Reader]
-	idx   *idx.MultiIndex
+	packs   *lru.Cache[string, *packRef]
+	idx     *idx.MultiIndex
+	journal *journal
+
+	// seq is the last used sequence number
+	seq atomic.Uint64
+	// lastID is the last used packfile ID number
+	lastID atomic.Uint64
+
+	// lookupMu is held for reading while looking for a block and opening its
+	// packfile, and for writing while removing a packfile from the index, so
+	// found packfiles are not removed before opening them
+	lookupMu sync.RWMutex
+
+	// commitMu is held for reading by commits, from getting their sequence
+	// number until the packfile is available
+	commitMu sync.RWMutex
+
+	// pinMu protects pins, and is held while deleting packfiles so they are
+	// not pinned in the middle
+	pinMu sync.Mutex
+	// pins counts the snapshots using each packfile
+	pins map[string]int
+
+	skipVerification bool
+	compression      Compression
+	durability       iio.Durability
 }
 
+// NewPackPack opens the packfiles on path of the OS filesystem, using
+// tempPath for the ones being written.
 func NewPackPack(path, tempPath string, openedPacks int) (*PackPack, error) {
-	if err := os.MkdirAll(path, 0755); err != nil {
+	return NewPackPackFS(iio.OS, path, tempPath, openedPacks)
+}
+
+// NewPackPackFS opens the packfiles on path, using tempPath for the ones
+// being written. Up to openedPacks packfiles are kept open.
+func NewPackPackFS(fsys iio.FS, path, tempPath string, openedPacks int) (*PackPack, error) {
+	if err := fsys.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
 
-	if err := os.MkdirAll(tempPath, 0755); err != nil {
+	if err := fsys.MkdirAll(tempPath, 0755); err != nil {
 		return nil, err
 	}
 
 	cache, err := lru.NewWithEvict(
 		openedPacks,
-		func(key string, value *Reader) {
-			value.Close()
+		func(key string, value *packRef) {
+			value.release()
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	i, err := idx.NewMulti(path, tempPath, openedPacks)
+	pp := &PackPack{
+		fsys:        fsys,
+		path:        path,
+		tempPath:    tempPath,
+		packs:       cache,
+		pins:        make(map[string]int),
+		compression: Compression{Codec: CodecS2},
+		durability:  iio.DurabilityFull,
+	}
+
+	if err := pp.recover(); err != nil {
+		return nil, err
+	}
+
+	j, err := openJournal(fsys, filepath.Join(path, journalName))
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := idx.NewMulti(fsys, path, tempPath, pp.rebuildIndex)
 	if err != nil {
+		j.Close()
 		return nil, err
 	}
 
-	pp := &PackPack{
-		path:     path,
-		tempPath: tempPath,
-		packs:    cache,
-		idx:      i,
+	// packfiles deleted after writing the multi-pack index are still found
+	// on it, so their IDs cannot be used again
+	lastID, err := lastPackID(fsys, path, i.MultiPackIndexPacks())
+	if err != nil {
+		return nil, multierr.Combine(err, i.Close(), j.Close())
 	}
 
+	pp.journal = j
+	pp.idx = i
+	pp.seq.Store(i.MaxSequence())
+	pp.lastID.Store(lastID)
+
 	return pp, nil
 }
 
+// nextPackID returns a new packfile ID. IDs are increasing, so sorting them
+// gives the packfile creation order.
+func (pp *PackPack) nextPackID() string {
+	return fmt.Sprintf("%016x", pp.lastID.Add(1))
+}
+
+// lastPackID returns the highest packfile ID number from the files on the
+// packs folder and the given packfile names. Packfiles created before using
+// monotonic IDs are ignored.
+func lastPackID(fsys iio.FS, path string, names []string) (uint64, error) {
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	var last uint64
+	for _, n := range names {
+		name, _, _ := strings.Cut(n, ".")
+		if len(name) != 16 {
+			continue
+		}
+
+		id, err := strconv.ParseUint(name, 16, 64)
+		if err != nil {
+			continue
+		}
+
+		if id > last {
+			last = id
+		}
+	}
+
+	return last, nil
+}
+
+// NextSequence returns a new sequence number, higher than all the previous
+// ones. Sequence numbers order packfile commits and deletions.
+func (pp *PackPack) NextSequence() uint64 {
+	return pp.seq.Add(1)
+}
+
+// ObserveSequence makes sure that new sequence numbers are higher than seq.
+func (pp *PackPack) ObserveSequence(seq uint64) {
+	for {
+		last := pp.seq.Load()
+		if last >= seq || pp.seq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// WithoutCommits calls fn while no packfile commit is in progress, so the
+// packfiles committed later get a sequence number higher than any other
+// obtained before.
+func (pp *PackPack) WithoutCommits(fn func()) {
+	pp.commitMu.Lock()
+	defer pp.commitMu.Unlock()
+
+	fn()
+}
+
+// Sequence returns the sequence number of a packfile.
+func (pp *PackPack) Sequence(packName string) uint64 {
+	return pp.idx.Sequence(packName)
+}
+
 // TODO GetHashes
 
 func (pp *PackPack) GetSize(key []byte) (uint32, error) {
-	size, err := pp.idx.GetSize(ihash.SumBytes(key))
+	return pp.GetSizeFrom(key, 0)
+}
+
+// GetSizeFrom returns the size of the value from the latest packfile with a
+// sequence number equal or greater than minSeq.
+func (pp *PackPack) GetSizeFrom(key []byte, minSeq uint64) (uint32, error) {
+	_, _, size, err := pp.idx.FindFrom(ihash.SumBytes(key), minSeq)
+	if errors.Is(err, idx.ErrEntryNotFound) {
+		return 0, ErrEntryNotFound
+	}
+
 	if err != nil {
 		return 0, err
 	}
@@ -78,30 +222,56 @@ func (pp *PackPack) GetSize(key []byte) (uint32, error) {
 }
 
 func (pp *PackPack) Get(key []byte) ([]byte, error) {
-	// TODO handle error not found
-	packName, offset, err := pp.idx.GetOffset(ihash.SumBytes(key))
+	return pp.GetFrom(key, 0)
+}
+
+// GetFrom returns the value from the latest packfile with a sequence number
+// equal or greater than minSeq.
+func (pp *PackPack) GetFrom(key []byte, minSeq uint64) ([]byte, error) {
+	pr, offset, err := pp.open(ihash.SumBytes(key), minSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pr.release()
+
+	_, v, err := pr.ReadValueAt(offset)
+	return v, err
+}
+
+// open returns the packfile containing the key and the block offset on it.
+// The returned reference must be released after reading the block.
+func (pp *PackPack) open(h ihash.Hash, minSeq uint64) (*packRef, int64, error) {
+	pp.lookupMu.RLock()
+	defer pp.lookupMu.RUnlock()
+
+	packName, offset, _, err := pp.idx.FindFrom(h, minSeq)
 	if errors.Is(err, idx.ErrEntryNotFound) {
-		return nil, ErrEntryNotFound
+		return nil, 0, ErrEntryNotFound
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	pr, err := pp.getPack(packName)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	_, v, err := pr.ReadValueAt(offset)
-	return v, err
+	return pr, offset, nil
 }
 
 func (pp *PackPack) Has(key []byte) (bool, error) {
-	// TODO handle error not found
-	_, _, err := pp.idx.GetOffset(ihash.SumBytes(key))
+	return pp.HasFrom(key, 0)
+}
+
+// HasFrom checks if the key is on any packfile with a sequence number equal
+// or greater than minSeq.
+func (pp *PackPack) HasFrom(key []byte, minSeq uint64) (bool, error) {
+	_, _, _, err := pp.idx.FindFrom(ihash.SumBytes(key), minSeq)
 	if errors.Is(err, idx.ErrEntryNotFound) {
-		return false, ErrEntryNotFound
+		return false, nil
 	}
 
 	if err != nil {
@@ -111,36 +281,165 @@ func (pp *PackPack) Has(key []byte) (bool, error) {
 	return true, nil
 }
 
-func (pp *PackPack) getPack(packName string) (*Reader, error) {
-	pai, ok := pp.packs.Get(packName)
-	if ok {
-		return pai, nil
+// PackIDs returns the IDs of all the committed packfiles.
+func (pp *PackPack) PackIDs() []string {
+	return pp.idx.PackIDs()
+}
+
+// DeletePack removes a packfile and its index. Lookups will stop finding
+// blocks from it before the file is removed. Packfiles pinned by a snapshot
+// are retired instead, and removed when the last snapshot using them is
+// released.
+func (pp *PackPack) DeletePack(packName string) error {
+	pp.pinMu.Lock()
+	defer pp.pinMu.Unlock()
+
+	if pp.pins[packName] > 0 {
+		pp.idx.Retire(packName)
+		return nil
+	}
+
+	return pp.deletePack(packName)
+}
+
+// HasRetired returns true if any packfile removed by a repack is still in
+// use by a snapshot.
+func (pp *PackPack) HasRetired() bool {
+	return pp.idx.HasRetired()
+}
+
+// deletePack removes a packfile and its index. It must be called holding
+// pinMu.
+func (pp *PackPack) deletePack(packName string) error {
+	if err := pp.journal.begin(opDelete, packName); err != nil {
+		return err
+	}
+
+	pp.lookupMu.Lock()
+	err := pp.idx.DeleteAll(packName)
+	pp.packs.Remove(packName)
+	pp.lookupMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := pp.fsys.Remove(packPath(packName, pp.path)); err != nil {
+		return err
+	}
+
+	if err := pp.durability.SyncDir(pp.fsys, pp.path); err != nil {
+		return err
+	}
+
+	return pp.journal.end(opDeleted, packName)
+}
+
+// SkipVerification disables checking block checksums on Get. It must be set
+// before reading any block.
+func (pp *PackPack) SkipVerification(skip bool) {
+	pp.skipVerification = skip
+}
+
+// SetCompression sets how blocks are compressed on new packfiles. It must be
+// set before writing any block.
+func (pp *PackPack) SetCompression(c Compression) {
+	pp.compression = c
+}
+
+// SetDurability sets which data is synced to disk when committing and
+// deleting packfiles. It defaults to iio.DurabilityFull, and must be set
+// before writing any packfile.
+func (pp *PackPack) SetDurability(d iio.Durability) {
+	pp.durability = d
+	pp.journal.durability = d
+	pp.idx.SetDurability(d)
+}
+
+// WriteMultiPackIndex writes a multi-pack index covering all the packfiles.
+func (pp *PackPack) WriteMultiPackIndex() error {
+	return pp.idx.WriteMultiPackIndex()
+}
+
+// packRef is an open packfile shared by concurrent reads. The cache holds a
+// reference while the packfile is on it, and every read holds another one
+// while using it. The packfile is closed when all of them are released.
+type packRef struct {
+	*Reader
+	refs atomic.Int32
+}
+
+// acquire adds a reference, failing if the packfile was already closed.
+func (r *packRef) acquire() bool {
+	for {
+		n := r.refs.Load()
+		if n == 0 {
+			return false
+		}
+
+		if r.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
 	}
+}
+
+// release drops a reference, closing the packfile if it was the last one.
+func (r *packRef) release() {
+	if r.refs.Add(-1) == 0 {
+		r.Close()
+	}
+}
 
-	pr, err := NewPackFromFile(packPath(packName, pp.path))
+// getPack returns the packfile from the cache, opening it if needed. The
+// returned reference must be released after using it.
+func (pp *PackPack) getPack(packName string) (*packRef, error) {
+	if pr, ok := pp.packs.Get(packName); ok && pr.acquire() {
+		return pr, nil
+	}
+
+	r, err := NewPackFromFile(pp.fsys, packPath(packName, pp.path))
 	if err != nil {
 		return nil, err
 	}
 
-	pp.packs.Add(packName, pr)
+	r.SkipVerification(pp.skipVerification)
+
+	// one reference for the cache and one for the caller
+	pr := &packRef{Reader: r}
+	pr.refs.Store(2)
+
+	// if other read added it in the meantime, this one is only used by the
+	// caller
+	if ok, _ := pp.packs.ContainsOrAdd(packName, pr); ok {
+		pr.refs.Add(-1)
+	}
 
 	return pr, nil
 }
 
 func (pp *PackPack) NewPackProcessing() (*PackProcessing, error) {
+	return pp.newPackProcessing(nil)
+}
 
+// newPackProcessing creates a packfile compressing blocks using the given
+// zstd dictionary, if any.
+func (pp *PackPack) newPackProcessing(dict []byte) (*PackProcessing, error) {
 	packProc := &PackProcessing{
 		tempPath:   pp.tempPath,
 		packFolder: pp.path,
 		idx:        pp.idx,
 		pp:         pp,
+		dict:       dict,
 	}
 	return packProc, packProc.newPack()
 }
 
 func (pp *PackPack) Close() error {
 	pp.packs.Purge()
-	return pp.idx.Close()
+	return multierr.Combine(
+		pp.idx.Close(),
+		pp.journal.Close(),
+	)
 }
 
 type PackProcessing struct {
@@ -149,69 +448,285 @@ type PackProcessing struct {
 	idx        idx.Idx
 
 	processingPackID string
+	count            int
+	seq              uint64
+	dict             []byte
 
 	txn idx.Transaction
 	w   *Writer
 	pp  *PackPack
 }
 
-func (pp *PackProcessing) closePack() error {
-	if err := pp.w.Close(); err != nil {
-		return err
-	}
+// Contains returns true if the key was already written.
+func (pp *PackProcessing) Contains(h ihash.Hash) bool {
+	return pp.txn.Contains(h)
+}
 
-	if err := iio.Rename(
-		packProcessingTxnPath(pp.processingPackID, pp.tempPath),
-		packProcessingPath(pp.processingPackID, pp.tempPath),
-	); err != nil {
-		return err
-	}
+// SetSequence sets the packfile sequence number instead of getting a new one
+// on Commit.
+func (pp *PackProcessing) SetSequence(seq uint64) {
+	pp.seq = seq
+}
+
+// PackID returns the name the packfile will have once committed.
+func (pp *PackProcessing) PackID() string {
+	return pp.processingPackID
+}
 
-	return pp.txn.Commit()
+// Count returns the number of blocks written.
+func (pp *PackProcessing) Count() int {
+	return pp.count
+}
+
+// Size returns the size of the packfile being written.
+func (pp *PackProcessing) Size() int64 {
+	return pp.w.Size()
 }
 
 func (pp *PackProcessing) newPack() error {
-	packID := uuid.New().String()
-	f, err := iio.OpenFile(packProcessingTxnPath(packID, pp.tempPath), os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0755)
+	packID := pp.pp.nextPackID()
+	f, err := iio.OpenFile(pp.pp.fsys, packProcessingTxnPath(packID, pp.tempPath), os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0755)
 	if err != nil {
 		return err
 	}
 
 	pp.processingPackID = packID
 
+	w := NewWriter(f)
+	c := pp.pp.compression
+	if err := w.SetCodec(c.Codec, c.Level, pp.dict); err != nil {
+		return multierr.Combine(err, w.Close(), pp.pp.fsys.Remove(packProcessingTxnPath(packID, pp.tempPath)))
+	}
+
 	txn, err := pp.idx.NewTransaction(packID)
 	if err != nil {
-		return err
+		return multierr.Combine(err, w.Close(), pp.pp.fsys.Remove(packProcessingTxnPath(packID, pp.tempPath)))
 	}
 
-	pp.w = NewWriter(f)
+	pp.w = w
 	pp.txn = txn
 
 	return pp.w.WriteHeader()
 }
 
 func (pp *PackProcessing) WriteBlock(key []byte, value []byte) error {
+	return pp.WriteHashedBlock(ihash.SumBytes(key), key, value)
+}
+
+// WriteHashedBlock writes a block using an already hashed key. If the original
+// key is unknown, key can be empty.
+func (pp *PackProcessing) WriteHashedBlock(h ihash.Hash, key []byte, value []byte) error {
 	size := uint32(len(value))
 
-	pos, err := pp.w.WriteBlock(key, size, bytes.NewBuffer(value))
+	pos, crc, err := pp.w.WriteHashedBlock(h, key, size, bytes.NewReader(value))
 	if err != nil {
 		return err
 	}
 
-	// TODO add CRC32
-	if err := pp.txn.Add(ihash.SumBytes(key), 0, pos, size); err != nil {
+	if err := pp.txn.Add(h, crc, pos, size); err != nil {
 		return err
 	}
 
+	pp.count++
+
 	return nil
 }
 
+// Commit makes the packfile available. The packfile and its index are
+// written into the processing folder first, and moved into the packs folder
+// after that. If the process is interrupted after both files are written, the
+// commit will be finished when opening the PackPack again.
 func (pp *PackProcessing) Commit() error {
-	if err := pp.closePack(); err != nil {
+	return pp.CommitWith(nil)
+}
+
+// CommitWith commits the packfile, calling fn with its sequence number right
+// before making it available. If the commit fails after starting it, also
+// because of fn, it is rolled back. If the rollback fails too, the commit is
+// finished when opening the PackPack again, so it could still happen.
+func (pp *PackProcessing) CommitWith(fn func(seq uint64) error) error {
+	pp.pp.commitMu.RLock()
+	defer pp.pp.commitMu.RUnlock()
+
+	seq := pp.seq
+	if seq == 0 {
+		seq = pp.pp.NextSequence()
+	}
+
+	// the sequence number is also on the packfile, so it is kept if the
+	// index is rebuilt
+	pp.w.SetSequence(seq)
+	if err := pp.w.Close(); err != nil {
+		return err
+	}
+
+	if err := pp.pp.durability.SyncFile(pp.pp.fsys, packProcessingTxnPath(pp.processingPackID, pp.tempPath)); err != nil {
+		return err
+	}
+
+	pp.txn.SetPackChecksum(pp.w.Sum())
+	pp.txn.SetSequence(seq)
+
+	if err := iio.Rename(
+		pp.pp.fsys,
+		packProcessingTxnPath(pp.processingPackID, pp.tempPath),
+		packProcessingPath(pp.processingPackID, pp.tempPath),
+	); err != nil {
+		return err
+	}
+
+	if err := pp.txn.Prepare(); err != nil {
+		return err
+	}
+
+	if err := pp.pp.journal.begin(opCommit, pp.processingPackID); err != nil {
+		return err
+	}
+
+	if err := pp.stage(seq, fn); err != nil {
+		return pp.rollback(err)
+	}
+
+	// the index makes the packfile available for lookups, so it must be the
+	// last one. It is already staged, so it cannot fail.
+	if err := pp.txn.Commit(); err != nil {
+		return err
+	}
+
+	return pp.pp.journal.end(opCommitted, pp.processingPackID)
+}
+
+// stage moves the packfile and its index into the packs folder, and calls fn.
+// They are not available until the index is committed.
+func (pp *PackProcessing) stage(seq uint64, fn func(seq uint64) error) error {
+	if err := iio.Rename(
+		pp.pp.fsys,
+		packProcessingPath(pp.processingPackID, pp.tempPath),
+		packPath(pp.processingPackID, pp.packFolder),
+	); err != nil {
 		return err
 	}
 
-	return iio.Rename(packProcessingPath(pp.processingPackID, pp.tempPath), packPath(pp.processingPackID, pp.packFolder))
+	if err := pp.txn.Stage(); err != nil {
+		return err
+	}
+
+	if fn == nil {
+		return nil
+	}
+
+	return fn(seq)
+}
+
+// rollback removes the files of a commit that failed after starting it, and
+// records it as aborted. If the files cannot be removed, the commit is kept
+// as started on the journal.
+func (pp *PackProcessing) rollback(err error) error {
+	fsys := pp.pp.fsys
+	rerr := multierr.Combine(
+		pp.txn.Discard(),
+		iio.RemoveIfExists(fsys, packPath(pp.processingPackID, pp.packFolder)),
+		iio.RemoveIfExists(fsys, packProcessingPath(pp.processingPackID, pp.tempPath)),
+	)
+	if rerr == nil {
+		rerr = pp.pp.durability.SyncDir(fsys, pp.packFolder)
+	}
+
+	if rerr == nil {
+		rerr = pp.pp.journal.end(opAborted, pp.processingPackID)
+	}
+
+	return multierr.Append(err, rerr)
+}
+
+// Discard removes the packfile being written, and its index.
+func (pp *PackProcessing) Discard() error {
+	if err := pp.w.Close(); err != nil {
+		return err
+	}
+
+	return pp.remove()
+}
+
+// remove removes the packfile, already closed, and its index.
+func (pp *PackProcessing) remove() error {
+	if err := pp.txn.Discard(); err != nil {
+		return err
+	}
+
+	return pp.pp.fsys.Remove(packProcessingTxnPath(pp.processingPackID, pp.tempPath))
+}
+
+// Compact writes into a new packfile the last block written of every key
+// accepted by keep, removing this one. It drops overwritten blocks without
+// keeping their values in memory.
+func (pp *PackProcessing) Compact(keep func(h ihash.Hash) bool) (*PackProcessing, error) {
+	if err := pp.w.Close(); err != nil {
+		return nil, multierr.Combine(err, pp.remove())
+	}
+
+	np, err := pp.pp.newPackProcessing(pp.dict)
+	if err != nil {
+		return nil, multierr.Combine(err, pp.remove())
+	}
+
+	if err := pp.copyLastBlocks(np, keep); err != nil {
+		return nil, multierr.Combine(err, np.Discard(), pp.remove())
+	}
+
+	if err := pp.remove(); err != nil {
+		return nil, multierr.Combine(err, np.Discard())
+	}
+
+	return np, nil
+}
+
+// copyLastBlocks writes into dst the last block of every key accepted by
+// keep, reading them from the closed packfile.
+func (pp *PackProcessing) copyLastBlocks(dst *PackProcessing, keep func(h ihash.Hash) bool) error {
+	r, err := NewPackFromFile(pp.pp.fsys, packProcessingTxnPath(pp.processingPackID, pp.tempPath))
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	last := make(map[ihash.Hash]int, pp.count)
+	for i := 0; ; i++ {
+		bh, err := r.NextHeader()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		last[bh.Hash] = i
+	}
+
+	if err := r.Reset(); err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		bh, v, err := r.NextBlock()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if last[bh.Hash] != i || !keep(bh.Hash) {
+			continue
+		}
+
+		if err := dst.WriteHashedBlock(bh.Hash, bh.OriginalKey(), v); err != nil {
+			return err
+		}
+	}
 }
 
 func packPath(name, packPath string) string {
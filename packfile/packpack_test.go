@@ -1,12 +1,23 @@
 package packfile
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"math/rand"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/idx"
+	"github.com/ajnavarro/super-blockstore/iio"
 )
 
 func TestWriteAndReadPackPack(t *testing.T) {
@@ -45,6 +56,611 @@ func TestWriteAndReadPackPack(t *testing.T) {
 	require.ErrorContains(err, "entry not found")
 }
 
+func TestPackPackNewestFirst(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+
+	pp, err := NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		require.NoError(packProc.WriteBlock([]byte("key"), []byte(fmt.Sprint(i))))
+		require.NoError(packProc.Commit())
+
+		v, err := pp.Get([]byte("key"))
+		require.NoError(err)
+		require.Equal([]byte(fmt.Sprint(i)), v)
+	}
+
+	// covered by the multi-pack index
+	require.NoError(pp.WriteMultiPackIndex())
+
+	v, err := pp.Get([]byte("key"))
+	require.NoError(err)
+	require.Equal([]byte("4"), v)
+
+	ids := pp.PackIDs()
+	require.NoError(pp.Close())
+
+	pp, err = NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	require.NoError(packProc.WriteBlock([]byte("key"), []byte("5")))
+	require.NoError(packProc.Commit())
+
+	// IDs keep increasing after opening the packs again
+	require.Equal(append(ids, packProc.processingPackID), pp.PackIDs())
+
+	v, err = pp.Get([]byte("key"))
+	require.NoError(err)
+	require.Equal([]byte("5"), v)
+
+	require.NoError(pp.Close())
+}
+
+func TestIterFilter(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	packs := path.Join(dir, "packs")
+
+	pp, err := NewPackPack(packs, path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	// values are stored as they are, so they can be corrupted on disk
+	pp.SetCompression(Compression{Codec: CodecNone})
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	require.NoError(packProc.WriteBlock([]byte("a/1"), []byte("value1")))
+	require.NoError(packProc.WriteBlock([]byte("b/1"), []byte("valueX")))
+	require.NoError(packProc.Commit())
+
+	p := packPath(pp.PackIDs()[0], packs)
+	data, err := os.ReadFile(p)
+	require.NoError(err)
+	data[bytes.Index(data, []byte("valueX"))+5] = 'Y'
+	require.NoError(os.WriteFile(p, data, 0755))
+
+	// values of blocks not matching the filter are not read
+	it := pp.NewIter(false)
+	it.SetFilter(func(key []byte) bool {
+		return bytes.HasPrefix(key, []byte("a/"))
+	})
+
+	b, err := it.Next()
+	require.NoError(err)
+	require.Equal([]byte("a/1"), b.Key)
+	require.Equal([]byte("value1"), b.Value)
+
+	_, err = it.Next()
+	require.Equal(io.EOF, err)
+	require.NoError(it.Close())
+
+	it = pp.NewIter(false)
+	_, err = it.Next()
+	require.NoError(err)
+	_, err = it.Next()
+	require.ErrorIs(err, ErrCorruptedBlock)
+	require.NoError(it.Close())
+
+	require.NoError(pp.Close())
+}
+
+func TestCompact(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	temp := path.Join(dir, "temp")
+
+	pp, err := NewPackPack(path.Join(dir, "packs"), temp, 10)
+	require.NoError(err)
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	require.NoError(packProc.WriteBlock([]byte("a"), []byte("old")))
+	require.NoError(packProc.WriteBlock([]byte("b"), []byte("b")))
+	require.NoError(packProc.WriteBlock([]byte("a"), []byte("a")))
+	require.NoError(packProc.WriteBlock([]byte("c"), []byte("c")))
+
+	dropped := ihash.SumBytes([]byte("c"))
+	packProc, err = packProc.Compact(func(h ihash.Hash) bool {
+		return h != dropped
+	})
+	require.NoError(err)
+	require.Equal(2, packProc.Count())
+	require.NoError(packProc.Commit())
+
+	for _, k := range []string{"a", "b"} {
+		v, err := pp.Get([]byte(k))
+		require.NoError(err)
+		require.Equal([]byte(k), v)
+	}
+
+	_, err = pp.Get([]byte("c"))
+	require.ErrorIs(err, ErrEntryNotFound)
+
+	// the compacted packfile was removed
+	entries, err := os.ReadDir(temp)
+	require.NoError(err)
+	require.Empty(entries)
+}
+
+func TestRebuildIndex(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	packs := path.Join(dir, "packs")
+
+	pp, err := NewPackPack(packs, path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	for i := 0; i < 100; i++ {
+		require.NoError(packProc.WriteBlock([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+	require.NoError(packProc.Commit())
+
+	id := packProc.processingPackID
+	require.NoError(pp.Close())
+
+	ir, err := idx.NewIndexFromFile(iio.OS, idx.IndexPath(id, packs))
+	require.NoError(err)
+
+	seq := ir.Sequence()
+	require.NotZero(seq)
+
+	var expected idx.Entries
+	require.NoError(ir.ForEach(func(e *idx.Entry) error {
+		expected = append(expected, e)
+		return nil
+	}))
+	require.NoError(ir.Close())
+
+	rebuilt := path.Join(dir, "rebuilt.idx")
+	require.NoError(RebuildIndex(iio.OS, packPath(id, packs), rebuilt))
+
+	ir, err = idx.NewIndexFromFile(iio.OS, rebuilt)
+	require.NoError(err)
+	require.NoError(ir.Verify())
+
+	var entries idx.Entries
+	require.NoError(ir.ForEach(func(e *idx.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}))
+	require.Equal(seq, ir.Sequence())
+	require.NoError(ir.Close())
+	require.Equal(expected, entries)
+
+	// missing indexes are rebuilt when opening the packs
+	for _, p := range []string{
+		idx.IndexPath(id, packs),
+		idx.FilterPath(id, packs),
+		idx.ReverseIndexPath(id, packs),
+	} {
+		require.NoError(os.Remove(p))
+	}
+
+	pp, err = NewPackPack(packs, path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	for _, p := range []string{
+		idx.IndexPath(id, packs),
+		idx.FilterPath(id, packs),
+		idx.ReverseIndexPath(id, packs),
+	} {
+		require.FileExists(p)
+	}
+
+	v, err := pp.Get([]byte("key42"))
+	require.NoError(err)
+	require.Equal([]byte("value42"), v)
+	require.Equal(seq, pp.Sequence(id))
+
+	require.NoError(pp.Close())
+
+	// indexes whose tables do not match their size are rebuilt too
+	data, err := os.ReadFile(idx.IndexPath(id, packs))
+	require.NoError(err)
+	require.NoError(os.WriteFile(idx.IndexPath(id, packs), data[:len(data)-1], 0755))
+
+	pp, err = NewPackPack(packs, path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	v, err = pp.Get([]byte("key42"))
+	require.NoError(err)
+	require.Equal([]byte("value42"), v)
+
+	require.NoError(pp.Close())
+
+	ir, err = idx.NewIndexFromFile(iio.OS, idx.IndexPath(id, packs))
+	require.NoError(err)
+	require.NoError(ir.Verify())
+	require.NoError(ir.Close())
+}
+
+func TestRepack(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+
+	pp, err := NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	ts, err := NewTombstonePath(path.Join(dir, "tombstone.bin"))
+	require.NoError(err)
+
+	// a full packfile without deleted blocks
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	for i := 0; i < 3; i++ {
+		require.NoError(packProc.WriteBlock([]byte(fmt.Sprintf("full%d", i)), block))
+	}
+	require.NoError(packProc.Commit())
+
+	fullPack := pp.PackIDs()[0]
+
+	for p := 0; p < 4; p++ {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		for i := 0; i < 2; i++ {
+			key := []byte(fmt.Sprintf("key%d-%d", p, i))
+			require.NoError(packProc.WriteBlock(key, key))
+		}
+		require.NoError(packProc.Commit())
+	}
+
+	// duplicated block
+	packProc, err = pp.NewPackProcessing()
+	require.NoError(err)
+	require.NoError(packProc.WriteBlock([]byte("key0-0"), []byte("key0-0")))
+	require.NoError(packProc.Commit())
+
+	require.Len(pp.PackIDs(), 6)
+
+	require.NoError(ts.AddKey([]byte("key1-0"), pp.NextSequence()))
+	require.NoError(ts.AddKey([]byte("key2-1"), pp.NextSequence()))
+
+	require.NoError(pp.Repack(pp.PackIDs(), ts, 3))
+
+	// 6 blocks remaining on 2 packfiles, plus the full one
+	packs := pp.PackIDs()
+	require.Len(packs, 3)
+	require.Contains(packs, fullPack)
+
+	var blocks int
+	it := pp.NewIter(false)
+	for {
+		_, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+
+		blocks++
+	}
+	require.NoError(it.Close())
+	require.Equal(9, blocks)
+
+	for p := 0; p < 4; p++ {
+		for i := 0; i < 2; i++ {
+			key := []byte(fmt.Sprintf("key%d-%d", p, i))
+			v, err := pp.Get(key)
+			if (p == 1 && i == 0) || (p == 2 && i == 1) {
+				require.ErrorIs(err, ErrEntryNotFound)
+				continue
+			}
+
+			require.NoError(err)
+			require.Equal(key, v)
+		}
+	}
+
+	// nothing to do
+	require.NoError(ts.Clear())
+	require.NoError(pp.Repack(pp.PackIDs(), ts, 3))
+	require.ElementsMatch(packs, pp.PackIDs())
+}
+
+func TestRepackNewerCopies(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+
+	pp, err := NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 10)
+	require.NoError(err)
+	defer pp.Close()
+
+	ts, err := NewTombstonePath(path.Join(dir, "tombstone.bin"))
+	require.NoError(err)
+	defer ts.Close()
+
+	commit := func(kv ...string) {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		for i := 0; i < len(kv); i += 2 {
+			require.NoError(packProc.WriteBlock([]byte(kv[i]), []byte(kv[i+1])))
+		}
+		require.NoError(packProc.Commit())
+	}
+
+	commit("a", "old")
+	// a full packfile, not repacked, with a newer value
+	commit("a", "new", "b", "b", "c", "c")
+	commit("d", "d")
+
+	require.NoError(pp.Repack(pp.PackIDs(), ts, 3))
+	require.Len(pp.PackIDs(), 2)
+
+	v, err := pp.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("new"), v)
+
+	v, err = pp.Get([]byte("d"))
+	require.NoError(err)
+	require.Equal([]byte("d"), v)
+}
+
+func TestPackIDsCoveredByMultiPackIndex(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	packs := path.Join(dir, "packs")
+	temp := path.Join(dir, "temp")
+
+	pp, err := NewPackPack(packs, temp, 10)
+	require.NoError(err)
+
+	var ids []string
+	for _, k := range []string{"a", "b"} {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		require.NoError(packProc.WriteBlock([]byte(k), []byte(k)))
+		require.NoError(packProc.Commit())
+
+		ids = append(ids, packProc.PackID())
+	}
+
+	require.NoError(pp.WriteMultiPackIndex())
+	require.NoError(pp.DeletePack(ids[1]))
+	require.NoError(pp.Close())
+
+	// the deleted packfile is the last one, but it is still on the
+	// multi-pack index
+	pp, err = NewPackPack(packs, temp, 10)
+	require.NoError(err)
+	defer pp.Close()
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	require.True(packProc.PackID() > ids[1], packProc.PackID())
+	require.NoError(packProc.WriteBlock([]byte("c"), []byte("c")))
+	require.NoError(packProc.Commit())
+
+	v, err := pp.Get([]byte("c"))
+	require.NoError(err)
+	require.Equal([]byte("c"), v)
+
+	_, err = pp.Get([]byte("b"))
+	require.ErrorIs(err, ErrEntryNotFound)
+}
+
+func TestWithoutCommits(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+
+	pp, err := NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 10)
+	require.NoError(err)
+	defer pp.Close()
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	require.NoError(packProc.WriteBlock([]byte("a"), []byte("a")))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	commit := make(chan error)
+	go func() {
+		commit <- packProc.CommitWith(func(seq uint64) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+
+	<-started
+
+	called := make(chan []string)
+	go pp.WithoutCommits(func() {
+		called <- pp.PackIDs()
+	})
+
+	select {
+	case <-called:
+		require.Fail("called in the middle of a commit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(<-commit)
+	require.Len(<-called, 1)
+}
+
+func TestRepackDictionary(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+
+	pp, err := NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 10)
+	require.NoError(err)
+
+	pp.SetCompression(Compression{Codec: CodecZstd, Level: 3, DictionarySize: 2048})
+
+	ts, err := NewTombstonePath(path.Join(dir, "tombstone.bin"))
+	require.NoError(err)
+
+	r := rand.New(rand.NewSource(42))
+	values := make(map[string][]byte)
+	for p := 0; p < 3; p++ {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%d-%d", p, i)
+			values[key] = similarBlock(r, i)
+			require.NoError(packProc.WriteBlock([]byte(key), values[key]))
+		}
+		require.NoError(packProc.Commit())
+	}
+
+	// new packfiles have no dictionary until repacking them
+	pr, err := pp.getPack(pp.PackIDs()[0])
+	require.NoError(err)
+	require.Equal(CodecZstd, pr.Codec())
+	require.Nil(pr.Dictionary())
+	pr.release()
+
+	require.NoError(pp.Repack(pp.PackIDs(), ts, 1000))
+
+	packs := pp.PackIDs()
+	require.Len(packs, 1)
+
+	pr, err = pp.getPack(packs[0])
+	require.NoError(err)
+	require.Equal(CodecZstd, pr.Codec())
+	require.NotEmpty(pr.Dictionary())
+	pr.release()
+
+	for k, v := range values {
+		out, err := pp.Get([]byte(k))
+		require.NoError(err)
+		require.Equal(v, out)
+	}
+
+	require.NoError(pp.Close())
+}
+
+func TestConcurrentGet(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+
+	pp, err := NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 1)
+	require.NoError(err)
+	defer pp.Close()
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+
+	// random values, stored without compression
+	const numBlocks = 3000
+	values := make([][]byte, numBlocks)
+	for i := range values {
+		values[i] = make([]byte, 1024)
+		rand.Read(values[i])
+		require.NoError(packProc.WriteBlock([]byte(fmt.Sprint(i)), values[i]))
+	}
+	require.NoError(packProc.Commit())
+
+	errs := make(chan error, 16)
+	for g := 0; g < cap(errs); g++ {
+		go func(g int) {
+			r := rand.New(rand.NewSource(int64(g)))
+			for j := 0; j < 200; j++ {
+				i := r.Intn(numBlocks)
+				v, err := pp.Get([]byte(fmt.Sprint(i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if !bytes.Equal(values[i], v) {
+					errs <- fmt.Errorf("unexpected value for block %d", i)
+					return
+				}
+			}
+
+			errs <- nil
+		}(g)
+	}
+
+	for g := 0; g < cap(errs); g++ {
+		require.NoError(<-errs)
+	}
+}
+
+func TestGetDuringRepack(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+
+	// a single open packfile, so they are evicted while being read
+	pp, err := NewPackPack(path.Join(dir, "packs"), path.Join(dir, "temp"), 1)
+	require.NoError(err)
+	defer pp.Close()
+
+	ts, err := NewTombstonePath(path.Join(dir, "tombstone.bin"))
+	require.NoError(err)
+	defer ts.Close()
+
+	const numPacks, numBlocks = 8, 50
+	for p := 0; p < numPacks; p++ {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		for i := 0; i < numBlocks; i++ {
+			key := []byte(fmt.Sprintf("key%d-%d", p, i))
+			require.NoError(packProc.WriteBlock(key, key))
+		}
+		require.NoError(packProc.Commit())
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	for g := 0; g < cap(errs); g++ {
+		go func(g int) {
+			r := rand.New(rand.NewSource(int64(g)))
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+
+				key := []byte(fmt.Sprintf("key%d-%d", r.Intn(numPacks), r.Intn(numBlocks)))
+				v, err := pp.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if !bytes.Equal(key, v) {
+					errs <- fmt.Errorf("unexpected value for block %s", key)
+					return
+				}
+			}
+		}(g)
+	}
+
+	for _, max := range []int{numBlocks * 2, numBlocks * 4, numBlocks * numPacks} {
+		require.NoError(pp.Repack(pp.PackIDs(), ts, max))
+	}
+
+	close(done)
+	for g := 0; g < cap(errs); g++ {
+		require.NoError(<-errs)
+	}
+
+	require.Len(pp.PackIDs(), 1)
+}
+
 var block = []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}
 
 // TODO improve benchmark reusing previous generated packfiles
@@ -204,3 +820,210 @@ func write(b *testing.B, numElements int) {
 	}
 
 }
+
+func TestRecoverPackPack(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	packs := path.Join(dir, "packs")
+	temp := path.Join(dir, "temp")
+
+	pp, err := NewPackPack(packs, temp, 10)
+	require.NoError(err)
+
+	var ids []string
+	for p := 0; p < 3; p++ {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		key := []byte(fmt.Sprintf("key%d", p))
+		require.NoError(packProc.WriteBlock(key, key))
+		require.NoError(packProc.Commit())
+		ids = append(ids, packProc.processingPackID)
+	}
+
+	// an unfinished batch
+	_, err = pp.NewPackProcessing()
+	require.NoError(err)
+
+	require.NoError(pp.Close())
+
+	// a commit interrupted after moving the packfile but before the index
+	require.NoError(os.Rename(
+		idx.IndexPath(ids[0], packs),
+		idx.IndexProcessingPath(ids[0], temp),
+	))
+
+	// a commit interrupted before moving any file
+	require.NoError(os.Rename(packPath(ids[1], packs), packProcessingPath(ids[1], temp)))
+	require.NoError(os.Rename(
+		idx.IndexPath(ids[1], packs),
+		idx.IndexProcessingPath(ids[1], temp),
+	))
+
+	// a deletion interrupted after removing the index
+	require.NoError(os.Remove(idx.IndexPath(ids[2], packs)))
+
+	j, err := openJournal(iio.OS, path.Join(packs, journalName))
+	require.NoError(err)
+	require.NoError(j.begin(opCommit, ids[0]))
+	require.NoError(j.begin(opCommit, ids[1]))
+	require.NoError(j.begin(opDelete, ids[2]))
+	require.NoError(j.Close())
+
+	// a commit not started yet is rolled back
+	orphan := path.Join(temp, "orphan.idx.writting")
+	require.NoError(os.WriteFile(orphan, []byte("orphan"), 0755))
+
+	pp, err = NewPackPack(packs, temp, 10)
+	require.NoError(err)
+	defer pp.Close()
+
+	require.ElementsMatch(ids[:2], pp.PackIDs())
+
+	for p := 0; p < 2; p++ {
+		key := []byte(fmt.Sprintf("key%d", p))
+		v, err := pp.Get(key)
+		require.NoError(err)
+		require.Equal(key, v)
+	}
+
+	_, err = os.Stat(packPath(ids[2], packs))
+	require.ErrorIs(err, fs.ErrNotExist)
+
+	entries, err := os.ReadDir(temp)
+	require.NoError(err)
+	require.Empty(entries)
+}
+
+func TestDurability(t *testing.T) {
+	require := require.New(t)
+
+	var synced []string
+	var fail string
+	fsys := iio.NewFaultFS(iio.OS)
+	fsys.SetFault(func(op iio.Op, p string) error {
+		if op != iio.OpSync {
+			return nil
+		}
+
+		if p == fail {
+			return errors.New("injected sync failure")
+		}
+
+		synced = append(synced, p)
+		return nil
+	})
+
+	dir := t.TempDir()
+	packs := path.Join(dir, "packs")
+	temp := path.Join(dir, "temp")
+
+	pp, err := NewPackPackFS(fsys, packs, temp, 10)
+	require.NoError(err)
+
+	commit := func(key string) (string, error) {
+		packProc, err := pp.NewPackProcessing()
+		require.NoError(err)
+		require.NoError(packProc.WriteBlock([]byte(key), []byte(key)))
+
+		return packProc.processingPackID, packProc.Commit()
+	}
+
+	pp.SetDurability(iio.DurabilityNone)
+	_, err = commit("none")
+	require.NoError(err)
+	require.Empty(synced)
+
+	pp.SetDurability(iio.DurabilityData)
+	id, err := commit("data")
+	require.NoError(err)
+	require.Equal([]string{
+		packProcessingTxnPath(id, temp),
+		idx.FilterProcessingPath(id, temp),
+		idx.ReverseIndexProcessingPath(id, temp),
+		idx.IndexProcessingPath(id, temp),
+		path.Join(packs, journalName),
+	}, synced)
+
+	synced = nil
+	pp.SetDurability(iio.DurabilityFull)
+	id, err = commit("full")
+	require.NoError(err)
+	require.Equal([]string{
+		packProcessingTxnPath(id, temp),
+		idx.FilterProcessingPath(id, temp),
+		idx.ReverseIndexProcessingPath(id, temp),
+		idx.IndexProcessingPath(id, temp),
+		temp,
+		path.Join(packs, journalName),
+		packs,
+	}, synced)
+
+	// the commit is rolled back, also when opening the packs again
+	fail = packs
+	id, err = commit("failed")
+	require.Error(err)
+	require.NotContains(pp.PackIDs(), id)
+	require.NoError(pp.Close())
+
+	fail = ""
+	pp, err = NewPackPackFS(fsys, packs, temp, 10)
+	require.NoError(err)
+	defer pp.Close()
+
+	require.NotContains(pp.PackIDs(), id)
+
+	_, err = pp.Get([]byte("failed"))
+	require.ErrorIs(err, ErrEntryNotFound)
+}
+
+func TestTornPackWrite(t *testing.T) {
+	require := require.New(t)
+
+	fsys := iio.NewFaultFS(iio.NewMemFS())
+	packs := "/packs"
+	temp := "/temp"
+
+	pp, err := NewPackPackFS(fsys, packs, temp, 10)
+	require.NoError(err)
+
+	packProc, err := pp.NewPackProcessing()
+	require.NoError(err)
+	require.NoError(packProc.WriteBlock([]byte("committed"), []byte("value")))
+	require.NoError(packProc.Commit())
+
+	packProc, err = pp.NewPackProcessing()
+	require.NoError(err)
+	require.NoError(packProc.WriteBlock([]byte("torn"), []byte("value")))
+
+	fsys.SetFault(func(op iio.Op, p string) error {
+		if op == iio.OpWrite && p == packProcessingTxnPath(packProc.processingPackID, temp) {
+			return &iio.TornWrite{N: 3}
+		}
+
+		return nil
+	})
+
+	var tw *iio.TornWrite
+	require.ErrorAs(packProc.Commit(), &tw)
+	require.NoError(pp.Close())
+
+	fsys.SetFault(nil)
+	pp, err = NewPackPackFS(fsys, packs, temp, 10)
+	require.NoError(err)
+	defer pp.Close()
+
+	require.Len(pp.PackIDs(), 1)
+
+	report, err := pp.Check(context.Background())
+	require.NoError(err)
+	require.Empty(report.Problems)
+
+	v, err := pp.Get([]byte("committed"))
+	require.NoError(err)
+	require.Equal([]byte("value"), v)
+
+	has, err := pp.Has([]byte("torn"))
+	require.NoError(err)
+	require.False(has)
+}
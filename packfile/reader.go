@@ -1,141 +1,522 @@
 package packfile
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"os"
+	"sync"
 
+	ihash "github.com/ajnavarro/super-blockstore/hash"
 	"github.com/ajnavarro/super-blockstore/iio"
 	"github.com/klauspost/compress/s2"
+	"go.uber.org/multierr"
 )
 
+// ErrCorruptedBlock is returned when a block doesn't match its checksum.
+var ErrCorruptedBlock = errors.New("corrupted block")
+
+// CorruptedBlockError contains the details of a block that doesn't match its
+// checksum. It matches ErrCorruptedBlock when using errors.Is.
+type CorruptedBlockError struct {
+	Hash     ihash.Hash
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *CorruptedBlockError) Error() string {
+	return fmt.Sprintf("%v %x: expected checksum %08x, got %08x", ErrCorruptedBlock, e.Hash, e.Expected, e.Actual)
+}
+
+func (e *CorruptedBlockError) Unwrap() error {
+	return ErrCorruptedBlock
+}
+
+// ErrInvalidChecksum is returned when a packfile doesn't match the checksum
+// on its footer.
+var ErrInvalidChecksum = errors.New("packfile checksum mismatch")
+
+// File is the packfile storage used by Reader. Data is read by position, so
+// several goroutines can read from the same file.
+type File interface {
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Reader reads blocks from a packfile. Sequential reads using Next, NextBlock,
+// NextHeader, Skip, Reset or Verify must be done from a single goroutine, but
+// ReadValueAt can be called concurrently from any number of them.
 type Reader struct {
-	// TODO buffered reader. maybe separate the seeker from the sequencial reader?
-	rc        io.ReadSeeker
-	c         io.Closer
-	gotHeader bool
+	f    File
+	size int64
+	// index is the s2 index of version 0 packfiles, which are compressed as
+	// a single stream. It is nil on newer ones.
+	index *s2.Index
+
+	// rc is the cursor used for sequential reads.
+	rc      cursor
+	version uint32
+	// start is the position of the first block.
+	start int64
+
+	codec Codec
+	dict  []byte
+	// zstd decodes zstd blocks using the packfile dictionary.
+	zstd *zstdCodec
+
+	skipVerification bool
+
+	// end is the position where blocks end, or -1 if not known yet.
+	end int64
 }
 
-func NewPackFromFile(p string) (*Reader, error) {
-	pf, err := iio.OpenFile(p, os.O_RDONLY, 0755)
+// NewPackFromFile opens the packfile on the given path.
+func NewPackFromFile(fsys iio.FS, p string) (*Reader, error) {
+	pf, err := iio.Open(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(pf)
 	if err != nil {
+		pf.Close()
 		return nil, err
 	}
 
-	return NewReader(pf)
+	return r, nil
 }
 
-func NewReader(rc io.ReadSeekCloser) (*Reader, error) {
-	s2rs, err := s2.NewReader(rc).ReadSeeker(true, nil)
+// NewReader creates a packfile reader, reading and checking the packfile header.
+func NewReader(f File) (*Reader, error) {
+	size, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Reader{
-		rc: s2rs,
-		c:  rc,
-	}, nil
+	pr := &Reader{
+		f:    f,
+		size: size,
+		end:  -1,
+	}
+
+	// packfiles compressed as a single stream don't start with the signature
+	sig := make([]byte, len(packSig))
+	if _, err := f.ReadAt(sig, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(sig, packSig) {
+		pr.index = &s2.Index{}
+		if err := pr.index.LoadStream(io.NewSectionReader(f, 0, size)); err != nil {
+			return nil, err
+		}
+	}
+
+	pr.rc = pr.newCursor()
+
+	if err := pr.readHeader(); err != nil {
+		pr.rc.release()
+		return nil, err
+	}
+
+	return pr, nil
+}
+
+// Version returns the packfile format version.
+func (pr *Reader) Version() uint32 {
+	return pr.version
+}
+
+// Codec returns the codec used to compress blocks. Blocks not reduced by
+// compressing them use CodecNone instead. Version 0 packfiles are compressed
+// as a single stream, so it is CodecNone.
+func (pr *Reader) Codec() Codec {
+	return pr.codec
+}
+
+// Dictionary returns the zstd dictionary used to compress blocks, if any.
+func (pr *Reader) Dictionary() []byte {
+	return pr.dict
 }
 
+// SkipVerification disables checking block checksums when reading values.
+func (pr *Reader) SkipVerification(skip bool) {
+	pr.skipVerification = skip
+}
+
+// Next returns the next block key and value. On version 0 packfiles, the key
+// is the hashed key.
 func (pr *Reader) Next() ([]byte, []byte, error) {
-	if !pr.gotHeader {
-		if err := pr.readHeader(); err != nil {
-			return nil, nil, err
-		}
+	bh, v, err := pr.NextBlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bh.Key, v, nil
+}
+
+// NextBlock returns the next block header and value.
+func (pr *Reader) NextBlock() (*BlockHeader, []byte, error) {
+	if err := pr.checkEnd(); err != nil {
+		return nil, nil, err
 	}
 
-	bh, err := pr.readBlockHeader()
+	return pr.readBlock(pr.rc)
+}
+
+func (pr *Reader) readBlock(r io.Reader) (*BlockHeader, []byte, error) {
+	bh, err := pr.readBlockHeader(r)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	v := make([]byte, bh.Blocksize)
-	_, err = io.ReadFull(pr.rc, v)
+	v, err := pr.readCheckedValue(r, bh)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return bh.Key, v, err
+	return bh, v, nil
 }
 
-func (pr *Reader) Skip() error {
-	if !pr.gotHeader {
-		if err := pr.readHeader(); err != nil {
-			return err
+// readCheckedValue reads the value of the block, checking it against the
+// checksum on its header unless verification is disabled.
+func (pr *Reader) readCheckedValue(r io.Reader, bh *BlockHeader) ([]byte, error) {
+	v, err := pr.readValue(r, bh)
+	if err != nil {
+		return nil, err
+	}
+
+	if pr.version >= packVersionBlocks && !pr.skipVerification {
+		if crc := Checksum(v); crc != bh.Checksum {
+			return nil, &CorruptedBlockError{
+				Hash:     bh.Hash,
+				Expected: bh.Checksum,
+				Actual:   crc,
+			}
 		}
 	}
 
-	bh, err := pr.readBlockHeader()
+	return v, nil
+}
+
+// readValue reads the stored block, decompressing it if needed.
+func (pr *Reader) readValue(r io.Reader, bh *BlockHeader) ([]byte, error) {
+	v := make([]byte, bh.Blocksize)
+	if bh.Codec == CodecNone && bh.storedSize == bh.Blocksize {
+		_, err := io.ReadFull(r, v)
+		return v, err
+	}
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+
+	if _, err := io.CopyN(buf, r, int64(bh.storedSize)); err != nil {
+		return nil, err
+	}
+
+	bc, err := pr.blockCodec(bh.Codec)
 	if err != nil {
+		return nil, err
+	}
+
+	if err := bc.decode(v, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("%w %x: %v", ErrCorruptedBlock, bh.Hash, err)
+	}
+
+	return v, nil
+}
+
+// blockCodec returns the codec used to decode blocks stored using c.
+func (pr *Reader) blockCodec(c Codec) (blockCodec, error) {
+	if c == CodecZstd && pr.zstd != nil {
+		return pr.zstd, nil
+	}
+
+	bc, ok := codecs[c]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownCodec, c)
+	}
+
+	return bc, nil
+}
+
+// skipValue moves the cursor to the next block.
+func (pr *Reader) skipValue(bh *BlockHeader) error {
+	// values are compressed together, so discarding them is as fast as seeking
+	if pr.index != nil {
+		_, err := io.CopyN(io.Discard, pr.rc, int64(bh.storedSize))
+		return err
+	}
+
+	_, err := pr.rc.Seek(int64(bh.storedSize), io.SeekCurrent)
+	return err
+}
+
+// NextHeader returns the next block header, skipping the value.
+func (pr *Reader) NextHeader() (*BlockHeader, error) {
+	bh, err := pr.nextHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pr.skipValue(bh); err != nil {
+		return nil, err
+	}
+
+	return bh, nil
+}
+
+// nextHeader reads the next block header, leaving the cursor at its value.
+// It must be followed by reading or skipping the value.
+func (pr *Reader) nextHeader() (*BlockHeader, error) {
+	if err := pr.checkEnd(); err != nil {
+		return nil, err
+	}
+
+	return pr.readBlockHeader(pr.rc)
+}
+
+// Offset returns the position of the next block.
+func (pr *Reader) Offset() int64 {
+	return pr.rc.Offset()
+}
+
+func (pr *Reader) Skip() error {
+	if err := pr.checkEnd(); err != nil {
 		return err
 	}
 
-	_, err = pr.rc.Seek(int64(bh.Blocksize), io.SeekCurrent)
+	bh, err := pr.readBlockHeader(pr.rc)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return pr.skipValue(bh)
 }
 
+// ReadValueAt returns the key and value of the block at the given position.
+// It is safe for concurrent use, because every call reads the block using its
+// own cursor.
 func (pr *Reader) ReadValueAt(off int64) ([]byte, []byte, error) {
-	_, err := pr.rc.Seek(off, io.SeekStart)
-	if err != nil {
+	c := pr.newCursor()
+	defer c.release()
+
+	if _, err := c.Seek(off, io.SeekStart); err != nil {
 		return nil, nil, err
 	}
 
-	bh, err := pr.readBlockHeader()
+	bh, v, err := pr.readBlock(c)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	v := make([]byte, bh.Blocksize)
-	_, err = io.ReadFull(pr.rc, v)
+	return bh.Key, v, nil
+}
+
+// Reset moves the reader to the first block.
+func (pr *Reader) Reset() error {
+	_, err := pr.rc.Seek(pr.start, io.SeekStart)
+	return err
+}
+
+// checkEnd returns io.EOF if there are no more blocks to read. Version 0
+// packfiles have no footer, so they are read until the end of the stream.
+func (pr *Reader) checkEnd() error {
+	if pr.version == packVersionHashes {
+		return nil
+	}
+
+	end, err := pr.dataEnd()
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+
+	if pr.Offset() >= end {
+		return io.EOF
+	}
+
+	return nil
+}
+
+// dataEnd returns the position where the footer starts.
+func (pr *Reader) dataEnd() (int64, error) {
+	if pr.end >= 0 {
+		return pr.end, nil
+	}
+
+	// the footer contains the sequence number and the checksum
+	end := pr.size - 8 - ihash.KeySize
+	if end < pr.start {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	pr.end = end
+
+	return end, nil
+}
+
+// Verify reads the whole packfile checking it against the checksum on its
+// footer, and returns that checksum. Version 0 packfiles have no footer, so
+// nothing is checked. After calling it, blocks are read again from the
+// beginning.
+func (pr *Reader) Verify() (ihash.Hash, error) {
+	var sum ihash.Hash
+	if pr.version == packVersionHashes {
+		return sum, nil
+	}
+
+	end, err := pr.dataEnd()
+	if err != nil {
+		return sum, err
+	}
+
+	if _, err := pr.rc.Seek(0, io.SeekStart); err != nil {
+		return sum, err
+	}
+
+	// the checksum also covers the sequence number
+	h := sha256.New()
+	if _, err := io.CopyN(h, pr.rc, end+8); err != nil {
+		return sum, err
+	}
+
+	if _, err := io.ReadFull(pr.rc, sum[:]); err != nil {
+		return sum, err
+	}
+
+	if !bytes.Equal(sum[:], h.Sum(nil)) {
+		return sum, ErrInvalidChecksum
+	}
+
+	return sum, pr.Reset()
+}
+
+// Sequence returns the sequence number of the packfile commit, stored on its
+// footer. It returns false on version 0 packfiles, which do not have it.
+func (pr *Reader) Sequence() (uint64, bool, error) {
+	if pr.version == packVersionHashes {
+		return 0, false, nil
+	}
+
+	end, err := pr.dataEnd()
+	if err != nil {
+		return 0, false, err
 	}
 
-	return bh.Key, v, err
+	var b [8]byte
+	if _, err := pr.f.ReadAt(b[:], end); err != nil {
+		return 0, false, err
+	}
+
+	return binary.BigEndian.Uint64(b[:]), true, nil
 }
 
 func (pr *Reader) Close() error {
-	return pr.c.Close()
+	pr.rc.release()
+
+	var err error
+	if pr.zstd != nil {
+		err = pr.zstd.close()
+	}
+
+	return multierr.Combine(err, pr.f.Close())
 }
 
 type BlockHeader struct {
-	Key       []byte
+	// Hash is the hashed key.
+	Hash ihash.Hash
+	// Key is the original key. On version 0 packfiles, or if the original key
+	// is unknown, it contains the hashed key.
+	Key []byte
+	// Checksum is the CRC32C of the block. It is zero on version 0
+	// packfiles.
+	Checksum  uint32
 	Blocksize uint32
+	// Codec is the codec used to store the block. Version 0 packfiles are
+	// compressed as a single stream, so it is always CodecNone.
+	Codec Codec
+
+	// storedSize is the size of the block as it is stored.
+	storedSize uint32
 }
 
-func (pr *Reader) readBlockHeader() (*BlockHeader, error) {
-	//block_header:
-	//	key:[32]bytes (sha256)
-	//	blocksize:uint64
-	key := make([]byte, 32)
+// OriginalKey returns the original key, or nil if it is unknown.
+func (bh *BlockHeader) OriginalKey() []byte {
+	if bytes.Equal(bh.Key, bh.Hash[:]) {
+		return nil
+	}
 
-	if _, err := io.ReadFull(pr.rc, key); err != nil {
+	return bh.Key
+}
+
+func (pr *Reader) readBlockHeader(r io.Reader) (*BlockHeader, error) {
+	//block_header:
+	//	key_hash:[32]bytes (sha256)
+	//	key_size:uint32 (version >= 1)
+	//	key:[]byte (version >= 1)
+	//	checksum:uint32 (version >= 1)
+	//	blocksize:uint32
+	//	codec:uint8 (version >= 1)
+	//	stored_size:uint32 (version >= 1)
+	bh := &BlockHeader{}
+
+	if _, err := io.ReadFull(r, bh.Hash[:]); err != nil {
 		return nil, err
 	}
 
-	var blocksize uint32
-	if err := binary.Read(pr.rc, binary.BigEndian, &blocksize); err != nil {
+	if pr.version == packVersionHashes {
+		bh.Key = make([]byte, ihash.KeySize)
+		copy(bh.Key, bh.Hash[:])
+
+		if err := binary.Read(r, binary.BigEndian, &bh.Blocksize); err != nil {
+			return nil, err
+		}
+
+		bh.storedSize = bh.Blocksize
+
+		return bh, nil
+	}
+
+	var keySize uint32
+	if err := binary.Read(r, binary.BigEndian, &keySize); err != nil {
 		return nil, err
 	}
 
-	// TODO check CRC
+	if keySize > 0 {
+		bh.Key = make([]byte, keySize)
+		if _, err := io.ReadFull(r, bh.Key); err != nil {
+			return nil, err
+		}
+	} else {
+		bh.Key = make([]byte, ihash.KeySize)
+		copy(bh.Key, bh.Hash[:])
+	}
+
+	for _, v := range []any{&bh.Checksum, &bh.Blocksize, &bh.Codec, &bh.storedSize} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
 
-	return &BlockHeader{
-		Key:       key,
-		Blocksize: blocksize,
-	}, nil
+	return bh, nil
 }
 
+// maxDictionarySize is the maximum size of a dictionary on a valid packfile
+// header.
+const maxDictionarySize = 16 << 20
+
 func (pr *Reader) readHeader() error {
 	// header:
 	//   "SPB" magic key:3 bytes
 	//   version:uint32
+	//   codec:uint8 (version >= 1)
+	//   dictionary_size:uint32 (version >= 1)
+	//   dictionary:[]bytes (version >= 1)
 
 	h := make([]byte, 3)
 	if _, err := io.ReadFull(pr.rc, h); err != nil {
@@ -151,11 +532,226 @@ func (pr *Reader) readHeader() error {
 		return err
 	}
 
-	if version != packVersion {
+	if version > packVersion {
 		return errors.New("version not supported")
 	}
 
-	pr.gotHeader = true
+	// only version 0 packfiles are compressed as a single stream
+	if (pr.index != nil) != (version == packVersionHashes) {
+		return errors.New("unexpected packfile container")
+	}
+
+	pr.version = version
+
+	if version >= packVersionBlocks {
+		if err := pr.readCodec(); err != nil {
+			return err
+		}
+	}
+
+	pr.start = pr.rc.Offset()
 
 	return nil
 }
+
+func (pr *Reader) readCodec() error {
+	if err := binary.Read(pr.rc, binary.BigEndian, &pr.codec); err != nil {
+		return err
+	}
+
+	var dictSize uint32
+	if err := binary.Read(pr.rc, binary.BigEndian, &dictSize); err != nil {
+		return err
+	}
+
+	if dictSize > maxDictionarySize {
+		return errors.New("dictionary too big")
+	}
+
+	if dictSize > 0 {
+		pr.dict = make([]byte, dictSize)
+		if _, err := io.ReadFull(pr.rc, pr.dict); err != nil {
+			return err
+		}
+	}
+
+	if pr.codec != CodecZstd {
+		if pr.dict != nil {
+			return fmt.Errorf("dictionaries are not supported by %v", pr.codec)
+		}
+
+		return nil
+	}
+
+	z, err := newZstdDecoder(pr.dict)
+	if err != nil {
+		return err
+	}
+
+	pr.zstd = z
+
+	return nil
+}
+
+// cursor reads the packfile contents from any position.
+type cursor interface {
+	io.ReadSeeker
+	// Offset returns the actual position.
+	Offset() int64
+	// release returns the resources used by the cursor to their pool.
+	release()
+}
+
+// newCursor returns a new cursor at the beginning of the packfile. Cursors
+// read by position from the packfile, so they do not share any state.
+func (pr *Reader) newCursor() cursor {
+	if pr.index != nil {
+		d := decoders.Get().(*s2.Reader)
+		d.Reset(io.NewSectionReader(pr.f, 0, pr.size))
+
+		return &streamCursor{pr: pr, d: d}
+	}
+
+	br := bufReaders.Get().(*bufio.Reader)
+	br.Reset(io.NewSectionReader(pr.f, 0, pr.size))
+
+	return &rawCursor{pr: pr, br: br}
+}
+
+// decoders reuses s2 decoders between cursors.
+var decoders = sync.Pool{
+	New: func() any {
+		return s2.NewReader(nil, s2.ReaderIgnoreStreamIdentifier())
+	},
+}
+
+// streamCursor reads the uncompressed stream of version 0 packfiles. Seeking
+// uses the s2 index to start decompressing from the closest chunk.
+type streamCursor struct {
+	pr  *Reader
+	d   *s2.Reader
+	pos int64
+}
+
+func (c *streamCursor) Read(b []byte) (int, error) {
+	n, err := c.d.Read(b)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *streamCursor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.pr.index.TotalUncompressed
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+
+	compressed, uncompressed, err := c.pr.index.Find(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	// moving forward from a position after the closest chunk, so the stream
+	// is already in place
+	if uncompressed <= c.pos && c.pos <= offset {
+		if err := c.d.Skip(offset - c.pos); err != nil {
+			return 0, err
+		}
+
+		c.pos = offset
+
+		return offset, nil
+	}
+
+	c.d.Reset(io.NewSectionReader(c.pr.f, compressed, c.pr.size-compressed))
+	if err := c.d.Skip(offset - uncompressed); err != nil {
+		return 0, err
+	}
+
+	c.pos = offset
+
+	return offset, nil
+}
+
+func (c *streamCursor) Offset() int64 {
+	return c.pos
+}
+
+func (c *streamCursor) release() {
+	if c.d == nil {
+		return
+	}
+
+	c.d.Reset(nil)
+	decoders.Put(c.d)
+	c.d = nil
+}
+
+// bufReaders reuses buffered readers between cursors.
+var bufReaders = sync.Pool{
+	New: func() any {
+		return bufio.NewReader(nil)
+	},
+}
+
+// rawCursor reads packfiles from version 1, where blocks are compressed
+// independently.
+type rawCursor struct {
+	pr  *Reader
+	br  *bufio.Reader
+	pos int64
+}
+
+func (c *rawCursor) Read(b []byte) (int, error) {
+	n, err := c.br.Read(b)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *rawCursor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.pr.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+
+	// moving forward inside the buffered data
+	if offset >= c.pos && offset-c.pos <= int64(c.br.Buffered()) {
+		if _, err := c.br.Discard(int(offset - c.pos)); err != nil {
+			return 0, err
+		}
+
+		c.pos = offset
+
+		return offset, nil
+	}
+
+	c.br.Reset(io.NewSectionReader(c.pr.f, offset, c.pr.size-offset))
+	c.pos = offset
+
+	return offset, nil
+}
+
+func (c *rawCursor) Offset() int64 {
+	return c.pos
+}
+
+func (c *rawCursor) release() {
+	if c.br == nil {
+		return
+	}
+
+	c.br.Reset(nil)
+	bufReaders.Put(c.br)
+	c.br = nil
+}
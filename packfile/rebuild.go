@@ -0,0 +1,79 @@
+package packfile
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ajnavarro/super-blockstore/idx"
+	"github.com/ajnavarro/super-blockstore/iio"
+	"go.uber.org/multierr"
+)
+
+// RebuildIndex reads the packfile on packPath and writes its index into
+// idxPath. The sequence number is read from the packfile footer. Version 0
+// packfiles do not have it, so it is set to zero, as on indexes older than
+// version 2.
+func RebuildIndex(fsys iio.FS, packPath, idxPath string) error {
+	w := idx.NewIndexWriter()
+	if err := rebuildIndexFromFile(fsys, packPath, w); err != nil {
+		return err
+	}
+
+	return idx.WriteIndex(fsys, w, idxPath)
+}
+
+// rebuildIndex adds the entries of a packfile into the index writer. It is
+// used by the packfile indexes to rebuild the missing ones.
+func (pp *PackPack) rebuildIndex(packName string, w *idx.IndexWriter) error {
+	if err := rebuildIndexFromFile(pp.fsys, packPath(packName, pp.path), w); err != nil {
+		return fmt.Errorf("rebuilding index of pack %s: %w", packName, err)
+	}
+
+	return nil
+}
+
+func rebuildIndexFromFile(fsys iio.FS, packPath string, w *idx.IndexWriter) error {
+	r, err := NewPackFromFile(fsys, packPath)
+	if err != nil {
+		return err
+	}
+
+	return multierr.Combine(indexBlocks(r, w), r.Close())
+}
+
+// indexBlocks checks the packfile checksum and adds all its blocks into the
+// index writer, reading them one by one. Block checksums are checked when
+// reading them. The sequence number is only set if the packfile has it.
+func indexBlocks(r *Reader, w *idx.IndexWriter) error {
+	sum, err := r.Verify()
+	if err != nil {
+		return err
+	}
+
+	seq, ok, err := r.Sequence()
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		w.SetSequence(seq)
+	}
+
+	for {
+		off := r.Offset()
+		bh, _, err := r.NextBlock()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		w.AddRaw(bh.Hash, bh.Checksum, uint64(off), bh.Blocksize)
+	}
+
+	w.SetPackChecksum(sum)
+
+	return nil
+}
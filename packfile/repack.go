@@ -0,0 +1,291 @@
+package packfile
+
+import (
+	"errors"
+	"io"
+	"sort"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/idx"
+	"go.uber.org/multierr"
+)
+
+// Repack rewrites the given packfiles removing deleted blocks, and joining
+// them into packfiles containing maxElements blocks at most. Packfiles without
+// deleted blocks and already containing maxElements blocks are left as they
+// are.
+//
+// Source packfiles are deleted only when all their blocks are available on
+// a committed packfile, so blocks can be read at any time during the process.
+//
+// Output packfiles keep the highest sequence number from their sources, so
+// deletions done after starting the repack still apply to their blocks.
+// Blocks with a newer copy on any other packfile are dropped, so they do not
+// shadow it once they get that sequence number.
+//
+// If the compression codec is zstd and dictionaries are enabled, a dictionary
+// is trained from a sample of the blocks and used by all the output packfiles.
+func (pp *PackPack) Repack(packs []string, ts *Tombstone, maxElements int) error {
+	var candidates []string
+	var dirty bool
+	for _, p := range packs {
+		count, deleted, err := pp.packStatus(p, ts)
+		if err != nil {
+			return err
+		}
+
+		if !deleted && count >= maxElements {
+			continue
+		}
+
+		dirty = dirty || deleted
+		candidates = append(candidates, p)
+	}
+
+	// a single packfile without deleted blocks cannot be improved
+	if len(candidates) == 0 || (len(candidates) == 1 && !dirty) {
+		return nil
+	}
+
+	// the latest copy of a block is the one kept
+	sort.Slice(candidates, func(i, j int) bool {
+		si, sj := pp.Sequence(candidates[i]), pp.Sequence(candidates[j])
+		if si != sj {
+			return si > sj
+		}
+
+		return candidates[i] > candidates[j]
+	})
+
+	dict, err := pp.trainDictionary(candidates)
+	if err != nil {
+		return err
+	}
+
+	r := &repacker{
+		pp:          pp,
+		ts:          ts,
+		maxElements: maxElements,
+		seen:        make(map[ihash.Hash]struct{}),
+		dict:        dict,
+	}
+
+	for _, p := range candidates {
+		if err := r.add(p); err != nil {
+			return r.discard(err)
+		}
+	}
+
+	return r.close()
+}
+
+// trainDictionary trains a zstd dictionary using blocks from the given
+// packfiles. The same amount of data is sampled from each packfile. It returns
+// nil if dictionaries are not enabled.
+func (pp *PackPack) trainDictionary(packs []string) ([]byte, error) {
+	c := pp.compression
+	if c.Codec != CodecZstd || c.DictionarySize <= 0 {
+		return nil, nil
+	}
+
+	perPack := c.DictionarySize * DictionarySampleRatio / len(packs)
+
+	var samples [][]byte
+	for _, p := range packs {
+		pr, err := NewPackFromFile(pp.fsys, packPath(p, pp.path))
+		if err != nil {
+			return nil, err
+		}
+
+		var size int
+		for size < perPack {
+			_, v, err := pr.Next()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				pr.Close()
+				return nil, err
+			}
+
+			samples = append(samples, v)
+			size += len(v)
+		}
+
+		if err := pr.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return TrainDictionary(samples, c.DictionarySize)
+}
+
+// packStatus returns the number of blocks in a packfile and if any of them
+// was deleted.
+func (pp *PackPack) packStatus(packName string, ts *Tombstone) (int, bool, error) {
+	seq := pp.Sequence(packName)
+
+	var count int
+	var deleted bool
+	err := pp.idx.ForEach(packName, func(e *idx.Entry) error {
+		count++
+		if deleted {
+			return nil
+		}
+
+		var err error
+		deleted, err = ts.Deleted(e.Key, seq)
+		return err
+	})
+
+	return count, deleted, err
+}
+
+type repacker struct {
+	pp          *PackPack
+	ts          *Tombstone
+	maxElements int
+
+	// seen contains all the written blocks, to avoid duplicates
+	seen map[ihash.Hash]struct{}
+	// dict is the zstd dictionary used by output packfiles
+	dict []byte
+
+	out *PackProcessing
+	// maxSeq is the highest sequence number from the read packfiles
+	maxSeq uint64
+	// processed contains the packfiles completely read that can be deleted
+	// after committing the output packfile
+	processed []string
+}
+
+func (r *repacker) add(packName string) error {
+	pr, err := NewPackFromFile(r.pp.fsys, packPath(packName, r.pp.path))
+	if err != nil {
+		return err
+	}
+
+	defer pr.Close()
+
+	seq := r.pp.Sequence(packName)
+	if seq > r.maxSeq {
+		r.maxSeq = seq
+	}
+
+	for {
+		bh, v, err := pr.NextBlock()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, ok := r.seen[bh.Hash]; ok {
+			continue
+		}
+
+		drop, err := r.shadowed(bh.Hash, seq)
+		if err != nil {
+			return err
+		}
+
+		if drop {
+			continue
+		}
+
+		if err := r.write(bh, v); err != nil {
+			return err
+		}
+	}
+
+	r.processed = append(r.processed, packName)
+
+	return nil
+}
+
+// shadowed returns true if the block from a packfile with the given sequence
+// number was deleted, or if there is a copy of it on a newer packfile. Newer
+// candidates were already read, so that copy is either written or deleted.
+func (r *repacker) shadowed(h ihash.Hash, seq uint64) (bool, error) {
+	deleted, err := r.ts.Deleted(h, seq)
+	if err != nil || deleted {
+		return deleted, err
+	}
+
+	_, _, _, err = r.pp.idx.FindFrom(h, seq+1)
+	if errors.Is(err, idx.ErrEntryNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (r *repacker) write(bh *BlockHeader, v []byte) error {
+	if r.out == nil {
+		out, err := r.pp.newPackProcessing(r.dict)
+		if err != nil {
+			return err
+		}
+
+		r.out = out
+	}
+
+	if err := r.out.WriteHashedBlock(bh.Hash, bh.OriginalKey(), v); err != nil {
+		return err
+	}
+
+	r.seen[bh.Hash] = struct{}{}
+
+	if r.out.Count() < r.maxElements {
+		return nil
+	}
+
+	return r.flush()
+}
+
+// flush commits the output packfile and deletes all the completely processed
+// packfiles.
+func (r *repacker) flush() error {
+	if r.out != nil {
+		r.out.SetSequence(r.maxSeq)
+		if err := r.out.Commit(); err != nil {
+			return err
+		}
+
+		r.out = nil
+	}
+
+	for _, p := range r.processed {
+		if err := r.pp.DeletePack(p); err != nil {
+			return err
+		}
+	}
+
+	r.processed = nil
+
+	return nil
+}
+
+func (r *repacker) close() error {
+	if r.out != nil && r.out.Count() == 0 {
+		if err := r.out.Discard(); err != nil {
+			return err
+		}
+
+		r.out = nil
+	}
+
+	return r.flush()
+}
+
+// discard removes the output packfile without deleting any source one.
+func (r *repacker) discard(err error) error {
+	if r.out == nil {
+		return err
+	}
+
+	return multierr.Combine(err, r.out.Discard())
+}
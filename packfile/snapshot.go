@@ -0,0 +1,128 @@
+package packfile
+
+import (
+	"errors"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/idx"
+	"go.uber.org/multierr"
+)
+
+// Snapshot is a read only view of the packfiles committed when it was taken.
+// Packfiles committed after that are not visible through it. Its packfiles
+// are pinned until it is released: the ones removed by a repack in the
+// meantime are kept on disk for the snapshot.
+type Snapshot struct {
+	pp    *PackPack
+	ids   []string
+	packs map[string]struct{}
+}
+
+// Snapshot returns a view of the currently committed packfiles.
+func (pp *PackPack) Snapshot() *Snapshot {
+	pp.pinMu.Lock()
+	defer pp.pinMu.Unlock()
+
+	ids := pp.idx.PackIDs()
+	packs := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		packs[id] = struct{}{}
+		pp.pins[id]++
+	}
+
+	return &Snapshot{pp: pp, ids: ids, packs: packs}
+}
+
+// Release unpins the packfiles on the snapshot, removing the ones retired
+// while it was in use. The snapshot must not be used after that.
+func (s *Snapshot) Release() error {
+	return s.pp.unpin(s.ids)
+}
+
+// unpin releases a pin of each packfile, removing the retired ones that are
+// not pinned anymore.
+func (pp *PackPack) unpin(ids []string) error {
+	pp.pinMu.Lock()
+	defer pp.pinMu.Unlock()
+
+	var err error
+	for _, id := range ids {
+		pp.pins[id]--
+		if pp.pins[id] > 0 {
+			continue
+		}
+
+		delete(pp.pins, id)
+		if pp.idx.Retired(id) {
+			err = multierr.Append(err, pp.deletePack(id))
+		}
+	}
+
+	return err
+}
+
+// PackIDs returns the IDs of the packfiles on the snapshot.
+func (s *Snapshot) PackIDs() []string {
+	return append([]string(nil), s.ids...)
+}
+
+// GetFrom returns the value from the latest packfile on the snapshot with a
+// sequence number equal or greater than minSeq.
+func (s *Snapshot) GetFrom(key []byte, minSeq uint64) ([]byte, error) {
+	packName, offset, _, err := s.find(key, minSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := s.pp.getPack(packName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pr.release()
+
+	_, v, err := pr.ReadValueAt(offset)
+	return v, err
+}
+
+// HasFrom checks if the key is on any packfile on the snapshot with a
+// sequence number equal or greater than minSeq.
+func (s *Snapshot) HasFrom(key []byte, minSeq uint64) (bool, error) {
+	_, _, _, err := s.find(key, minSeq)
+	if errors.Is(err, ErrEntryNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetSizeFrom returns the size of the value from the latest packfile on the
+// snapshot with a sequence number equal or greater than minSeq.
+func (s *Snapshot) GetSizeFrom(key []byte, minSeq uint64) (uint32, error) {
+	_, _, size, err := s.find(key, minSeq)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (s *Snapshot) find(key []byte, minSeq uint64) (string, int64, uint32, error) {
+	packName, offset, size, err := s.pp.idx.FindIn(ihash.SumBytes(key), minSeq, s.packs)
+	if errors.Is(err, idx.ErrEntryNotFound) {
+		return "", 0, 0, ErrEntryNotFound
+	}
+
+	return packName, offset, size, err
+}
+
+// NewIter returns an iterator over the packfiles on the snapshot, newest
+// first. If keysOnly is true, values are skipped and only keys and sizes are
+// returned.
+func (s *Snapshot) NewIter(keysOnly bool) *Iter {
+	return newIter(s.pp, s.PackIDs(), keysOnly)
+}
@@ -3,113 +3,603 @@ package packfile
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
+	"io/fs"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+
+	"go.uber.org/multierr"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
 )
 
-// TODO add LRU cache
-// TODO add binary search on disk file to avoid have all on memory
-type Tombstone struct {
-	f *os.File
-	w *bufio.Writer
+/*
+format tombstone:
+
+The tombstone is split in a base file, sorted and mapped in memory, and a
+delta file where new deletions are appended. When the delta file reaches
+maxDelta keys it is merged into a new base file in the background.
+
+base file:
+ header:
+  "SPT" magic key:3 bytes
+  version:uint32
+  count:uint64
+  last_sequence:uint64
+  fanout:[256]uint32
+ entries, sorted by key_hash:
+  key_hash:[32]bytes (sha256)
+  sequence:uint64
+
+delta file:
+ header:
+  "SPT" magic key:3 bytes
+  version:uint32
+ entries:
+  key_hash:[32]bytes (sha256)
+  sequence:uint64
+
+Base files from version 0 and 1 contain the entries in insertion order, like
+delta files. Version 0 files have no header, and entries only contain the key
+hash. They are converted to the actual version when opened.
+*/
+
+var tombstoneSig []byte = []byte{'S', 'P', 'T'}
+var tombstoneVersion uint32 = 2
+var tombstoneDeltaVersion uint32 = 1
+
+const tombstoneHeaderSize = 7
+const tombstoneBaseHeaderSize = tombstoneHeaderSize + 8 + 8 + 256*4
+const tombstoneEntrySize = ihash.KeySize + 8
+
+// defaultMaxDelta is the number of keys kept on the delta before merging them
+// into the base file.
+const defaultMaxDelta = 64 * 1024
 
-	keys   [][]ihash.Hash
-	sorted []bool
+type Tombstone struct {
+	mu sync.RWMutex
+
+	fsys iio.FS
+	path string
+	base *tombstoneBase
+
+	delta iio.File
+	w     *bufio.Writer
+	// deltaKeys contains the sequence number of the last deletion of every
+	// key on the delta file
+	deltaKeys map[ihash.Hash]uint64
+	// frozen contains the keys of the delta being merged into the base file
+	frozen  map[ihash.Hash]uint64
+	lastSeq uint64
+
+	maxDelta   int
+	durability iio.Durability
+	merging    bool
+	mergeErr   error
+	wg         sync.WaitGroup
+	// mergeMu avoids concurrent base file rewrites
+	mergeMu sync.Mutex
 }
 
+// NewTombstonePath opens the tombstone on the given path of the OS
+// filesystem, creating it if needed.
 func NewTombstonePath(f string) (*Tombstone, error) {
-	fil, err := os.OpenFile(f, os.O_CREATE|os.O_RDWR, 0755)
+	return NewTombstoneFS(iio.OS, f)
+}
+
+// NewTombstoneFS opens the tombstone on the given path, creating it if
+// needed.
+func NewTombstoneFS(fsys iio.FS, f string) (*Tombstone, error) {
+	ts := &Tombstone{
+		fsys:       fsys,
+		path:       f,
+		deltaKeys:  make(map[ihash.Hash]uint64),
+		maxDelta:   defaultMaxDelta,
+		durability: iio.DurabilityFull,
+	}
+
+	if err := ts.open(); err != nil {
+		return nil, multierr.Combine(err, ts.close())
+	}
+
+	return ts, nil
+}
+
+func (ts *Tombstone) deltaPath() string {
+	return ts.path + ".delta"
+}
+
+func (ts *Tombstone) frozenPath() string {
+	return ts.path + ".delta.old"
+}
+
+func (ts *Tombstone) tmpPath() string {
+	return ts.path + ".tmp"
+}
+
+func (ts *Tombstone) open() error {
+	// remove leftovers from an interrupted merge
+	if err := iio.RemoveIfExists(ts.fsys, ts.tmpPath()); err != nil {
+		return err
+	}
+
+	if err := ts.upgrade(); err != nil {
+		return err
+	}
+
+	base, err := openTombstoneBase(ts.fsys, ts.path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	ts := &Tombstone{
-		f:      fil,
-		w:      bufio.NewWriter(fil),
-		keys:   make([][]ihash.Hash, 256),
-		sorted: make([]bool, 256),
+	ts.base = base
+	ts.lastSeq = base.lastSeq
+
+	// a merge was interrupted, so it is done again
+	frozen, err := readDeltaFile(ts.fsys, ts.frozenPath())
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range frozen {
+		ts.observe(seq)
+	}
+
+	ts.frozen = frozen
+
+	if err := ts.openDelta(); err != nil {
+		return err
 	}
 
-	return ts, ts.load(fil)
+	return ts.merge()
 }
 
-func (ts *Tombstone) load(f *os.File) error {
-	for {
-		var k ihash.Hash
-		_, err := io.ReadFull(f, k[:])
-		if err == io.EOF {
-			break
+// upgrade converts base files from previous versions to the actual one, and
+// creates the base file if it does not exist.
+func (ts *Tombstone) upgrade() error {
+	keys := make(map[ihash.Hash]uint64)
+
+	f, err := iio.Open(ts.fsys, ts.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ts.writeBase(nil, 0)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	add := func(k ihash.Hash, seq uint64) {
+		addEntry(keys, k, seq)
+	}
+
+	r := bufio.NewReader(f)
+	header, err := r.Peek(tombstoneHeaderSize)
+	switch {
+	case err == io.EOF && len(header) == 0:
+	case err == nil && bytes.Equal(header[:len(tombstoneSig)], tombstoneSig):
+		version, err := readTombstoneHeader(r)
+		if err != nil {
+			return err
+		}
+
+		if version == tombstoneVersion {
+			return nil
+		}
+
+		if version != tombstoneDeltaVersion {
+			return errors.New("version not supported")
+		}
+
+		if _, err := readEntries(r, version, add); err != nil {
+			return err
+		}
+	default:
+		if _, err := readEntries(r, 0, add); err != nil {
+			return err
+		}
+	}
+
+	var lastSeq uint64
+	for _, seq := range keys {
+		if seq > lastSeq {
+			lastSeq = seq
+		}
+	}
+
+	return ts.writeBase(sortEntries(keys), lastSeq)
+}
+
+// writeBase replaces the base file with a new one containing the given
+// sorted entries.
+func (ts *Tombstone) writeBase(entries []tombstoneEntry, lastSeq uint64) error {
+	empty := &tombstoneBase{}
+	if err := empty.merge(ts.fsys, ts.durability, ts.tmpPath(), entries, lastSeq, nil); err != nil {
+		return err
+	}
+
+	if err := ts.fsys.Rename(ts.tmpPath(), ts.path); err != nil {
+		return err
+	}
+
+	return ts.durability.SyncDir(ts.fsys, filepath.Dir(ts.path))
+}
+
+// openDelta opens the delta file, loading all the keys on it.
+func (ts *Tombstone) openDelta() error {
+	f, err := iio.OpenFile(ts.fsys, ts.deltaPath(), os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+
+	ts.delta = f
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() < tombstoneHeaderSize {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+
+		if err := writeTombstoneHeader(f, tombstoneDeltaVersion); err != nil {
+			return err
+		}
+	} else {
+		r := bufio.NewReader(f)
+		version, err := readTombstoneHeader(r)
+		if err != nil {
+			return err
+		}
 
+		if version != tombstoneDeltaVersion {
+			return errors.New("version not supported")
 		}
 
+		n, err := readEntries(r, version, ts.addDelta)
 		if err != nil {
 			return err
 		}
 
-		if err := ts.AddHash(k); err != nil {
+		// remove a partially written entry
+		if err := f.Truncate(tombstoneHeaderSize + n*tombstoneEntrySize); err != nil {
 			return err
 		}
 	}
 
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	ts.w = bufio.NewWriter(f)
+
 	return nil
 }
 
-// AddHash adds a hash directly to the list.
-func (ts *Tombstone) AddHash(k ihash.Hash) error {
-	ts.sorted[k[0]] = false
+func readDeltaFile(fsys iio.FS, p string) (map[ihash.Hash]uint64, error) {
+	f, err := iio.Open(fsys, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
 
-	_, err := ts.w.Write(k[:])
+	r := bufio.NewReader(f)
+	version, err := readTombstoneHeader(r)
 	if err != nil {
+		return nil, err
+	}
+
+	if version != tombstoneDeltaVersion {
+		return nil, errors.New("version not supported")
+	}
+
+	keys := make(map[ihash.Hash]uint64)
+	_, err = readEntries(r, version, func(k ihash.Hash, seq uint64) {
+		addEntry(keys, k, seq)
+	})
+
+	return keys, err
+}
+
+func writeTombstoneHeader(w io.Writer, version uint32) error {
+	if _, err := w.Write(tombstoneSig); err != nil {
 		return err
 	}
 
+	return binary.Write(w, binary.BigEndian, version)
+}
+
+func readTombstoneHeader(r io.Reader) (uint32, error) {
+	header := make([]byte, tombstoneHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(header[:len(tombstoneSig)], tombstoneSig) {
+		return 0, errors.New("signature doesn't match")
+	}
+
+	return binary.BigEndian.Uint32(header[len(tombstoneSig):]), nil
+}
+
+// readEntries calls fn for every entry until the end of the reader. It
+// returns the number of complete entries read, ignoring a partially written
+// one at the end.
+func readEntries(r io.Reader, version uint32, fn func(k ihash.Hash, seq uint64)) (int64, error) {
+	size := tombstoneEntrySize
+	if version == 0 {
+		size = ihash.KeySize
+	}
+
+	var n int64
+	var entry [tombstoneEntrySize]byte
+	for {
+		_, err := io.ReadFull(r, entry[:size])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		var k ihash.Hash
+		copy(k[:], entry[:])
+
+		var seq uint64
+		if version != 0 {
+			seq = binary.BigEndian.Uint64(entry[ihash.KeySize:])
+		}
+
+		fn(k, seq)
+		n++
+	}
+}
+
+func writeEntry(w io.Writer, k ihash.Hash, seq uint64) error {
+	var entry [tombstoneEntrySize]byte
+	copy(entry[:], k[:])
+	binary.BigEndian.PutUint64(entry[ihash.KeySize:], seq)
+
+	_, err := w.Write(entry[:])
+	return err
+}
+
+func addEntry(keys map[ihash.Hash]uint64, k ihash.Hash, seq uint64) {
+	if last, ok := keys[k]; !ok || seq > last {
+		keys[k] = seq
+	}
+}
+
+func (ts *Tombstone) addDelta(k ihash.Hash, seq uint64) {
+	addEntry(ts.deltaKeys, k, seq)
+	ts.observe(seq)
+}
+
+func (ts *Tombstone) observe(seq uint64) {
+	if seq > ts.lastSeq {
+		ts.lastSeq = seq
+	}
+}
+
+// AddHash adds a hash directly to the list, deleted with the given sequence
+// number.
+func (ts *Tombstone) AddHash(k ihash.Hash, seq uint64) error {
+	return ts.AddHashes([]ihash.Hash{k}, seq)
+}
+
+// AddHashes adds several hashes to the list, all of them deleted with the
+// given sequence number. Lookups see all of them or none.
+func (ts *Tombstone) AddHashes(keys []ihash.Hash, seq uint64) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, k := range keys {
+		if err := writeEntry(ts.w, k, seq); err != nil {
+			return err
+		}
+	}
+
 	if err := ts.w.Flush(); err != nil {
 		return err
 	}
 
-	ts.keys[k[0]] = append(ts.keys[k[0]], k)
+	for _, k := range keys {
+		ts.addDelta(k, seq)
+	}
 
-	return nil
+	if len(ts.deltaKeys) < ts.maxDelta || ts.merging {
+		return nil
+	}
+
+	return ts.startMerge()
+}
+
+// SetDurability sets which data is synced to disk when replacing the
+// tombstone files. It defaults to iio.DurabilityFull.
+func (ts *Tombstone) SetDurability(d iio.Durability) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.durability = d
+}
+
+// Sync makes durable all the deletions added before.
+func (ts *Tombstone) Sync() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.delta.Sync()
 }
 
 // AddKey adds any key to the deleted list. It will be converted as SHA256
-func (ts *Tombstone) AddKey(key []byte) error {
-	return ts.AddHash(ihash.SumBytes(key))
+func (ts *Tombstone) AddKey(key []byte, seq uint64) error {
+	return ts.AddHash(ihash.SumBytes(key), seq)
 }
 
-func (ts *Tombstone) HasHash(k ihash.Hash) (bool, error) {
-	bucketLen := len(ts.keys[k[0]])
-	if bucketLen == 0 {
-		return false, nil
+// startMerge merges the delta into the base file in the background. New
+// deletions are written into a new delta meanwhile. If a previous merge
+// failed, its delta is merged first.
+func (ts *Tombstone) startMerge() error {
+	if ts.frozen == nil {
+		if err := ts.freeze(); err != nil {
+			return err
+		}
+	}
+
+	ts.merging = true
+	ts.wg.Add(1)
+	go func() {
+		defer ts.wg.Done()
+
+		err := ts.merge()
+
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+
+		ts.merging = false
+		ts.mergeErr = err
+	}()
+
+	return nil
+}
+
+func (ts *Tombstone) freeze() error {
+	// deletions must stay durable until the merge is done
+	if ts.durability >= iio.DurabilityData {
+		if err := ts.delta.Sync(); err != nil {
+			return err
+		}
 	}
 
-	if !ts.sorted[k[0]] {
-		Sort(ts.keys[k[0]])
-		ts.sorted[k[0]] = true
+	if err := ts.fsys.Rename(ts.deltaPath(), ts.frozenPath()); err != nil {
+		return err
+	}
+
+	if err := ts.durability.SyncDir(ts.fsys, filepath.Dir(ts.path)); err != nil {
+		return err
+	}
+
+	if err := ts.delta.Close(); err != nil {
+		return err
+	}
+
+	ts.frozen = ts.deltaKeys
+	ts.deltaKeys = make(map[ihash.Hash]uint64)
+
+	return ts.openDelta()
+}
+
+// merge writes a new base file containing the frozen delta.
+func (ts *Tombstone) merge() error {
+	ts.mergeMu.Lock()
+	defer ts.mergeMu.Unlock()
+
+	return ts.mergeFrozen(nil)
+}
+
+// mergeFrozen writes a new base file containing the frozen delta, without the
+// deletions accepted by drop, if not nil. It must be called holding mergeMu.
+func (ts *Tombstone) mergeFrozen(drop func(seq uint64) bool) error {
+	ts.mu.RLock()
+	base, frozen, lastSeq, d := ts.base, ts.frozen, ts.lastSeq, ts.durability
+	ts.mu.RUnlock()
+
+	if frozen == nil {
+		return nil
+	}
+
+	// the base file is only replaced holding mergeMu, so it can be read
+	// without blocking lookups
+	if err := base.merge(ts.fsys, d, ts.tmpPath(), sortEntries(frozen), lastSeq, drop); err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err := ts.replaceBase(); err != nil {
+		return err
+	}
+
+	ts.frozen = nil
+
+	return iio.RemoveIfExists(ts.fsys, ts.frozenPath())
+}
+
+// replaceBase moves the new base file written on tmpPath to its final place.
+func (ts *Tombstone) replaceBase() error {
+	if err := ts.fsys.Rename(ts.tmpPath(), ts.path); err != nil {
+		return err
+	}
+
+	if err := ts.durability.SyncDir(ts.fsys, filepath.Dir(ts.path)); err != nil {
+		return err
+	}
+
+	base, err := openTombstoneBase(ts.fsys, ts.path)
+	if err != nil {
+		return err
 	}
 
-	bucket := ts.keys[k[0]]
+	old := ts.base
+	ts.base = base
+
+	return old.Close()
+}
+
+// Sequence returns the sequence number of the last deletion of the hash, and
+// false if it was never deleted.
+func (ts *Tombstone) Sequence(k ihash.Hash) (uint64, bool, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
 
-	ePos := sort.Search(
-		bucketLen,
-		func(i int) bool {
-			return bytes.Compare(k[:], bucket[i][:]) <= 0
-		},
-	)
+	seq, ok := ts.base.find(k)
+	seq, ok = lookupEntry(ts.frozen, k, seq, ok)
+	seq, ok = lookupEntry(ts.deltaKeys, k, seq, ok)
 
-	if ePos >= bucketLen {
-		return false, nil
+	return seq, ok, nil
+}
+
+// lookupEntry returns the sequence number of the key in keys if it is higher
+// than the given one.
+func lookupEntry(keys map[ihash.Hash]uint64, k ihash.Hash, seq uint64, ok bool) (uint64, bool) {
+	s, found := keys[k]
+	if found && (!ok || s > seq) {
+		return s, true
 	}
 
-	bk := bucket[ePos]
-	if !bytes.Equal(bk[:], k[:]) {
-		return false, nil
+	return seq, ok
+}
+
+// Deleted returns true if a value stored with the given sequence number was
+// deleted after that.
+func (ts *Tombstone) Deleted(k ihash.Hash, seq uint64) (bool, error) {
+	delSeq, ok, err := ts.Sequence(k)
+	if err != nil || !ok {
+		return false, err
 	}
 
-	return true, nil
+	return seq <= delSeq, nil
+}
+
+func (ts *Tombstone) HasHash(k ihash.Hash) (bool, error) {
+	_, ok, err := ts.Sequence(k)
+	return ok, err
 }
 
 // Has checks if the key is on the list.
@@ -117,29 +607,342 @@ func (ts *Tombstone) Has(key []byte) (bool, error) {
 	return ts.HasHash(ihash.SumBytes(key))
 }
 
+// Len returns the number of hashes on the tombstone. Hashes deleted several
+// times can be counted more than once until merged.
+func (ts *Tombstone) Len() int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.base.count + len(ts.frozen) + len(ts.deltaKeys)
+}
+
+// LastSequence returns the highest sequence number added to the tombstone.
+func (ts *Tombstone) LastSequence() uint64 {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.lastSeq
+}
+
+// Close waits for any running merge and closes the tombstone files.
 func (ts *Tombstone) Close() error {
-	return ts.f.Close()
+	ts.wg.Wait()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.close()
+}
+
+func (ts *Tombstone) close() error {
+	var err error
+	if ts.delta != nil {
+		err = multierr.Append(err, ts.delta.Close())
+	}
+
+	if ts.base != nil {
+		err = multierr.Append(err, ts.base.Close())
+	}
+
+	return multierr.Combine(ts.mergeErr, err)
 }
 
 func (ts *Tombstone) Clear() error {
-	_, err := ts.f.Seek(0, io.SeekStart)
+	return ts.ClearUntil(math.MaxUint64)
+}
+
+// ClearUntil removes all the deletions with a sequence number lower or equal
+// than seq. The remaining ones are written into a new base file that replaces
+// the actual one, so the tombstone is never left partially cleared. The delta
+// is frozen as when merging it, so deletions can be added and looked up while
+// the base file is written. Deletions added meanwhile are not cleared.
+//
+// If a background merge failed, its delta is merged first, and the error is
+// returned if it fails again.
+func (ts *Tombstone) ClearUntil(seq uint64) error {
+	ts.mergeMu.Lock()
+	defer ts.mergeMu.Unlock()
+
+	drop := func(s uint64) bool {
+		return s <= seq
+	}
+
+	ts.mu.RLock()
+	pending := ts.frozen != nil
+	ts.mu.RUnlock()
+
+	if pending {
+		err := ts.mergeFrozen(drop)
+
+		// the merge is done, or its error is returned now
+		ts.mu.Lock()
+		ts.mergeErr = nil
+		ts.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	ts.mu.Lock()
+	err := ts.freeze()
+	ts.mu.Unlock()
+
 	if err != nil {
 		return err
 	}
 
-	if err := ts.f.Truncate(0); err != nil {
+	return ts.mergeFrozen(drop)
+}
+
+type tombstoneEntry struct {
+	hash ihash.Hash
+	seq  uint64
+}
+
+func sortEntries(keys map[ihash.Hash]uint64) []tombstoneEntry {
+	entries := make([]tombstoneEntry, 0, len(keys))
+	for k, seq := range keys {
+		entries = append(entries, tombstoneEntry{hash: k, seq: seq})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].hash[:], entries[j].hash[:]) < 0
+	})
+
+	return entries
+}
+
+// tombstoneBase is a sorted tombstone file mapped in memory.
+type tombstoneBase struct {
+	data []byte
+	// mmapped is true if data must be released using iio.Munmap.
+	mmapped bool
+	count   int
+	lastSeq uint64
+}
+
+func openTombstoneBase(fsys iio.FS, p string) (*tombstoneBase, error) {
+	f, err := iio.Open(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+
+	// the mapping is still valid after closing the file
+	data, mmapped, err := iio.Mmap(f)
+	b := &tombstoneBase{data: data, mmapped: mmapped}
+	if err := multierr.Combine(err, f.Close()); err != nil {
+		return nil, multierr.Combine(err, b.Close())
+	}
+
+	if err := b.readHeader(); err != nil {
+		return nil, multierr.Combine(err, b.Close())
+	}
+
+	return b, nil
+}
+
+func (b *tombstoneBase) readHeader() error {
+	if len(b.data) < tombstoneBaseHeaderSize {
+		return errors.New("invalid tombstone size")
+	}
+
+	version, err := readTombstoneHeader(bytes.NewReader(b.data))
+	if err != nil {
 		return err
 	}
 
-	ts.keys = make([][]ihash.Hash, 256)
+	if version != tombstoneVersion {
+		return errors.New("version not supported")
+	}
+
+	count := binary.BigEndian.Uint64(b.data[tombstoneHeaderSize:])
+	if uint64(len(b.data)-tombstoneBaseHeaderSize) != count*tombstoneEntrySize {
+		return errors.New("invalid tombstone size")
+	}
+
+	b.count = int(count)
+	b.lastSeq = binary.BigEndian.Uint64(b.data[tombstoneHeaderSize+8:])
 
-	ts.w.Reset(ts.f)
+	var prev uint32
+	for i := 0; i < 256; i++ {
+		f := b.fanout(i)
+		if f < prev {
+			return errors.New("invalid tombstone fanout")
+		}
+
+		prev = f
+	}
+
+	if int(prev) != b.count {
+		return errors.New("invalid tombstone fanout")
+	}
 
 	return nil
 }
 
-func Sort(e []ihash.Hash) {
-	sort.Slice(e, func(i, j int) bool {
-		return bytes.Compare(e[i][:], e[j][:]) < 0
+func (b *tombstoneBase) fanout(i int) uint32 {
+	return binary.BigEndian.Uint32(b.data[tombstoneHeaderSize+16+i*4:])
+}
+
+func (b *tombstoneBase) key(i int) []byte {
+	o := tombstoneBaseHeaderSize + i*tombstoneEntrySize
+	return b.data[o : o+ihash.KeySize]
+}
+
+func (b *tombstoneBase) seq(i int) uint64 {
+	o := tombstoneBaseHeaderSize + i*tombstoneEntrySize + ihash.KeySize
+	return binary.BigEndian.Uint64(b.data[o:])
+}
+
+func (b *tombstoneBase) find(k ihash.Hash) (uint64, bool) {
+	if b.count == 0 {
+		return 0, false
+	}
+
+	var lo int
+	if k[0] > 0 {
+		lo = int(b.fanout(int(k[0]) - 1))
+	}
+
+	hi := int(b.fanout(int(k[0])))
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(b.key(lo+i), k[:]) >= 0
 	})
+
+	if i == hi || !bytes.Equal(b.key(i), k[:]) {
+		return 0, false
+	}
+
+	return b.seq(i), true
+}
+
+// merge writes a new base file into p, containing the actual entries and the
+// given sorted ones. The highest sequence number is kept for keys on both.
+// Entries matching drop are not written. The file is synced if the durability
+// level requires it.
+func (b *tombstoneBase) merge(fsys iio.FS, d iio.Durability, p string, entries []tombstoneEntry, lastSeq uint64, drop func(seq uint64) bool) error {
+	w, err := newTombstoneWriter(fsys, d, p)
+	if err != nil {
+		return err
+	}
+
+	var i, j int
+	for i < b.count || j < len(entries) {
+		var e tombstoneEntry
+
+		c := -1
+		if i == b.count {
+			c = 1
+		} else if j < len(entries) {
+			c = bytes.Compare(b.key(i), entries[j].hash[:])
+		}
+
+		switch {
+		case c < 0:
+			copy(e.hash[:], b.key(i))
+			e.seq = b.seq(i)
+			i++
+		case c > 0:
+			e = entries[j]
+			j++
+		default:
+			e = entries[j]
+			if s := b.seq(i); s > e.seq {
+				e.seq = s
+			}
+			i++
+			j++
+		}
+
+		if drop != nil && drop(e.seq) {
+			continue
+		}
+
+		if err := w.add(e); err != nil {
+			return multierr.Combine(err, w.f.Close())
+		}
+	}
+
+	return w.close(lastSeq)
+}
+
+func (b *tombstoneBase) Close() error {
+	if !b.mmapped {
+		return nil
+	}
+
+	return iio.Munmap(b.data)
+}
+
+type tombstoneWriter struct {
+	f      iio.File
+	w      *bufio.Writer
+	d      iio.Durability
+	fanout [256]uint32
+	count  uint64
+}
+
+func newTombstoneWriter(fsys iio.FS, d iio.Durability, p string) (*tombstoneWriter, error) {
+	f, err := iio.OpenFile(fsys, p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+
+	// the header is written when closing
+	if _, err := w.Write(make([]byte, tombstoneBaseHeaderSize)); err != nil {
+		return nil, multierr.Combine(err, f.Close())
+	}
+
+	return &tombstoneWriter{f: f, w: w, d: d}, nil
+}
+
+func (w *tombstoneWriter) add(e tombstoneEntry) error {
+	if err := writeEntry(w.w, e.hash, e.seq); err != nil {
+		return err
+	}
+
+	w.fanout[e.hash[0]]++
+	w.count++
+
+	return nil
+}
+
+func (w *tombstoneWriter) close(lastSeq uint64) error {
+	if err := w.writeHeader(lastSeq); err != nil {
+		return multierr.Combine(err, w.f.Close())
+	}
+
+	return w.f.Close()
+}
+
+func (w *tombstoneWriter) writeHeader(lastSeq uint64) error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, tombstoneBaseHeaderSize)
+	copy(header, tombstoneSig)
+	binary.BigEndian.PutUint32(header[len(tombstoneSig):], tombstoneVersion)
+	binary.BigEndian.PutUint64(header[tombstoneHeaderSize:], w.count)
+	binary.BigEndian.PutUint64(header[tombstoneHeaderSize+8:], lastSeq)
+
+	var total uint32
+	for i, f := range w.fanout {
+		total += f
+		binary.BigEndian.PutUint32(header[tombstoneHeaderSize+16+i*4:], total)
+	}
+
+	if _, err := w.f.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	if w.d < iio.DurabilityData {
+		return nil
+	}
+
+	return w.f.Sync()
 }
@@ -2,10 +2,17 @@ package packfile
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
 )
 
 func TestTombstone(t *testing.T) {
@@ -19,13 +26,13 @@ func TestTombstone(t *testing.T) {
 	require.NoError(err)
 	require.NotNil(ts)
 
-	err = ts.AddKey([]byte("a"))
+	err = ts.AddKey([]byte("a"), 1)
 	require.NoError(err)
 
-	err = ts.AddKey([]byte("b"))
+	err = ts.AddKey([]byte("b"), 2)
 	require.NoError(err)
 
-	err = ts.AddKey([]byte("c"))
+	err = ts.AddKey([]byte("c"), 3)
 	require.NoError(err)
 
 	ok, err := ts.Has([]byte("b"))
@@ -40,17 +47,285 @@ func TestTombstone(t *testing.T) {
 
 	ts2, err := NewTombstonePath(filename)
 	require.NoError(err)
+	require.Equal(3, ts2.Len())
 
-	ok, err = ts2.Has([]byte("c"))
+	for _, k := range []string{"a", "b", "c"} {
+		ok, err = ts2.Has([]byte(k))
+		require.NoError(err)
+		require.True(ok)
+	}
+
+	err = ts2.AddKey([]byte("d"), 4)
 	require.NoError(err)
-	require.True(ok)
+
+	err = ts2.ClearUntil(2)
+	require.NoError(err)
+	require.Equal(2, ts2.Len())
+
+	ok, err = ts2.Has([]byte("b"))
+	require.NoError(err)
+	require.False(ok)
+
+	for _, k := range []string{"c", "d"} {
+		ok, err = ts2.Has([]byte(k))
+		require.NoError(err)
+		require.True(ok)
+	}
 
 	err = ts2.Clear()
 	require.NoError(err)
 
-	ok, err = ts2.Has([]byte("z"))
+	ok, err = ts2.Has([]byte("c"))
+	require.NoError(err)
+	require.False(ok)
+
+	require.NoError(ts2.Close())
+
+	ts3, err := NewTombstonePath(filename)
+	require.NoError(err)
+	require.Equal(0, ts3.Len())
+}
+
+func TestTombstoneSequence(t *testing.T) {
+	require := require.New(t)
+
+	ts, err := NewTombstonePath(path.Join(t.TempDir(), "tombstone.bin"))
+	require.NoError(err)
+
+	k := ihash.SumBytes([]byte("a"))
+	require.NoError(ts.AddHash(k, 5))
+	require.NoError(ts.AddHash(k, 3))
+
+	seq, ok, err := ts.Sequence(k)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(uint64(5), seq)
+	require.Equal(uint64(5), ts.LastSequence())
+
+	for s, deleted := range map[uint64]bool{4: true, 5: true, 6: false} {
+		ok, err := ts.Deleted(k, s)
+		require.NoError(err)
+		require.Equal(deleted, ok)
+	}
+
+	ok, err = ts.Deleted(ihash.SumBytes([]byte("b")), 0)
 	require.NoError(err)
 	require.False(ok)
+
+	require.NoError(ts.Close())
+}
+
+func TestTombstoneVersion0(t *testing.T) {
+	require := require.New(t)
+
+	p := path.Join(t.TempDir(), "tombstone.bin")
+
+	// version 0 files only contain hashes
+	a := ihash.SumBytes([]byte("a"))
+	b := ihash.SumBytes([]byte("b"))
+	require.NoError(os.WriteFile(p, append(a[:], b[:]...), 0755))
+
+	ts, err := NewTombstonePath(p)
+	require.NoError(err)
+	require.Equal(2, ts.Len())
+
+	ok, err := ts.Deleted(a, 0)
+	require.NoError(err)
+	require.True(ok)
+
+	require.NoError(ts.AddKey([]byte("c"), 1))
+	require.NoError(ts.Close())
+
+	ts, err = NewTombstonePath(p)
+	require.NoError(err)
+	require.Equal(3, ts.Len())
+
+	for _, k := range []string{"a", "b", "c"} {
+		ok, err = ts.Has([]byte(k))
+		require.NoError(err)
+		require.True(ok)
+	}
+
+	require.NoError(ts.Close())
+}
+
+func TestTombstoneMerge(t *testing.T) {
+	require := require.New(t)
+
+	p := path.Join(t.TempDir(), "tombstone.bin")
+
+	ts, err := NewTombstonePath(p)
+	require.NoError(err)
+	ts.maxDelta = 3
+
+	for i := 0; i < 10; i++ {
+		require.NoError(ts.AddKey([]byte(fmt.Sprint(i)), uint64(i+1)))
+	}
+
+	// deleted again, so the highest sequence number is kept when merging
+	require.NoError(ts.AddKey([]byte("0"), 20))
+
+	ts.wg.Wait()
+	require.NoError(ts.mergeErr)
+	require.Greater(ts.base.count, 0)
+
+	check := func(ts *Tombstone) {
+		for i := 1; i < 10; i++ {
+			seq, ok, err := ts.Sequence(ihash.SumBytes([]byte(fmt.Sprint(i))))
+			require.NoError(err)
+			require.True(ok)
+			require.Equal(uint64(i+1), seq)
+		}
+
+		seq, ok, err := ts.Sequence(ihash.SumBytes([]byte("0")))
+		require.NoError(err)
+		require.True(ok)
+		require.Equal(uint64(20), seq)
+		require.Equal(uint64(20), ts.LastSequence())
+	}
+
+	check(ts)
+	require.NoError(ts.Close())
+
+	ts, err = NewTombstonePath(p)
+	require.NoError(err)
+	check(ts)
+
+	require.NoError(ts.ClearUntil(5))
+	require.Equal(6, ts.Len())
+
+	for i := 0; i < 10; i++ {
+		ok, err := ts.Has([]byte(fmt.Sprint(i)))
+		require.NoError(err)
+		require.Equal(i == 0 || i >= 5, ok)
+	}
+
+	require.NoError(ts.Close())
+}
+
+func TestTombstoneInterruptedMerge(t *testing.T) {
+	require := require.New(t)
+
+	p := path.Join(t.TempDir(), "tombstone.bin")
+
+	ts, err := NewTombstonePath(p)
+	require.NoError(err)
+	require.NoError(ts.AddKey([]byte("a"), 1))
+	require.NoError(ts.AddKey([]byte("b"), 2))
+	require.NoError(ts.Close())
+
+	// the delta was frozen, but the new base file was not renamed
+	require.NoError(os.Rename(p+".delta", p+".delta.old"))
+	require.NoError(os.WriteFile(p+".tmp", []byte("partial"), 0755))
+
+	ts, err = NewTombstonePath(p)
+	require.NoError(err)
+	require.Equal(2, ts.base.count)
+	require.Equal(2, ts.Len())
+
+	for _, k := range []string{"a", "b"} {
+		ok, err := ts.Has([]byte(k))
+		require.NoError(err)
+		require.True(ok)
+	}
+
+	for _, f := range []string{p + ".delta.old", p + ".tmp"} {
+		_, err = os.Stat(f)
+		require.ErrorIs(err, fs.ErrNotExist)
+	}
+
+	require.NoError(ts.Close())
+}
+
+func TestTombstoneClearUntilConcurrent(t *testing.T) {
+	require := require.New(t)
+
+	fsys := iio.NewFaultFS(iio.NewMemFS())
+	ts, err := NewTombstoneFS(fsys, "/tombstone.bin")
+	require.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(ts.AddKey([]byte(fmt.Sprint(i)), uint64(i+1)))
+	}
+
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	fsys.SetFault(func(op iio.Op, p string) error {
+		if op == iio.OpOpen && p == ts.tmpPath() {
+			close(writing)
+			<-release
+		}
+
+		return nil
+	})
+
+	cleared := make(chan error)
+	go func() {
+		cleared <- ts.ClearUntil(5)
+	}()
+
+	// lookups and deletions are not blocked while writing the base file
+	<-writing
+	ok, err := ts.Has([]byte("0"))
+	require.NoError(err)
+	require.True(ok)
+	require.NoError(ts.AddKey([]byte("new"), 11))
+
+	close(release)
+	require.NoError(<-cleared)
+	fsys.SetFault(nil)
+
+	for i := 0; i < 10; i++ {
+		ok, err := ts.Has([]byte(fmt.Sprint(i)))
+		require.NoError(err)
+		require.Equal(i >= 5, ok)
+	}
+
+	ok, err = ts.Has([]byte("new"))
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(6, ts.Len())
+
+	require.NoError(ts.Close())
+}
+
+func TestTombstoneFailedMerge(t *testing.T) {
+	require := require.New(t)
+
+	errMerge := errors.New("merge failed")
+	fsys := iio.NewFaultFS(iio.NewMemFS())
+	ts, err := NewTombstoneFS(fsys, "/tombstone.bin")
+	require.NoError(err)
+	ts.maxDelta = 3
+
+	fsys.SetFault(func(op iio.Op, p string) error {
+		if op == iio.OpOpen && p == ts.tmpPath() {
+			return errMerge
+		}
+
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(ts.AddKey([]byte(fmt.Sprint(i)), uint64(i+1)))
+	}
+
+	ts.wg.Wait()
+	require.ErrorIs(ts.mergeErr, errMerge)
+
+	// the failed merge is done again first
+	require.ErrorIs(ts.ClearUntil(1), errMerge)
+
+	fsys.SetFault(nil)
+	require.NoError(ts.ClearUntil(1))
+
+	for i := 0; i < 3; i++ {
+		ok, err := ts.Has([]byte(fmt.Sprint(i)))
+		require.NoError(err)
+		require.Equal(i >= 1, ok)
+	}
+
+	require.NoError(ts.Close())
 }
 
 func BenchmarkTombstoneWrite(b *testing.B) {
@@ -68,7 +343,7 @@ func BenchmarkTombstoneWrite(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		b := make([]byte, 8)
 		binary.BigEndian.PutUint64(b, uint64(i))
-		require.NoError(ts.AddKey(b))
+		require.NoError(ts.AddKey(b, uint64(i)))
 	}
 
 	ts.Close()
@@ -88,7 +363,7 @@ func BenchmarkTombstoneRead(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		b := make([]byte, 8)
 		binary.BigEndian.PutUint64(b, uint64(i))
-		require.NoError(ts.AddKey(b))
+		require.NoError(ts.AddKey(b, uint64(i)))
 	}
 
 	b.ResetTimer()
@@ -1,27 +1,45 @@
 package packfile
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"hash"
+	"hash/crc32"
 	"io"
 	"sync"
 
 	ihash "github.com/ajnavarro/super-blockstore/hash"
-	"github.com/klauspost/compress/s2"
+	"go.uber.org/multierr"
 )
 
 /*
 format packfile:
 
+Version 0 packfiles are compressed as a single s2 stream, and their block
+headers only contain the hashed key and the block size. From version 1, each
+block is compressed independently using the codec on its header.
+
 header:
  "SPB" magic key:3 bytes
  version:uint32
+ codec:uint8 (version >= 1), codec used to compress blocks
+ dictionary_size:uint32 (version >= 1), zero if there is no dictionary
+ dictionary:[]bytes (version >= 1), zstd dictionary used by zstd blocks
 blocks:
  block_header:
-   key:[32]bytes (sha256)
-   checksum:uint32
-   blocksize:uint64
+   key_hash:[32]bytes (sha256)
+   key_size:uint32 (version >= 1), zero if the key is unknown
+   key:[]bytes (version >= 1)
+   checksum:uint32 (version >= 1), CRC32C of the block
+   blocksize:uint32
+   codec:uint8 (version >= 1)
+   stored_size:uint32 (version >= 1), size of the block as it is stored
    block:[]bytes
+footer (version >= 1):
+ sequence:uint64, sequence number of the packfile commit
+ checksum:[32]bytes, sha256 of all the previous bytes
 */
 
 var bufPool = sync.Pool{
@@ -31,27 +49,85 @@ var bufPool = sync.Pool{
 }
 
 var packSig []byte = []byte{'S', 'P', 'B'}
-var packVersion uint32 = 0
+var packVersion uint32 = packVersionBlocks
+
+const (
+	// packVersionHashes is the first version, a single s2 stream storing
+	// only hashed keys.
+	packVersionHashes uint32 = iota
+	// packVersionBlocks compresses each block independently, storing its
+	// original key and checksum, and adds the codec and the compression
+	// dictionary to the header, and the commit sequence number and the
+	// packfile checksum at the end.
+	packVersionBlocks
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the CRC32C of a block.
+func Checksum(value []byte) uint32 {
+	return crc32.Checksum(value, crcTable)
+}
 
 type Writer struct {
 	w   io.Writer
+	bw  *bufio.Writer
 	c   io.Closer
 	pos int64
+
+	hash hash.Hash
+	sum  ihash.Hash
+
+	codec Codec
+	bc    blockCodec
+	dict  []byte
+	seq   uint64
+
+	// scratch is reused to compress blocks
+	scratch []byte
 }
 
+// NewWriter returns a packfile writer compressing blocks using s2.
 func NewWriter(w io.WriteCloser) *Writer {
-	// TODO maybe buffer?
-	s2w := s2.NewWriter(w, s2.WriterAddIndex())
+	bw := bufio.NewWriter(w)
+	h := sha256.New()
 	return &Writer{
-		w: s2w,
-		c: s2w,
+		w:     io.MultiWriter(bw, h),
+		bw:    bw,
+		c:     w,
+		hash:  h,
+		codec: CodecS2,
+		bc:    codecs[CodecS2],
 	}
 }
 
+// SetCodec sets the codec used to compress blocks. Level and dict are only
+// used by zstd, and dict can be empty. It must be called before WriteHeader.
+func (pw *Writer) SetCodec(c Codec, level int, dict []byte) error {
+	bc, err := newBlockCodec(c, level, dict)
+	if err != nil {
+		return err
+	}
+
+	if err := pw.bc.close(); err != nil {
+		bc.close()
+		return err
+	}
+
+	pw.codec = c
+	pw.bc = bc
+	pw.dict = dict
+
+	return nil
+}
+
 func (pw *Writer) WriteHeader() error {
 	// header:
 	//   "SPB" magic key:3 bytes
 	//   version:uint32
+	//   codec:uint8
+	//   dictionary_size:uint32
+	//   dictionary:[]bytes
 	n, err := pw.w.Write(packSig)
 	if err != nil {
 		return err
@@ -65,44 +141,148 @@ func (pw *Writer) WriteHeader() error {
 
 	pw.pos += 4
 
-	// return pw.w.Flush()
+	if err := binary.Write(pw.w, binary.BigEndian, pw.codec); err != nil {
+		return err
+	}
+
+	pw.pos++
+
+	if err := binary.Write(pw.w, binary.BigEndian, uint32(len(pw.dict))); err != nil {
+		return err
+	}
+
+	pw.pos += 4
+
+	n, err = pw.w.Write(pw.dict)
+	if err != nil {
+		return err
+	}
+
+	pw.pos += int64(n)
+
 	return nil
 }
 
-func (pw *Writer) WriteBlock(key []byte, len uint32, value io.Reader) (int64, error) {
+// WriteBlock writes a block, returning its position and checksum.
+func (pw *Writer) WriteBlock(key []byte, size uint32, value io.Reader) (int64, uint32, error) {
+	return pw.WriteHashedBlock(ihash.SumBytes(key), key, size, value)
+}
+
+// WriteHashedBlock writes a block using an already hashed key. If the original
+// key is unknown, key can be empty.
+func (pw *Writer) WriteHashedBlock(k ihash.Hash, key []byte, size uint32, value io.Reader) (int64, uint32, error) {
 	pOut := pw.pos
+
+	// the checksum is written before the block, so we need to read it first
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+
+	if _, err := io.CopyN(buf, value, int64(size)); err != nil {
+		return pOut, 0, err
+	}
+
+	crc := Checksum(buf.Bytes())
+
 	//block_header:
 
-	//	key:[32]bytes
-	k := ihash.SumBytes(key)
+	//	key_hash:[32]bytes
 	n, err := pw.w.Write(k[:])
 	if err != nil {
-		return pOut, err
+		return pOut, 0, err
 	}
 
 	pw.pos += int64(n)
 
-	// TODO
+	//	key_size:uint32
+	if err := binary.Write(pw.w, binary.BigEndian, uint32(len(key))); err != nil {
+		return pOut, 0, err
+	}
+
+	pw.pos += 4
+
+	//	key:[]bytes
+	n, err = pw.w.Write(key)
+	if err != nil {
+		return pOut, 0, err
+	}
+
+	pw.pos += int64(n)
+
+	//	checksum:uint32
+	if err := binary.Write(pw.w, binary.BigEndian, crc); err != nil {
+		return pOut, 0, err
+	}
+
+	pw.pos += 4
 
 	//	blocksize:uint32
-	if err := binary.Write(pw.w, binary.BigEndian, len); err != nil {
-		return pOut, err
+	if err := binary.Write(pw.w, binary.BigEndian, size); err != nil {
+		return pOut, 0, err
+	}
+
+	pw.pos += 4
+
+	codec, data, scratch := encodeBlock(pw.bc, pw.codec, pw.scratch, buf.Bytes())
+	pw.scratch = scratch
+
+	//	codec:uint8
+	if err := binary.Write(pw.w, binary.BigEndian, codec); err != nil {
+		return pOut, 0, err
+	}
+
+	pw.pos++
+
+	//	stored_size:uint32
+	if err := binary.Write(pw.w, binary.BigEndian, uint32(len(data))); err != nil {
+		return pOut, 0, err
 	}
 
 	pw.pos += 4
 
 	// block:
 
-	nCopy, err := io.Copy(pw.w, value)
+	n, err = pw.w.Write(data)
 	if err != nil {
-		return pOut, err
+		return pOut, 0, err
 	}
 
-	pw.pos += nCopy
+	pw.pos += int64(n)
+
+	return pOut, crc, nil
+}
+
+// Size returns the number of bytes written.
+func (pw *Writer) Size() int64 {
+	return pw.pos
+}
+
+// Sum returns the packfile checksum. It is only available after Close.
+func (pw *Writer) Sum() ihash.Hash {
+	return pw.sum
+}
 
-	return pOut, nil
+// SetSequence sets the sequence number written on the footer. It must be
+// called before Close.
+func (pw *Writer) SetSequence(seq uint64) {
+	pw.seq = seq
 }
 
+// Close writes the footer, flushes all the pending data and closes the
+// underlying writer.
 func (pw *Writer) Close() error {
-	return pw.c.Close()
+	if err := binary.Write(pw.w, binary.BigEndian, pw.seq); err != nil {
+		return multierr.Combine(err, pw.bc.close(), pw.c.Close())
+	}
+
+	copy(pw.sum[:], pw.hash.Sum(nil))
+	if _, err := pw.bw.Write(pw.sum[:]); err != nil {
+		return multierr.Combine(err, pw.bc.close(), pw.c.Close())
+	}
+
+	if err := pw.bw.Flush(); err != nil {
+		return multierr.Combine(err, pw.bc.close(), pw.c.Close())
+	}
+
+	return multierr.Combine(pw.bc.close(), pw.c.Close())
 }
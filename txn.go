@@ -0,0 +1,732 @@
+package superblock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"runtime"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
+	"github.com/ajnavarro/super-blockstore/packfile"
+)
+
+// ErrTxnDone is returned when using a transaction already committed or
+// discarded.
+var ErrTxnDone = errors.New("transaction already committed or discarded")
+
+// ErrTxnReadOnly is returned when writing on a read only transaction.
+var ErrTxnReadOnly = errors.New("transaction is read only")
+
+var _ datastore.Txn = &Txn{}
+
+// Txn reads from a snapshot of the committed packfiles and deletions taken
+// when it was created, plus its own writes. Puts are written into its own
+// packfile, and all its changes are made available at once on Commit.
+// Transactions dropped without calling Commit or Discard are discarded when
+// garbage collected. A Txn must not be used concurrently.
+//
+// Packfiles removed by GC are kept on disk until all the transactions using
+// them are committed or discarded.
+type Txn struct {
+	ds       *Datastore
+	snap     *snapshot
+	readOnly bool
+
+	packProc *packfile.PackProcessing
+	// writes contains the keys whose last operation was a Put
+	writes map[ihash.Hash]*txnWrite
+	// deleted contains the keys whose last operation was a deletion
+	deleted map[ihash.Hash]struct{}
+	done    bool
+}
+
+type txnWrite struct {
+	key   []byte
+	value []byte
+}
+
+// NewTransaction returns a transaction reading from a snapshot of the
+// currently committed data. Read only transactions fail on Put and Delete.
+func (ds *Datastore) NewTransaction(ctx context.Context, readOnly bool) (datastore.Txn, error) {
+	tx := &Txn{
+		ds:       ds,
+		readOnly: readOnly,
+		writes:   make(map[ihash.Hash]*txnWrite),
+		deleted:  make(map[ihash.Hash]struct{}),
+	}
+
+	if !readOnly {
+		pp, err := ds.pp.NewPackProcessing()
+		if err != nil {
+			return nil, err
+		}
+
+		tx.packProc = pp
+	}
+
+	tx.snap = ds.newSnapshot()
+
+	runtime.SetFinalizer(tx, (*Txn).finalize)
+
+	return tx, nil
+}
+
+// Get retrieves the object `value` named by `key`.
+// Get will return ErrNotFound if the key is not mapped to a value.
+func (tx *Txn) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+
+	k := ihash.SumBytes(key.Bytes())
+	if w, ok := tx.writes[k]; ok {
+		return w.value, nil
+	}
+
+	if _, ok := tx.deleted[k]; ok {
+		return nil, datastore.ErrNotFound
+	}
+
+	minSeq, err := tx.snap.minSequence(tx.ds.ts, k)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := tx.snap.packs.GetFrom(key.Bytes(), minSeq)
+	if errors.Is(err, packfile.ErrEntryNotFound) {
+		return nil, datastore.ErrNotFound
+	}
+
+	return v, err
+}
+
+// Has returns whether the `key` is mapped to a `value`.
+func (tx *Txn) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	if tx.done {
+		return false, ErrTxnDone
+	}
+
+	k := ihash.SumBytes(key.Bytes())
+	if _, ok := tx.writes[k]; ok {
+		return true, nil
+	}
+
+	if _, ok := tx.deleted[k]; ok {
+		return false, nil
+	}
+
+	minSeq, err := tx.snap.minSequence(tx.ds.ts, k)
+	if err != nil {
+		return false, err
+	}
+
+	return tx.snap.packs.HasFrom(key.Bytes(), minSeq)
+}
+
+// GetSize returns the size of the `value` named by `key`.
+func (tx *Txn) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	if tx.done {
+		return 0, ErrTxnDone
+	}
+
+	k := ihash.SumBytes(key.Bytes())
+	if w, ok := tx.writes[k]; ok {
+		return len(w.value), nil
+	}
+
+	if _, ok := tx.deleted[k]; ok {
+		return 0, datastore.ErrNotFound
+	}
+
+	minSeq, err := tx.snap.minSequence(tx.ds.ts, k)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := tx.snap.packs.GetSizeFrom(key.Bytes(), minSeq)
+	if errors.Is(err, packfile.ErrEntryNotFound) {
+		return 0, datastore.ErrNotFound
+	}
+
+	return int(size), err
+}
+
+// Query searches the snapshot and the writes of the transaction. Its own
+// writes are returned first.
+func (tx *Txn) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+
+	skip := make(map[ihash.Hash]struct{}, len(tx.writes)+len(tx.deleted))
+	entries := make([]query.Entry, 0, len(tx.writes))
+	for k, w := range tx.writes {
+		e := query.Entry{Key: datastore.NewKey(string(w.key)).String(), Size: len(w.value)}
+		if !q.KeysOnly {
+			e.Value = w.value
+		}
+
+		entries = append(entries, e)
+		skip[k] = struct{}{}
+	}
+
+	for k := range tx.deleted {
+		skip[k] = struct{}{}
+	}
+
+	deleted := func(k ihash.Hash, seq uint64) (bool, error) {
+		minSeq, err := tx.snap.minSequence(tx.ds.ts, k)
+		return seq < minSeq, err
+	}
+
+	return tx.ds.query(ctx, q, tx.snap.packs.NewIter(q.KeysOnly), deleted, entries, skip)
+}
+
+// Put stores the object `value` named by `key`. It is available for the
+// following reads of the transaction, and for everyone else after Commit.
+func (tx *Txn) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+
+	k := ihash.SumBytes(key.Bytes())
+	delete(tx.deleted, k)
+
+	if w, ok := tx.writes[k]; ok && bytes.Equal(w.value, value) {
+		return nil
+	}
+
+	tx.writes[k] = &txnWrite{key: key.Bytes(), value: append([]byte(nil), value...)}
+
+	// blocks on the same packfile keep the first value
+	if tx.packProc.Contains(k) {
+		return tx.rewrite()
+	}
+
+	return tx.packProc.WriteHashedBlock(k, key.Bytes(), value)
+}
+
+// rewrite writes the current values into a new packfile, discarding the one
+// containing overwritten values.
+func (tx *Txn) rewrite() error {
+	pp, err := tx.ds.pp.NewPackProcessing()
+	if err != nil {
+		return err
+	}
+
+	for k, w := range tx.writes {
+		if err := pp.WriteHashedBlock(k, w.key, w.value); err != nil {
+			return multierr.Combine(err, pp.Discard())
+		}
+	}
+
+	old := tx.packProc
+	tx.packProc = pp
+
+	return old.Discard()
+}
+
+// Delete removes the value for given `key`, also if it was put on the
+// transaction before.
+func (tx *Txn) Delete(ctx context.Context, key datastore.Key) error {
+	if err := tx.writable(); err != nil {
+		return err
+	}
+
+	k := ihash.SumBytes(key.Bytes())
+	delete(tx.writes, k)
+	tx.deleted[k] = struct{}{}
+
+	return nil
+}
+
+func (tx *Txn) writable() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+
+	if tx.readOnly {
+		return ErrTxnReadOnly
+	}
+
+	return nil
+}
+
+// Commit makes available the packfile with the Puts of the transaction and
+// applies its deletions at once. If the process stops in the middle, the
+// commit is either finished or rolled back when opening the datastore again.
+func (tx *Txn) Commit(ctx context.Context) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+
+	if tx.readOnly {
+		return tx.finish()
+	}
+
+	err := tx.ds.commitTxn(tx.packProc, hashes(tx.writes), tx.deleted)
+	return multierr.Combine(err, tx.finish())
+}
+
+// Discard throws away the changes of the transaction. It can be called after
+// Commit.
+func (tx *Txn) Discard(ctx context.Context) {
+	if tx.done {
+		return
+	}
+
+	tx.finish()
+
+	if tx.packProc != nil {
+		tx.packProc.Discard()
+	}
+}
+
+// finish marks the transaction as done, releasing its snapshot.
+func (tx *Txn) finish() error {
+	tx.done = true
+	runtime.SetFinalizer(tx, nil)
+
+	return tx.ds.releaseSnapshot(tx.snap)
+}
+
+// finalize discards a transaction that was dropped without calling Commit or
+// Discard.
+func (tx *Txn) finalize() {
+	tx.Discard(context.Background())
+}
+
+// commitTxn makes available the packfile written by a transaction, with the
+// values of the written keys, and deletes the given keys, both at once.
+// Deletions are recorded on a log before committing the packfile, and applied
+// again when opening the datastore if the process stopped before making all
+// of them durable.
+func (ds *Datastore) commitTxn(pp *packfile.PackProcessing, written []ihash.Hash, deleted map[ihash.Hash]struct{}) error {
+	keys := hashes(deleted)
+
+	// pending single Puts of the same keys happened before the commit
+	ds.mu.Lock()
+	pending := false
+	for _, k := range keys {
+		_, ok := ds.memtable[k]
+		pending = pending || ok
+	}
+
+	for _, k := range written {
+		_, ok := ds.memtable[k]
+		pending = pending || ok
+	}
+
+	var err error
+	if pending {
+		err = ds.commitSingleObjectsLocked()
+	}
+	ds.mu.Unlock()
+
+	if err != nil {
+		return multierr.Combine(err, pp.Discard())
+	}
+
+	if len(keys) == 0 && pp.Count() == 0 {
+		return pp.Discard()
+	}
+
+	// the packfile and the deletions are visible at once on snapshots
+	ds.delMu.Lock()
+	defer ds.delMu.Unlock()
+
+	l := &txnLog{keys: keys}
+	var p string
+	if len(keys) > 0 {
+		if pp.Count() > 0 {
+			l.packID = pp.PackID()
+		} else {
+			l.seq = ds.pp.NextSequence()
+		}
+
+		p = path.Join(ds.folder, txnFolder, pp.PackID())
+		if err := ds.writeTxnLog(p, l); err != nil {
+			return multierr.Combine(err, pp.Discard())
+		}
+	}
+
+	// reads are blocked from adding the deletions until the packfile is
+	// available, so they see both at once
+	locked := false
+	unlock := func() {
+		if locked {
+			locked = false
+			ds.viewMu.Unlock()
+		}
+	}
+	defer unlock()
+
+	visible := func(seq uint64) error {
+		ds.viewMu.Lock()
+		locked = true
+
+		for _, k := range written {
+			ds.cache.Remove(k)
+		}
+
+		for _, k := range keys {
+			ds.cache.Remove(k)
+		}
+
+		if len(keys) == 0 {
+			return nil
+		}
+
+		l.seq = seq
+		return ds.addTxnDeletions(l)
+	}
+
+	if l.packID == "" && len(keys) > 0 {
+		if err := pp.Discard(); err != nil {
+			return err
+		}
+
+		if err := visible(l.seq); err != nil {
+			return err
+		}
+	} else {
+		// if the commit fails and cannot be rolled back, it is finished
+		// when opening the datastore, so the log must be kept
+		if err := pp.CommitWith(visible); err != nil {
+			return err
+		}
+	}
+
+	unlock()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if ds.durability >= iio.DurabilityData {
+		if err := ds.ts.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return ds.fsys.Remove(p)
+}
+
+// applyTxnLog adds the deletions of a transaction to the tombstone, making
+// them durable. It must be called holding delMu.
+func (ds *Datastore) applyTxnLog(l *txnLog) error {
+	if err := ds.addTxnDeletions(l); err != nil {
+		return err
+	}
+
+	if ds.durability < iio.DurabilityData {
+		return nil
+	}
+
+	return ds.ts.Sync()
+}
+
+// addTxnDeletions adds the deletions of a transaction to the tombstone. It
+// must be called holding delMu.
+func (ds *Datastore) addTxnDeletions(l *txnLog) error {
+	if err := ds.preserveDeletions(l.keys...); err != nil {
+		return err
+	}
+
+	// deletions use the sequence number of the packfile, so they remove
+	// the values put on the transaction before deleting them
+	ds.pp.ObserveSequence(l.seq)
+	return ds.ts.AddHashes(l.keys, l.seq)
+}
+
+// recoverTxns finishes the commits of the transactions interrupted before
+// applying their deletions. The ones whose packfile was not committed are
+// rolled back.
+func (ds *Datastore) recoverTxns() error {
+	dir := path.Join(ds.folder, txnFolder)
+	entries, err := ds.fsys.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	packs := make(map[string]struct{})
+	for _, id := range ds.pp.PackIDs() {
+		packs[id] = struct{}{}
+	}
+
+	ds.delMu.Lock()
+	defer ds.delMu.Unlock()
+
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		l, err := ds.readTxnLog(p)
+		if err != nil && !errors.Is(err, errInvalidTxnLog) {
+			return err
+		}
+
+		// the log was being written, so the commit never started
+		committed := err == nil
+		if committed && l.packID != "" {
+			_, committed = packs[l.packID]
+			l.seq = ds.pp.Sequence(l.packID)
+		}
+
+		if committed {
+			if err := ds.applyTxnLog(l); err != nil {
+				return err
+			}
+		}
+
+		if err := ds.fsys.Remove(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+format transaction log:
+
+ header:
+  "SPX" magic key:3 bytes
+  version:uint32
+ pack_id_size:uint32
+ pack_id:pack_id_size bytes (empty if there is no packfile)
+ sequence:uint64 (of the deletions if there is no packfile)
+ deletions_count:uint32
+ deletions:[32]bytes * deletions_count
+ checksum:uint32 (crc32c of all the previous bytes)
+*/
+
+var txnSig []byte = []byte{'S', 'P', 'X'}
+var txnVersion uint32 = 0
+
+const txnHeaderSize = 7
+
+var errInvalidTxnLog = errors.New("invalid transaction log")
+
+// txnLog records the deletions of a transaction being committed.
+type txnLog struct {
+	packID string
+	seq    uint64
+	keys   []ihash.Hash
+}
+
+// writeTxnLog writes the log, making it durable before the commit starts.
+func (ds *Datastore) writeTxnLog(p string, l *txnLog) error {
+	buf := bytes.NewBuffer(make([]byte, 0, txnHeaderSize+4+len(l.packID)+8+4+len(l.keys)*ihash.KeySize+4))
+	buf.Write(txnSig)
+
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:4], txnVersion)
+	buf.Write(n[:4])
+
+	writeWALBytes(buf, []byte(l.packID))
+
+	binary.BigEndian.PutUint64(n[:], l.seq)
+	buf.Write(n[:])
+
+	binary.BigEndian.PutUint32(n[:4], uint32(len(l.keys)))
+	buf.Write(n[:4])
+
+	for _, k := range l.keys {
+		buf.Write(k[:])
+	}
+
+	binary.BigEndian.PutUint32(n[:4], packfile.Checksum(buf.Bytes()))
+	buf.Write(n[:4])
+
+	if err := iio.WriteFile(ds.fsys, p, buf.Bytes(), 0755); err != nil {
+		return err
+	}
+
+	if err := ds.durability.SyncFile(ds.fsys, p); err != nil {
+		return err
+	}
+
+	return ds.durability.SyncDir(ds.fsys, path.Dir(p))
+}
+
+// readTxnLog reads a log, returning errInvalidTxnLog if it was not
+// completely written.
+func (ds *Datastore) readTxnLog(p string) (*txnLog, error) {
+	b, err := iio.ReadFile(ds.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < txnHeaderSize+4 {
+		return nil, errInvalidTxnLog
+	}
+
+	data, crc := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if packfile.Checksum(data) != crc {
+		return nil, errInvalidTxnLog
+	}
+
+	if !bytes.Equal(data[:len(txnSig)], txnSig) {
+		return nil, errors.New("not a valid transaction log file")
+	}
+
+	if binary.BigEndian.Uint32(data[len(txnSig):]) > txnVersion {
+		return nil, errors.New("not a valid transaction log version")
+	}
+
+	r := bytes.NewReader(data[txnHeaderSize:])
+	l := &txnLog{}
+
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, errInvalidTxnLog
+	}
+
+	id := make([]byte, size)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, errInvalidTxnLog
+	}
+
+	l.packID = string(id)
+
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &l.seq); err != nil {
+		return nil, errInvalidTxnLog
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, errInvalidTxnLog
+	}
+
+	if int(count)*ihash.KeySize != r.Len() {
+		return nil, errInvalidTxnLog
+	}
+
+	l.keys = make([]ihash.Hash, count)
+	for i := range l.keys {
+		if _, err := io.ReadFull(r, l.keys[i][:]); err != nil {
+			return nil, errInvalidTxnLog
+		}
+	}
+
+	return l, nil
+}
+
+// snapshot is a consistent view of the committed packfiles and deletions.
+type snapshot struct {
+	packs *packfile.Snapshot
+
+	mu sync.Mutex
+	// deletions contains the state on the tombstone, when the snapshot was
+	// taken, of the keys deleted after that.
+	deletions map[ihash.Hash]deletion
+}
+
+type deletion struct {
+	seq     uint64
+	deleted bool
+}
+
+// newSnapshot takes a snapshot, keeping the deletions done after that out of
+// it until it is released.
+func (ds *Datastore) newSnapshot() *snapshot {
+	ds.delMu.Lock()
+	defer ds.delMu.Unlock()
+
+	s := &snapshot{
+		packs:     ds.pp.Snapshot(),
+		deletions: make(map[ihash.Hash]deletion),
+	}
+
+	ds.snapshots[s] = struct{}{}
+
+	return s
+}
+
+// releaseSnapshot stops preserving deletions for the snapshot, and unpins
+// its packfiles.
+func (ds *Datastore) releaseSnapshot(s *snapshot) error {
+	ds.delMu.Lock()
+	delete(ds.snapshots, s)
+	ds.delMu.Unlock()
+
+	return s.packs.Release()
+}
+
+// preserveDeletions saves the current tombstone state of the keys on all the
+// snapshots, before deleting them. It must be called holding delMu.
+func (ds *Datastore) preserveDeletions(keys ...ihash.Hash) error {
+	for s := range ds.snapshots {
+		if err := s.preserve(ds.ts, keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *snapshot) preserve(ts *packfile.Tombstone, keys []ihash.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range keys {
+		if _, ok := s.deletions[k]; ok {
+			continue
+		}
+
+		seq, deleted, err := ts.Sequence(k)
+		if err != nil {
+			return err
+		}
+
+		s.deletions[k] = deletion{seq: seq, deleted: deleted}
+	}
+
+	return nil
+}
+
+// minSequence returns the minimum sequence number of the packfiles where the
+// key is available on the snapshot.
+func (s *snapshot) minSequence(ts *packfile.Tombstone, k ihash.Hash) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.deletions[k]
+	if !ok {
+		// the key cannot be deleted until the lock is released
+		var err error
+		d.seq, d.deleted, err = ts.Sequence(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if !d.deleted {
+		return 0, nil
+	}
+
+	return d.seq + 1, nil
+}
+
+// hashes returns the keys of the given map.
+func hashes[V any](m map[ihash.Hash]V) []ihash.Hash {
+	keys := make([]ihash.Hash, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
@@ -0,0 +1,388 @@
+package superblock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"go.uber.org/multierr"
+
+	ihash "github.com/ajnavarro/super-blockstore/hash"
+	"github.com/ajnavarro/super-blockstore/iio"
+	"github.com/ajnavarro/super-blockstore/packfile"
+)
+
+/*
+format write-ahead log:
+
+ header:
+  "SPW" magic key:3 bytes
+  version:uint32
+ records:
+  op:uint8 (1: put, 2: delete)
+  put:
+   key_size:uint32
+   key:key_size bytes
+   value_size:uint32
+   value:value_size bytes
+  delete:
+   key_hash:[32]bytes (sha256)
+   sequence:uint64
+  checksum:uint32 (crc32c of the record)
+
+Records after a truncated or corrupted one are ignored, as they were being
+written when the process stopped.
+*/
+
+var walSig []byte = []byte{'S', 'P', 'W'}
+var walVersion uint32 = 0
+
+const walHeaderSize = 7
+
+const (
+	walOpPut    byte = 1
+	walOpDelete byte = 2
+)
+
+var errInvalidWALRecord = errors.New("invalid write-ahead log record")
+
+// walRecord is a Put, if key is not nil, or a Delete.
+type walRecord struct {
+	key   []byte
+	value []byte
+
+	hash ihash.Hash
+	seq  uint64
+}
+
+// wal is a write-ahead log for the single Puts and Deletes. Records are
+// written in order, and fsynced in groups: a sync covers all the records
+// appended before it, so concurrent writers share it.
+type wal struct {
+	mu sync.Mutex // protects f, w and written
+	f  iio.File
+	w  *bufio.Writer
+	// written is the number of appended records, never reset
+	written uint64
+
+	syncMu sync.Mutex // serializes syncs and truncations
+	synced uint64
+}
+
+// openWAL opens the write-ahead log on the given path, creating it if
+// needed. Existing records are kept until truncate is called.
+func openWAL(fsys iio.FS, p string) (*wal, error) {
+	f, err := iio.OpenFile(fsys, p, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &wal{f: f, w: bufio.NewWriter(f)}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, multierr.Combine(err, f.Close())
+	}
+
+	torn, err := tornWALHeader(f, fi.Size())
+	if err != nil {
+		return nil, multierr.Combine(err, f.Close())
+	}
+
+	// records are only written after syncing the header, so a log with a
+	// header not completely written is empty
+	if torn {
+		if err := l.reset(); err != nil {
+			return nil, multierr.Combine(err, f.Close())
+		}
+	}
+
+	return l, nil
+}
+
+// tornWALHeader returns true if the header was not completely written: the
+// file is shorter than the header, or some of its bytes are still zero.
+func tornWALHeader(f iio.File, size int64) (bool, error) {
+	if size < walHeaderSize {
+		return true, nil
+	}
+
+	header := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return false, err
+	}
+
+	expected := make([]byte, walHeaderSize)
+	copy(expected, walSig)
+	binary.BigEndian.PutUint32(expected[len(walSig):], walVersion)
+
+	if bytes.Equal(header, expected) {
+		return false, nil
+	}
+
+	for i, b := range header {
+		if b != 0 && b != expected[i] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// replay calls fn with all the valid records on the log, in order.
+func (l *wal) replay(fn func(r *walRecord) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fi, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(l.f)
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header[:len(walSig)], walSig) {
+		return errors.New("not a valid write-ahead log file")
+	}
+
+	if binary.BigEndian.Uint32(header[len(walSig):]) > walVersion {
+		return errors.New("not a valid write-ahead log version")
+	}
+
+	end := int64(walHeaderSize)
+	for {
+		rec, n, err := readWALRecord(r, fi.Size())
+		if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, errInvalidWALRecord) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+
+		end += n
+	}
+
+	// new records are appended after the valid ones
+	if err := l.f.Truncate(end); err != nil {
+		return err
+	}
+
+	_, err = l.f.Seek(end, io.SeekStart)
+	return err
+}
+
+// readWALRecord reads the next record, returning also its size. Sizes bigger
+// than the whole file belong to a corrupted record.
+func readWALRecord(r io.Reader, fileSize int64) (*walRecord, int64, error) {
+	var buf bytes.Buffer
+	tr := io.TeeReader(r, &buf)
+
+	readBytes := func() ([]byte, error) {
+		var size uint32
+		if err := binary.Read(tr, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+
+		if int64(size) > fileSize {
+			return nil, errInvalidWALRecord
+		}
+
+		b := make([]byte, size)
+		_, err := io.ReadFull(tr, b)
+		return b, err
+	}
+
+	var op [1]byte
+	if _, err := io.ReadFull(tr, op[:]); err != nil {
+		return nil, 0, err
+	}
+
+	rec := &walRecord{}
+	switch op[0] {
+	case walOpPut:
+		var err error
+		if rec.key, err = readBytes(); err != nil {
+			return nil, 0, err
+		}
+
+		if rec.value, err = readBytes(); err != nil {
+			return nil, 0, err
+		}
+	case walOpDelete:
+		if _, err := io.ReadFull(tr, rec.hash[:]); err != nil {
+			return nil, 0, err
+		}
+
+		if err := binary.Read(tr, binary.BigEndian, &rec.seq); err != nil {
+			return nil, 0, err
+		}
+	default:
+		return nil, 0, errInvalidWALRecord
+	}
+
+	var crc uint32
+	if err := binary.Read(r, binary.BigEndian, &crc); err != nil {
+		return nil, 0, err
+	}
+
+	if packfile.Checksum(buf.Bytes()) != crc {
+		return nil, 0, errInvalidWALRecord
+	}
+
+	return rec, int64(buf.Len()) + 4, nil
+}
+
+// appendPut adds a Put record, returning the number to wait for using sync.
+func (l *wal) appendPut(key, value []byte) (uint64, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1+4+len(key)+4+len(value)+4))
+	buf.WriteByte(walOpPut)
+	writeWALBytes(buf, key)
+	writeWALBytes(buf, value)
+
+	return l.append(buf)
+}
+
+// appendDelete adds a Delete record, returning the number to wait for using
+// sync.
+func (l *wal) appendDelete(k ihash.Hash, seq uint64) (uint64, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1+ihash.KeySize+8+4))
+	buf.WriteByte(walOpDelete)
+	buf.Write(k[:])
+
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], seq)
+	buf.Write(s[:])
+
+	return l.append(buf)
+}
+
+func writeWALBytes(buf *bytes.Buffer, b []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+	buf.Write(size[:])
+	buf.Write(b)
+}
+
+func (l *wal) append(buf *bytes.Buffer) (uint64, error) {
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], packfile.Checksum(buf.Bytes()))
+	buf.Write(crc[:])
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	l.written++
+
+	return l.written, nil
+}
+
+// appended returns the number of appended records, to sync all of them.
+func (l *wal) appended() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.written
+}
+
+// sync makes durable all the records until the n-th appended one. If a
+// previous sync already covered it, it returns without writing anything.
+func (l *wal) sync(n uint64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	if l.synced >= n {
+		return nil
+	}
+
+	l.mu.Lock()
+	err := l.w.Flush()
+	written := l.written
+	l.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// records appended meanwhile are written on the following sync
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+
+	l.synced = written
+
+	return nil
+}
+
+// truncate removes all the records. It must be called once they are on a
+// committed packfile.
+func (l *wal) truncate() error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.reset(); err != nil {
+		return err
+	}
+
+	l.synced = l.written
+
+	return nil
+}
+
+// reset leaves the log only with its header. It must be called holding the
+// locks.
+func (l *wal) reset() error {
+	l.w.Reset(l.f)
+
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	l.w.Write(walSig)
+	if err := binary.Write(l.w, binary.BigEndian, walVersion); err != nil {
+		return err
+	}
+
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+
+	return l.f.Sync()
+}
+
+func (l *wal) close() error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return multierr.Combine(l.w.Flush(), l.f.Sync(), l.f.Close())
+}